@@ -0,0 +1,500 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardingHeaders are the headers proxies commonly use to pass the address of the client on.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Real-Ip",
+	"True-Client-Ip",
+	"Cf-Connecting-Ip",
+	"Fastly-Client-Ip",
+	"X-Client-Ip",
+	"X-Cluster-Client-Ip",
+	"Client-Ip",
+	"Via",
+}
+
+// auditRequest is what the echo target saw of one request the proxy relayed.
+type auditRequest struct {
+	Received   time.Time   `json:"-"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remote_addr"`
+	Proto      string      `json:"proto"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"-"`
+	TLSVersion string      `json:"tls_version,omitempty"`
+	TLSCipher  string      `json:"tls_cipher,omitempty"`
+	ALPN       string      `json:"alpn,omitempty"`
+	ServerName string      `json:"server_name,omitempty"`
+	// ClientCertificate is the subject of the certificate the proxy presented, if any.
+	ClientCertificate string `json:"client_certificate,omitempty"`
+	// Delay is the time between the client sending the query and the target receiving it.
+	Delay time.Duration `json:"delay_ns"`
+}
+
+// auditRecorder keeps every request the echo target receives.
+type auditRecorder struct {
+	sync.Mutex
+	requests []auditRequest
+}
+
+func (a *auditRecorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readLimitedBody(r.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		request := auditRequest{
+			Received:   time.Now(),
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			RemoteAddr: r.RemoteAddr,
+			Proto:      r.Proto,
+			Header:     r.Header.Clone(),
+			Body:       body,
+		}
+		if r.TLS != nil {
+			request.TLSVersion = tlsVersionName(r.TLS.Version)
+			request.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+			request.ALPN = r.TLS.NegotiatedProtocol
+			request.ServerName = r.TLS.ServerName
+			if len(r.TLS.PeerCertificates) > 0 {
+				request.ClientCertificate = r.TLS.PeerCertificates[0].Subject.String()
+			}
+		}
+		a.Lock()
+		a.requests = append(a.requests, request)
+		a.Unlock()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *auditRecorder) received() []auditRequest {
+	a.Lock()
+	defer a.Unlock()
+	return append([]auditRequest{}, a.requests...)
+}
+
+// echoResolver answers every query with an empty NOERROR response, so that the audit never sends
+// anything upstream.
+type echoResolver struct{}
+
+func (echoResolver) Resolve(query *dns.Msg) (*dns.Msg, error) {
+	response := new(dns.Msg)
+	response.SetReply(query)
+	return response, nil
+}
+
+// auditQuery is a query the client sent through the proxy.
+type auditQuery struct {
+	sent    time.Time
+	message []byte
+}
+
+type auditResult struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type auditReport struct {
+	Proxy  string `json:"proxy"`
+	Target string `json:"target"`
+	// ClientAddresses are the addresses the client is known by, searched for in what the target saw.
+	ClientAddresses []string       `json:"client_addresses"`
+	Canary          string         `json:"canary"`
+	Sent            int            `json:"sent"`
+	Requests        []auditRequest `json:"requests"`
+	Results         []auditResult  `json:"results"`
+	LeaksIdentity   bool           `json:"leaks_identity"`
+}
+
+// auditor sends queries carrying canaries through the proxy to its own echo target and inspects
+// what arrives there.
+type auditor struct {
+	client     *http.Client
+	proxy      string
+	targetName string
+	config     odoh.ObliviousDoHConfig
+	canary     string
+	// clientAddresses holds the addresses of the client, from --client-ip and the local addresses
+	// of the connections to the proxy.
+	clientAddresses map[string]bool
+	queries         []auditQuery
+}
+
+func (a *auditor) send(domain string) error {
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	dnsQuery.Id = 0
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		return err
+	}
+	message, queryContext, err := sealQuery(odoh.CreateObliviousDNSQuery(packedDnsQuery, 0), a.config)
+	if err != nil {
+		return err
+	}
+	serialized := message.Marshal()
+	req, err := prepareHttpRequest(serialized, true, a.targetName, a.proxy)
+	if err != nil {
+		return err
+	}
+	// Everything a browser-like client might send, each marked so that it can be recognised at
+	// the target if the proxy passes it on.
+	query := req.URL.Query()
+	query.Set("audit", a.canary)
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("User-Agent", "odoh-audit/"+a.canary)
+	req.Header.Set("Cookie", "odoh-audit="+a.canary)
+	req.Header.Set("Accept-Language", "x-"+a.canary[:8])
+	req.Header.Set("Referer", "https://"+a.canary+".invalid/")
+	req.Header.Set("X-Odoh-Audit", a.canary)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if host, _, err := net.SplitHostPort(info.Conn.LocalAddr().String()); err == nil {
+				a.clientAddresses[host] = true
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
+	sent := time.Now()
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+	body, err := readLimitedBody(resp.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy answered with status %d", resp.StatusCode)
+	}
+	response, err := unmarshalObliviousMessage(body)
+	if err != nil {
+		return err
+	}
+	if _, err := validateEncryptedResponse(response, queryContext); err != nil {
+		return err
+	}
+	a.queries = append(a.queries, auditQuery{sent: sent, message: serialized})
+	return nil
+}
+
+// addresses returns the client addresses found in s. The addresses are compared as IPs, so that
+// 10.0.0.1 does not match 10.0.0.12.
+func (a *auditor) addresses(s string) []string {
+	ips := addressTokens(s)
+	var found []string
+	for address := range a.clientAddresses {
+		clientIP := net.ParseIP(address)
+		for _, ip := range ips {
+			if ip.Equal(clientIP) {
+				found = append(found, address)
+				break
+			}
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// addressTokens returns the IPs in header values and URLs, such as those of X-Forwarded-For, of
+// `Forwarded: for="[2001:db8::1]:443"` or of a query parameter, with or without a port.
+func addressTokens(s string) []net.IP {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		s = unescaped
+	}
+	tokens := strings.FieldsFunc(s, func(r rune) bool {
+		return strings.ContainsRune(" \t,;=&?/\"[]", r)
+	})
+	var ips []net.IP
+	for _, token := range tokens {
+		if host, _, err := net.SplitHostPort(token); err == nil {
+			token = host
+		}
+		if ip := net.ParseIP(token); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// check inspects the requests the target received. Headers naming the client, canaries and a
+// connection from the client address are leaks; forwarding headers without the client address
+// and modified messages only deserve a warning.
+func (a *auditor) check(requests []auditRequest, proxyAddresses map[string]bool) []auditResult {
+	var forwarded, forwardedAddresses, canaryHeaders, addressHeaders, canaryURLs, directConnections []string
+	modified := 0
+	for _, request := range requests {
+		for _, name := range forwardingHeaders {
+			if values, ok := request.Header[name]; ok {
+				forwarded = append(forwarded, name)
+				if found := a.addresses(strings.Join(values, ",")); len(found) > 0 {
+					forwardedAddresses = append(forwardedAddresses, name+": "+strings.Join(found, ","))
+				}
+			}
+		}
+		for name, values := range request.Header {
+			value := strings.Join(values, ",")
+			if strings.Contains(value, a.canary) || strings.Contains(value, a.canary[:8]) {
+				canaryHeaders = append(canaryHeaders, name)
+			}
+			if found := a.addresses(value); len(found) > 0 {
+				addressHeaders = append(addressHeaders, name)
+			}
+		}
+		if strings.Contains(request.URL, a.canary) {
+			canaryURLs = append(canaryURLs, request.URL)
+		}
+		if found := a.addresses(request.URL); len(found) > 0 {
+			canaryURLs = append(canaryURLs, request.URL)
+		}
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil && a.clientAddresses[host] && !proxyAddresses[host] {
+			directConnections = append(directConnections, host)
+		}
+		unchanged := false
+		for _, query := range a.queries {
+			if bytes.Equal(query.message, request.Body) {
+				unchanged = true
+			}
+		}
+		if !unchanged {
+			modified++
+		}
+	}
+
+	results := []auditResult{
+		auditStatus("no forwarding header names the client", forwardedAddresses, AUDIT_LEAK),
+		auditStatus("client headers are not passed on", canaryHeaders, AUDIT_LEAK),
+		auditStatus("client address does not appear in the headers", addressHeaders, AUDIT_LEAK),
+		auditStatus("client query parameters are not passed on", canaryURLs, AUDIT_LEAK),
+		auditStatus("target connection does not come from the client", directConnections, AUDIT_LEAK),
+		auditStatus("no forwarding headers are added", forwarded, AUDIT_WARN),
+	}
+	relayed := auditResult{Check: "messages are relayed unchanged", Status: AUDIT_PASS}
+	if modified > 0 {
+		relayed.Status = AUDIT_WARN
+		relayed.Detail = fmt.Sprintf("%d of %d messages differ from those sent", modified, len(requests))
+	}
+	return append(results, relayed)
+}
+
+// auditStatus fails the check with the status if anything was found, listing the distinct findings.
+func auditStatus(check string, found []string, status string) auditResult {
+	if len(found) == 0 {
+		return auditResult{Check: check, Status: AUDIT_PASS}
+	}
+	distinct := make(map[string]bool)
+	var detail []string
+	for _, finding := range found {
+		if !distinct[finding] {
+			distinct[finding] = true
+			detail = append(detail, finding)
+		}
+	}
+	sort.Strings(detail)
+	return auditResult{Check: check, Status: status, Detail: strings.Join(detail, "; ")}
+}
+
+// lookupAddresses resolves the host of the proxy, so that the connection of a proxy running next to
+// the client is not mistaken for the client itself.
+func lookupAddresses(host string) map[string]bool {
+	addresses := make(map[string]bool)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addresses[ip.String()] = true
+		return addresses
+	}
+	resolved, err := net.LookupHost(host)
+	if err != nil {
+		return addresses
+	}
+	for _, address := range resolved {
+		addresses[address] = true
+	}
+	return addresses
+}
+
+func runPrivacyAudit(c *cli.Context) error {
+	proxy := c.String("proxy")
+	if len(proxy) == 0 {
+		return errors.New("--proxy is required")
+	}
+	if c.Int("queries") < 1 {
+		return errors.New("--queries must be at least 1")
+	}
+
+	key, err := mintKey(hpkeSuite{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128}, ODOH_VERSION_RFC9230, nil)
+	if err != nil {
+		return err
+	}
+	recorder := &auditRecorder{}
+	target := &odohTarget{
+		keys:      []mintedKey{key},
+		configs:   odoh.CreateObliviousDoHConfigs([]odoh.ObliviousDoHConfig{key.Config}).Marshal(),
+		configTTL: 0,
+		resolver:  echoResolver{},
+	}
+
+	listener, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return err
+	}
+	targetName := c.String("target-name")
+	if len(targetName) == 0 {
+		targetName = listener.Addr().String()
+	}
+	certificate, err := serverCertificate(c, listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	server := &http.Server{
+		Handler: recorder.wrap(target.handler()),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			// Ask for a client certificate to see whether the proxy presents one.
+			ClientAuth: tls.RequestClientCert,
+		},
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client, err := withProxyCredentials(c, &http.Client{Transport: httpTransport, Timeout: c.Duration("timeout")}, []string{proxy})
+	if err != nil {
+		return err
+	}
+	canary := make([]byte, 16)
+	if _, err := rand.Read(canary); err != nil {
+		return err
+	}
+	audit := &auditor{
+		client:          client,
+		proxy:           proxy,
+		targetName:      targetName,
+		config:          key.Config,
+		canary:          hex.EncodeToString(canary),
+		clientAddresses: make(map[string]bool),
+	}
+	for _, address := range c.StringSlice("client-ip") {
+		if ip := net.ParseIP(address); ip != nil {
+			audit.clientAddresses[ip.String()] = true
+		}
+	}
+	for i := 0; i < c.Int("queries"); i++ {
+		if err := audit.send(c.String("domain")); err != nil {
+			return fmt.Errorf("query %d through %v failed: %v", i+1, proxy, err)
+		}
+	}
+
+	requests := recorder.received()
+	for i := range requests {
+		for _, query := range audit.queries {
+			if bytes.Equal(query.message, requests[i].Body) {
+				requests[i].Delay = requests[i].Received.Sub(query.sent)
+			}
+		}
+	}
+	report := auditReport{
+		Proxy:    proxy,
+		Target:   targetName,
+		Canary:   audit.canary,
+		Sent:     len(audit.queries),
+		Requests: requests,
+		Results:  audit.check(requests, lookupAddresses(proxyHost(proxy))),
+	}
+	for address := range audit.clientAddresses {
+		report.ClientAddresses = append(report.ClientAddresses, address)
+	}
+	sort.Strings(report.ClientAddresses)
+	for _, result := range report.Results {
+		if result.Status == AUDIT_LEAK {
+			report.LeaksIdentity = true
+		}
+	}
+
+	if c.String("output") == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.print()
+	}
+
+	if report.LeaksIdentity {
+		return cli.NewExitError(fmt.Sprintf("%s leaks client identity to the target", proxy), 1)
+	}
+	return nil
+}
+
+func (r auditReport) print() {
+	fmt.Printf("Privacy audit of %s -> %s (%d queries sent, %d received)\n", r.Proxy, r.Target, r.Sent, len(r.Requests))
+	fmt.Printf("Client addresses: %s\n", strings.Join(r.ClientAddresses, ", "))
+	for i, request := range r.Requests {
+		fmt.Printf("Request %d: %s %s %s from %s, delay %v\n", i+1, request.Proto, request.Method, request.URL, request.RemoteAddr, request.Delay)
+		if len(request.TLSVersion) > 0 {
+			certificate := "none"
+			if len(request.ClientCertificate) > 0 {
+				certificate = request.ClientCertificate
+			}
+			fmt.Printf("  TLS: %s, %s, ALPN %q, SNI %q, client certificate %s\n", request.TLSVersion, request.TLSCipher, request.ALPN, request.ServerName, certificate)
+		}
+		names := make([]string, 0, len(request.Header))
+		for name := range request.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s: %s\n", name, strings.Join(request.Header[name], ", "))
+		}
+	}
+	for _, result := range r.Results {
+		if len(result.Detail) > 0 {
+			fmt.Printf("  %s %s (%s)\n", strings.ToUpper(result.Status), result.Check, result.Detail)
+		} else {
+			fmt.Printf("  %s %s\n", strings.ToUpper(result.Status), result.Check)
+		}
+	}
+	if r.LeaksIdentity {
+		fmt.Println("The proxy leaks client identity to the target")
+	} else {
+		fmt.Println("No client identity reached the target")
+	}
+}
@@ -0,0 +1,210 @@
+package commands
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// tokenProvider supplies the bearer token presented to the proxy, which may change between requests.
+type tokenProvider interface {
+	Token() (string, error)
+}
+
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// fileTokenProvider reads the token from a file on every request, so that an external process can
+// rotate the token by rewriting the file.
+type fileTokenProvider struct {
+	path string
+}
+
+func (f fileTokenProvider) Token() (string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if len(token) == 0 {
+		return "", fmt.Errorf("no token in %v", f.path)
+	}
+	return token, nil
+}
+
+// proxyAuthenticator adds credentials to a request addressed to the proxy.
+type proxyAuthenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+type bearerAuthenticator struct {
+	tokens tokenProvider
+}
+
+func (b bearerAuthenticator) Authenticate(req *http.Request) error {
+	token, err := b.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("unable to obtain the proxy token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+type basicAuthenticator struct {
+	username string
+	password string
+}
+
+func (b basicAuthenticator) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(b.username, b.password)
+	return nil
+}
+
+// proxyCredentials carries the requests of a client, authenticating those addressed to one of the
+// proxies. Targets and every other host get the requests untouched and never see the client
+// certificate, whichever proxy or redirect led there.
+type proxyCredentials struct {
+	proxies       map[string]bool
+	authenticator proxyAuthenticator
+	// insecure allows the credentials to go over plain HTTP, for --proxy-insecure-auth.
+	insecure bool
+	// proxyTransport carries the requests to the proxies, presenting the client certificate if any.
+	proxyTransport http.RoundTripper
+	transport      http.RoundTripper
+}
+
+func (p *proxyCredentials) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !p.proxies[strings.ToLower(req.URL.Host)] {
+		return p.transport.RoundTrip(req)
+	}
+	if p.authenticator != nil {
+		if req.URL.Scheme != "https" && !p.insecure {
+			return nil, fmt.Errorf("refusing to send the proxy credentials to %s over plain HTTP", req.URL.Host)
+		}
+		// A RoundTripper must not modify the request it was given.
+		req = req.Clone(req.Context())
+		if err := p.authenticator.Authenticate(req); err != nil {
+			return nil, err
+		}
+	}
+	return p.proxyTransport.RoundTrip(req)
+}
+
+// proxyBaseURL accepts the proxy as host:port, reached over PROXY_HTTP_MODE, or as a URL, which
+// allows HTTPS proxies and client certificates.
+func proxyBaseURL(proxy string) string {
+	if strings.Contains(proxy, "://") {
+		return strings.TrimSuffix(proxy, "/")
+	}
+	return PROXY_HTTP_MODE + "://" + proxy
+}
+
+func proxyHost(proxy string) string {
+	proxyURL, err := url.Parse(proxyBaseURL(proxy))
+	if err != nil {
+		return proxy
+	}
+	return proxyURL.Host
+}
+
+// newProxyAuthenticator reads the authentication flags shared by the commands talking to proxies.
+func newProxyAuthenticator(c *cli.Context) (proxyAuthenticator, error) {
+	var authenticators []proxyAuthenticator
+	if len(c.String("proxy-token")) > 0 {
+		authenticators = append(authenticators, bearerAuthenticator{staticToken(c.String("proxy-token"))})
+	}
+	if len(c.String("proxy-token-file")) > 0 {
+		authenticators = append(authenticators, bearerAuthenticator{fileTokenProvider{path: c.String("proxy-token-file")}})
+	}
+	if len(c.String("proxy-basic")) > 0 {
+		credentials := strings.SplitN(c.String("proxy-basic"), ":", 2)
+		if len(credentials) != 2 {
+			return nil, errors.New("--proxy-basic expects user:password")
+		}
+		authenticators = append(authenticators, basicAuthenticator{credentials[0], credentials[1]})
+	}
+	if len(authenticators) > 1 {
+		return nil, errors.New("only one of --proxy-token, --proxy-token-file and --proxy-basic may be given")
+	}
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	return authenticators[0], nil
+}
+
+// newProxyHTTPClient returns the client for a command that sends requests through the proxies,
+// carrying the credentials given by the authentication flags to those proxies only and sending the
+// headers of --header-policy.
+func newProxyHTTPClient(c *cli.Context, proxies ...string) (*http.Client, error) {
+	return configureProxyClient(c, &http.Client{Transport: httpTransport, Timeout: HTTP_CLIENT_TIMEOUT}, proxies)
+}
+
+func configureProxyClient(c *cli.Context, client *http.Client, proxies []string) (*http.Client, error) {
+	policy, err := parseHeaderPolicy(c.String("header-policy"))
+	if err != nil {
+		return nil, err
+	}
+	client, err = withProxyCredentials(c, client, proxies)
+	if err != nil {
+		return nil, err
+	}
+	return withHeaderPolicy(client, policy), nil
+}
+
+func withProxyCredentials(c *cli.Context, client *http.Client, proxies []string) (*http.Client, error) {
+	authenticator, err := newProxyAuthenticator(c)
+	if err != nil {
+		return nil, err
+	}
+	certificateFile, keyFile := c.String("proxy-cert"), c.String("proxy-key")
+	if authenticator == nil && len(certificateFile) == 0 && len(keyFile) == 0 {
+		return client, nil
+	}
+
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	credentials := &proxyCredentials{
+		proxies:        make(map[string]bool),
+		authenticator:  authenticator,
+		insecure:       c.Bool("proxy-insecure-auth"),
+		proxyTransport: transport,
+		transport:      transport,
+	}
+	for _, proxy := range proxies {
+		if len(proxy) == 0 {
+			continue
+		}
+		// Bearer tokens and Basic credentials are as good as a password to whoever sees them.
+		if authenticator != nil && !credentials.insecure && !strings.HasPrefix(proxyBaseURL(proxy), "https://") {
+			return nil, fmt.Errorf("refusing to send the proxy credentials to %s over plain HTTP, give the proxy as an https:// URL or pass --proxy-insecure-auth", proxy)
+		}
+		credentials.proxies[strings.ToLower(proxyHost(proxy))] = true
+	}
+	if len(certificateFile) > 0 || len(keyFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		base, ok := transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("client certificates require an http.Transport")
+		}
+		proxyTransport := base.Clone()
+		if proxyTransport.TLSClientConfig == nil {
+			proxyTransport.TLSClientConfig = &tls.Config{}
+		}
+		proxyTransport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+		credentials.proxyTransport = proxyTransport
+	}
+	return &http.Client{Transport: credentials, Timeout: client.Timeout}, nil
+}
@@ -1,9 +1,12 @@
 package commands
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	odoh "github.com/cloudflare/odoh-go"
 	"github.com/miekg/dns"
 	"github.com/urfave/cli"
@@ -16,6 +19,7 @@ import (
 
 // This runningTime structure contains the epoch timestamps for each of the operations
 // taking place. The explanations are as follows:
+// 0. Queued => Epoch time at which the query was handed to the timing policy, so that Start - Queued is the latency cost of the policy.
 // 1. Start => Epoch time at which the client starts to prepare the question
 // 2. ClientQueryEncryptionTime => Epoch time at which the client completes the encryption and serialization of the question.
 // 3. ClientUpstreamRequestTime => Epoch time indicating the start of the network request.
@@ -23,6 +27,7 @@ import (
 // 5. EndTime => Epoch time indicating the end of all tasks for the request.
 // NOTE: All timestamps are stored in NanoSecond granularity and need to be converted into microseconds (/1000.0) or milliseconds (/1000.0^2)
 type runningTime struct {
+	Queued                       int64
 	Start                        int64
 	ClientQueryEncryptionTime    int64
 	ClientUpstreamRequestTime    int64
@@ -32,15 +37,24 @@ type runningTime struct {
 }
 
 type experiment struct {
-	ExperimentID    string
-	Hostname        string
-	DnsType         uint16
-	TargetPublicKey odoh.ObliviousDoHConfigContents
+	ExperimentID  string
+	Hostname      string
+	DnsType       uint16
+	TargetConfigs []odoh.ObliviousDoHConfig
+	// Protocol is PROTOCOL_OHTTP to send DoH over Oblivious HTTP with OHTTPConfigs instead of ODoH.
+	Protocol     string
+	OHTTPConfigs []ohttpKeyConfig
+	// Relay overrides the relay endpoint of Proxy for Oblivious HTTP.
+	Relay string
 	// Instrumentation
 	Proxy  string
 	Target string
 	// Timing parameters
 	IngestedFrom string
+	// Padded pads the DNS query with EDNS(0) padding, so that queries under cover traffic all have
+	// the same size, and Decoy marks the decoys of cover traffic.
+	Padded bool
+	Decoy  bool
 }
 
 type experimentResult struct {
@@ -62,6 +76,11 @@ type experimentResult struct {
 	IngestedFrom string
 	ProtocolType string
 	ExperimentID string
+	// TimingPolicy is the timing policy the query was sent under, Dummy marks the dummy queries of
+	// constant-rate and Decoy the decoys of cover traffic.
+	TimingPolicy string
+	Dummy        bool
+	Decoy        bool
 }
 
 func (e *experimentResult) serialize() string {
@@ -81,11 +100,16 @@ type DiscoveryServiceResponse struct {
 func (e *experiment) run(client *http.Client, channel chan experimentResult) {
 	hostname := e.Hostname
 	dnsType := e.DnsType
-	targetPublicKey := e.TargetPublicKey
+	targetConfigs := e.TargetConfigs
 	proxy := e.Proxy
 	target := e.Target
 	expId := e.ExperimentID
 
+	if e.Protocol == PROTOCOL_OHTTP {
+		e.runOHTTP(client, channel)
+		return
+	}
+
 	shouldUseProxy := false
 
 	if proxy != "" {
@@ -99,15 +123,21 @@ func (e *experiment) run(client *http.Client, channel chan experimentResult) {
 
 	dnsQuery := new(dns.Msg)
 	dnsQuery.SetQuestion(hostname, dnsType)
+	if e.Padded {
+		if err := padDnsQuery(dnsQuery); err != nil {
+			log.Fatalf("padDnsQuery failed: %v", err)
+		}
+	}
 	packedDnsQuery, err := dnsQuery.Pack()
 	if err != nil {
 		log.Fatalf("dns.Pack() failed: %v", err)
 	}
 
-	odohQuery, queryContext, err := createOdohQuestion(packedDnsQuery, targetPublicKey)
+	odohQuery, queryContext, targetConfig, err := createOdohQuestionWithConfigs(packedDnsQuery, targetConfigs)
 	if err != nil {
 		log.Fatalf("createOdohQuestion failed: %v", err)
 	}
+	targetPublicKey := targetConfig.Contents
 
 	timeToPrepareQuestionAndSerialize := time.Now().UnixNano()
 	rt.ClientQueryEncryptionTime = timeToPrepareQuestionAndSerialize
@@ -206,8 +236,100 @@ func (e *experiment) run(client *http.Client, channel chan experimentResult) {
 	channel <- exp
 }
 
-func responseHandler(numberOfChannels int, responseChannel chan experimentResult) []string {
-	responses := make([]string, 0)
+// runOHTTP is the DoH over Oblivious HTTP counterpart of run, recording the same timestamps.
+func (e *experiment) runOHTTP(client *http.Client, channel chan experimentResult) {
+	rt := runningTime{}
+	start := time.Now()
+	rt.Start = start.UnixNano()
+	exp := experimentResult{
+		Hostname:     e.Hostname,
+		DnsType:      e.DnsType,
+		Target:       e.Target,
+		Proxy:        e.Proxy,
+		STime:        start,
+		IngestedFrom: e.IngestedFrom,
+		ProtocolType: "OHTTP",
+		ExperimentID: e.ExperimentID,
+	}
+	fail := func(err error) {
+		exp.ETime = time.Now()
+		exp.DnsAnswer = []byte(err.Error())
+		exp.Timestamp = rt
+		channel <- exp
+	}
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(e.Hostname, e.DnsType)
+	if e.Padded {
+		if err := padDnsQuery(dnsQuery); err != nil {
+			log.Fatalf("padDnsQuery failed: %v", err)
+		}
+	}
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		log.Fatalf("dns.Pack() failed: %v", err)
+	}
+	gatewayURL := ohttpGatewayURL(e.Target)
+	relayURL, err := ohttpRelayURL(e.Relay, e.Proxy, gatewayURL)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	encapsulated, requestContext, err := sealOHTTPQueryWithConfigs(packedDnsQuery, e.Target, e.OHTTPConfigs)
+	if err != nil {
+		log.Fatalf("sealOHTTPQuery failed: %v", err)
+	}
+	rt.ClientQueryEncryptionTime = time.Now().UnixNano()
+	rt.ClientUpstreamRequestTime = time.Now().UnixNano()
+	encapsulatedResponse, err := exchangeOHTTP(context.Background(), encapsulated, relayURL, client)
+	rt.ClientDownstreamResponseTime = time.Now().UnixNano()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	dnsAnswer, err := openOHTTPAnswer(encapsulatedResponse, requestContext)
+	rt.ClientAnswerDecryptionTime = time.Now().UnixNano()
+	if err != nil {
+		fail(err)
+		return
+	}
+	dnsAnswerBytes, err := dnsAnswer.Pack()
+	if err != nil {
+		fail(err)
+		return
+	}
+	rt.EndTime = time.Now().UnixNano()
+
+	requestId := make([]byte, 2)
+	binary.BigEndian.PutUint16(requestId, uint16(dnsQuery.Id))
+	exp.ETime = time.Now()
+	exp.RequestID = hex.EncodeToString(requestId)
+	exp.DnsQuestion = encapsulated
+	exp.DnsAnswer = dnsAnswerBytes
+	exp.Timestamp = rt
+	exp.Status = true
+	log.Printf("experiment : %v", exp.serialize())
+	channel <- exp
+}
+
+// runScheduled runs the experiment once the scheduler releases it and records when it was queued.
+func (e experiment) runScheduled(scheduler *queryScheduler, policy timingPolicy, client *http.Client, channel chan experimentResult) {
+	queued := time.Now()
+	scheduler.Submit(func() {
+		results := make(chan experimentResult, 1)
+		e.run(client, results)
+		result := <-results
+		result.Timestamp.Queued = queued.UnixNano()
+		result.TimingPolicy = policy.String()
+		result.Decoy = e.Decoy
+		channel <- result
+	})
+}
+
+func responseHandler(numberOfChannels int, responseChannel chan experimentResult) []experimentResult {
+	responses := make([]experimentResult, 0)
 	for index := 0; index < numberOfChannels; index++ {
 		answerStructure := <-responseChannel
 		answer := answerStructure.DnsAnswer
@@ -219,7 +341,7 @@ func responseHandler(numberOfChannels int, responseChannel chan experimentResult
 		log.Printf("Response %v\n", index)
 		log.Printf("Size of the Response for [%v] is [%v] and [%v] to [%v] = [%v] using Proxy [%v] using Target [%v]",
 			hostname, len(answer), sTime.UnixNano(), eTime.UnixNano(), eTime.Sub(sTime).Microseconds(), proxy, target)
-		responses = append(responses, answerStructure.serialize())
+		responses = append(responses, answerStructure)
 	}
 	return responses
 }
@@ -252,6 +374,28 @@ func benchmarkClient(c *cli.Context) {
 	defer f.Close()
 	log.SetOutput(f)
 
+	telemetryState := getTelemetryInstance()
+	//telemetryResponse := telemetryState.getClusterInformation()
+	//log.Printf("Server: %s", telemetryResponse["version"].(map[string]interface{})["number"])
+
+	results, err := runBenchmark(c, clientInstanceName, experimentID)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	responses := make([]string, 0, len(results))
+	for _, result := range results {
+		responses = append(responses, result.serialize())
+	}
+	log.Printf("Collected [%v] Responses.", len(responses))
+	telemetryState.streamLogsToGCP(responses)
+	//telemetryState.streamLogsToELK(responses)
+
+	telemetryState.tearDown()
+}
+
+// runBenchmark runs the queries of `bench` and returns their results, leaving the log file and the
+// telemetry to benchmarkClient.
+func runBenchmark(c *cli.Context, clientInstanceName string, experimentID string) ([]experimentResult, error) {
 	// The Preparation Phase of the request.
 	filepath := c.String("data")
 	filterCount := c.Uint64("pick")
@@ -259,51 +403,156 @@ func benchmarkClient(c *cli.Context) {
 	requestPerMinute := c.Uint64("rate") // requests/minute
 	discoveryServiceHostname := c.String("discovery")
 	tickTrigger := getTickTriggerTiming(int(requestPerMinute))
+	suitePreference, err := parseSuitePreference(c.String("suites"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the HPKE suite preference. Error %v", err)
+	}
+	versionSelection, err := parseOdohVersionSelection(c.String("odoh-version"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the ODoH version selection. Error %v", err)
+	}
+	protocol := c.String("protocol")
+	if protocol != PROTOCOL_ODOH && protocol != PROTOCOL_OHTTP {
+		return nil, fmt.Errorf("Unknown protocol %v.", protocol)
+	}
+	timing, err := newTimingPolicy(c)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the timing policy. Error %v", err)
+	}
+	coverRatio := c.Float64("cover-ratio")
 
 	totalResponsesNeeded := numberOfParallelClients * filterCount
 
 	allDomains, err := readLines(filepath)
-
 	if err != nil {
-		log.Printf("Failed to read the file correctly. %v", err)
+		return nil, fmt.Errorf("Failed to read the file correctly. %v", err)
 	}
 
+	// Decoys are drawn from the whole dataset, not only from the hostnames picked for the run.
+	cover, err := newCoverTraffic(allDomains, coverRatio)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up the cover traffic. Error %v", err)
+	}
 	hostnames := shuffleAndSlice(allDomains, filterCount)
 	log.Printf("Now operating on a total size of : [%v] hostnames", len(hostnames))
+	if len(hostnames) == 0 {
+		return nil, errors.New("No hostnames to query in the dataset.")
+	}
 
-	// Create a base state of the experiment
-	state := GetInstance(numberOfParallelClients)
-	telemetryState := getTelemetryInstance()
-	//telemetryResponse := telemetryState.getClusterInformation()
-	//log.Printf("Server: %s", telemetryResponse["version"].(map[string]interface{})["number"])
+	// Create a base state of the experiment, with clients going through the outbound proxies.
+	restore, err := useOutboundProxies(c)
+	defer restore()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up the outbound proxies. Error %v", err)
+	}
+	state, err := GetInstance(numberOfParallelClients)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up the clients. Error %v", err)
+	}
 
 	// Create network requests concurrently.
 	const dnsMessageType = dns.TypeA
 
-	availableServices, err := fetchProxiesAndTargets(discoveryServiceHostname, instance.client[0])
+	availableServices, err := fetchProxiesAndTargets(discoveryServiceHostname, state.client[0])
 	if err != nil {
-		log.Fatalf("Unable to discover the services available.")
+		return nil, fmt.Errorf("Unable to discover the services available. Error %v", err)
 	}
 
 	// Obtain all the keys for the targets.
 	targets := availableServices.Targets
 	proxies := availableServices.Proxies
+	if len(targets) == 0 || len(proxies) == 0 {
+		return nil, errors.New("The discovery service lists no targets or no proxies.")
+	}
+	for index := range state.client {
+		state.client[index], err = configureProxyClient(c, state.client[index], proxies)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to set up the clients for the proxies. Error %v", err)
+		}
+	}
 	for _, target := range targets {
-		configs, err := fetchTargetConfigs(target)
+		if protocol == PROTOCOL_OHTTP {
+			ohttpConfigs, err := fetchOHTTPKeyConfigs(ohttpGatewayURL(target), state.client[0])
+			if err != nil {
+				return nil, fmt.Errorf("Unable to obtain the OHTTP keys of %v. Error %v", target, err)
+			}
+			state.InsertOHTTPConfigs(target, ohttpConfigs)
+			continue
+		}
+		fetched, err := fetchRawTargetConfigs(target, c.String("config-source"))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to obtain the ObliviousDoHConfigs from %v. Error %v", target, err)
+		}
+		configs, err := fetched.parse()
 		if err != nil {
-			log.Fatalf("Unable to obtain the ObliviousDoHConfigs from %v. Error %v", target, err)
+			return nil, fmt.Errorf("Unable to obtain the ObliviousDoHConfigs from %v. Error %v", target, err)
+		}
+		usableConfigs := orderConfigs(configs, versionSelection.versionsFor(target), suitePreference)
+		if len(usableConfigs) == 0 {
+			return nil, fmt.Errorf("No usable ObliviousDoHConfig published by %v.", target)
 		}
-		config := configs.Configs[0]
-		state.InsertKey(target, config.Contents)
+		state.InsertConfigs(target, usableConfigs)
 	}
 
-	keysAvailable := state.TotalNumberOfTargets()
-	log.Printf("%v targets available to choose from.", keysAvailable)
+	log.Printf("%v targets available to choose from.", state.TotalNumberOfTargets())
 	log.Printf("%v proxies available to choose from.", len(proxies))
 
 	start := time.Now()
 	responseChannel := make(chan experimentResult, totalResponsesNeeded)
 
+	// targetExperiments holds the experiment for each target, which newExperiment completes.
+	targetExperiments := make(map[string]experiment)
+	for _, target := range targets {
+		e := experiment{
+			ExperimentID: experimentID,
+			DnsType:      dnsMessageType,
+			Protocol:     protocol,
+			Relay:        c.String("relay"),
+			Target:       target,
+			IngestedFrom: clientInstanceName,
+			Padded:       cover != nil,
+		}
+		if protocol == PROTOCOL_OHTTP {
+			e.OHTTPConfigs, err = state.GetOHTTPConfigs(target)
+		} else {
+			e.TargetConfigs, err = state.GetTargetConfigs(target)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve the PK requested for %v. Error %v", target, err)
+		}
+		targetExperiments[target] = e
+	}
+
+	// newExperiment picks a target and a proxy at random for a query of the hostname.
+	newExperiment := func(hostname string) experiment {
+		e := targetExperiments[targets[mathrand.Intn(len(targets))]]
+		e.Hostname = hostname
+		e.Proxy = proxies[mathrand.Intn(len(proxies))]
+		return e
+	}
+
+	// Each client releases its queries under the timing policy. The dummy queries of constant-rate
+	// and the decoys of cover traffic are logged, but not counted as responses.
+	dummyChannel := make(chan experimentResult)
+	go func() {
+		for dummy := range dummyChannel {
+			log.Printf("dummy experiment : %v", dummy.serialize())
+		}
+	}()
+	schedulers := make([]*queryScheduler, numberOfParallelClients)
+	for index := range schedulers {
+		client := state.client[index]
+		schedulers[index] = newQueryScheduler(timing, func() {
+			e := newExperiment(hostnames[mathrand.Intn(len(hostnames))])
+			results := make(chan experimentResult, 1)
+			e.run(client, results)
+			result := <-results
+			result.TimingPolicy = timing.String()
+			result.Dummy = true
+			dummyChannel <- result
+		})
+	}
+
 	totalQueries := len(hostnames)
 	log.Printf("Tick Trigger : %v %v", tickTrigger, time.Duration(tickTrigger)*time.Minute)
 
@@ -323,24 +572,27 @@ func benchmarkClient(c *cli.Context) {
 				hostname := hostnames[index]
 				clientUsed := state.client[clientIndex]
 				log.Printf("Choosing [Client %v] to make a query", index%int(numberOfParallelClients))
-				chosenTarget := targets[mathrand.Intn(keysAvailable)]
-				chosenProxy := proxies[mathrand.Intn(len(proxies))]
-				targetConfigContents, err := state.GetTargetConfigContents(chosenTarget)
-				if err != nil {
-					log.Fatalf("Unable to retrieve the PK requested")
-				}
-				e := experiment{
-					ExperimentID:    experimentID,
-					Hostname:        hostname,
-					DnsType:         dnsMessageType,
-					TargetPublicKey: targetConfigContents,
-					Target:          chosenTarget,
-					Proxy:           chosenProxy,
-					IngestedFrom:    clientInstanceName,
-				}
+				e := newExperiment(hostname)
 
 				log.Printf("Request %v%v\n", index, clientIndex)
-				go e.run(clientUsed, responseChannel)
+				query := func() {
+					e.runScheduled(schedulers[clientIndex], timing, clientUsed, responseChannel)
+				}
+				// Decoys go through the same proxy to the same target as the query they cover.
+				var decoys []func()
+				if cover != nil {
+					for _, domain := range cover.decoyDomains() {
+						decoy := e
+						decoy.Hostname = domain
+						decoy.Decoy = true
+						decoys = append(decoys, func() {
+							decoy.runScheduled(schedulers[clientIndex], timing, clientUsed, dummyChannel)
+						})
+					}
+				}
+				for _, submit := range shuffleQueries(query, decoys) {
+					submit()
+				}
 			}
 			totalQueries--
 		}
@@ -353,13 +605,12 @@ func benchmarkClient(c *cli.Context) {
 	log.Printf("Reached here and triggering the responseHandler.\n")
 	responses := responseHandler(int(totalResponsesNeeded), responseChannel)
 	close(responseChannel)
+	for _, scheduler := range schedulers {
+		scheduler.Close()
+	}
+	close(dummyChannel)
 
 	totalResponse := time.Since(start)
 	log.Printf("Time to perform [%v] workflow tasks : [%v]", len(hostnames), totalResponse.Milliseconds())
-
-	log.Printf("Collected [%v] Responses.", len(responses))
-	telemetryState.streamLogsToGCP(responses)
-	//telemetryState.streamLogsToELK(responses)
-
-	telemetryState.tearDown()
+	return responses, nil
 }
@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Binary HTTP messages (RFC 9292) carry the DoH requests and responses encapsulated by Oblivious HTTP.
+// Only the known-length framing is produced, which is what OHTTP gateways are required to accept.
+
+const (
+	BHTTP_KNOWN_LENGTH_REQUEST  = 0
+	BHTTP_KNOWN_LENGTH_RESPONSE = 1
+)
+
+var errTruncatedBinaryMessage = errors.New("truncated binary HTTP message")
+
+type bhttpRequest struct {
+	Method    string
+	Scheme    string
+	Authority string
+	Path      string
+	Header    http.Header
+	Content   []byte
+}
+
+type bhttpResponse struct {
+	Status  int
+	Header  http.Header
+	Content []byte
+}
+
+// appendVarint appends a QUIC variable-length integer (RFC 9000, Section 16).
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func readVarint(data []byte) (uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, errTruncatedBinaryMessage
+	}
+	length := 1 << (data[0] >> 6)
+	if len(data) < length {
+		return 0, nil, errTruncatedBinaryMessage
+	}
+	v := uint64(data[0] & 0x3f)
+	for _, b := range data[1:length] {
+		v = v<<8 | uint64(b)
+	}
+	return v, data[length:], nil
+}
+
+func appendVarintBytes(b []byte, data []byte) []byte {
+	return append(appendVarint(b, uint64(len(data))), data...)
+}
+
+func readVarintBytes(data []byte) ([]byte, []byte, error) {
+	length, rest, err := readVarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > uint64(len(rest)) {
+		return nil, nil, errTruncatedBinaryMessage
+	}
+	return rest[:length], rest[length:], nil
+}
+
+// appendFieldSection encodes the header as a known-length field section, with lowercase names as HTTP/2
+// and HTTP/3 require. Names are sorted so that the encoding does not depend on map order.
+func appendFieldSection(b []byte, header http.Header) []byte {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fields []byte
+	for _, name := range names {
+		for _, value := range header[name] {
+			fields = appendVarintBytes(fields, []byte(strings.ToLower(name)))
+			fields = appendVarintBytes(fields, []byte(value))
+		}
+	}
+	return appendVarintBytes(b, fields)
+}
+
+func readFieldSection(data []byte) (http.Header, []byte, error) {
+	fields, rest, err := readVarintBytes(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make(http.Header)
+	for len(fields) > 0 {
+		var name, value []byte
+		if name, fields, err = readVarintBytes(fields); err != nil {
+			return nil, nil, err
+		}
+		if value, fields, err = readVarintBytes(fields); err != nil {
+			return nil, nil, err
+		}
+		header.Add(string(name), string(value))
+	}
+	return header, rest, nil
+}
+
+// readContentAndTrailer reads what follows the header section. A message may be truncated after any
+// section and may end with zero padding.
+func readContentAndTrailer(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	content, rest, err := readVarintBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		if _, rest, err = readFieldSection(rest); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return nil, errors.New("non-zero padding in binary HTTP message")
+		}
+	}
+	return content, nil
+}
+
+func (r bhttpRequest) Marshal() []byte {
+	message := appendVarint(nil, BHTTP_KNOWN_LENGTH_REQUEST)
+	message = appendVarintBytes(message, []byte(r.Method))
+	message = appendVarintBytes(message, []byte(r.Scheme))
+	message = appendVarintBytes(message, []byte(r.Authority))
+	message = appendVarintBytes(message, []byte(r.Path))
+	message = appendFieldSection(message, r.Header)
+	message = appendVarintBytes(message, r.Content)
+	// An empty trailer section.
+	return appendVarint(message, 0)
+}
+
+func unmarshalBinaryRequest(data []byte) (bhttpRequest, error) {
+	framing, rest, err := readVarint(data)
+	if err != nil {
+		return bhttpRequest{}, err
+	}
+	if framing != BHTTP_KNOWN_LENGTH_REQUEST {
+		return bhttpRequest{}, fmt.Errorf("unsupported binary HTTP framing %d", framing)
+	}
+
+	var request bhttpRequest
+	controlData := []*string{&request.Method, &request.Scheme, &request.Authority, &request.Path}
+	for _, field := range controlData {
+		var value []byte
+		if value, rest, err = readVarintBytes(rest); err != nil {
+			return bhttpRequest{}, err
+		}
+		*field = string(value)
+	}
+	request.Header = make(http.Header)
+	if len(rest) > 0 {
+		if request.Header, rest, err = readFieldSection(rest); err != nil {
+			return bhttpRequest{}, err
+		}
+	}
+	if request.Content, err = readContentAndTrailer(rest); err != nil {
+		return bhttpRequest{}, err
+	}
+	return request, nil
+}
+
+func (r bhttpResponse) Marshal() []byte {
+	message := appendVarint(nil, BHTTP_KNOWN_LENGTH_RESPONSE)
+	message = appendVarint(message, uint64(r.Status))
+	message = appendFieldSection(message, r.Header)
+	message = appendVarintBytes(message, r.Content)
+	return appendVarint(message, 0)
+}
+
+// unmarshalBinaryResponse decodes a known-length response, skipping any informational responses.
+func unmarshalBinaryResponse(data []byte) (bhttpResponse, error) {
+	framing, rest, err := readVarint(data)
+	if err != nil {
+		return bhttpResponse{}, err
+	}
+	if framing != BHTTP_KNOWN_LENGTH_RESPONSE {
+		return bhttpResponse{}, fmt.Errorf("unsupported binary HTTP framing %d", framing)
+	}
+
+	var response bhttpResponse
+	for {
+		var status uint64
+		if status, rest, err = readVarint(rest); err != nil {
+			return bhttpResponse{}, err
+		}
+		if status < 100 || status > 599 {
+			return bhttpResponse{}, fmt.Errorf("invalid status %d in binary HTTP response", status)
+		}
+		response.Status = int(status)
+		if status >= 200 {
+			break
+		}
+		if _, rest, err = readFieldSection(rest); err != nil {
+			return bhttpResponse{}, err
+		}
+	}
+	response.Header = make(http.Header)
+	if len(rest) > 0 {
+		if response.Header, rest, err = readFieldSection(rest); err != nil {
+			return bhttpResponse{}, err
+		}
+	}
+	if response.Content, err = readContentAndTrailer(rest); err != nil {
+		return bhttpResponse{}, err
+	}
+	return response, nil
+}
@@ -2,8 +2,136 @@ package commands
 
 import (
 	"github.com/urfave/cli"
+	"time"
 )
 
+var keyringFlag = cli.StringFlag{
+	Name:  "keyring",
+	Value: "odoh-keyring.json",
+	Usage: "Path of the local keyring, which holds private keys",
+}
+
+var keyringMintFlags = []cli.Flag{
+	keyringFlag,
+	cli.StringFlag{
+		Name:  "kemid",
+		Value: "32",
+	},
+	cli.StringFlag{
+		Name:  "kdfid",
+		Value: "1",
+	},
+	cli.StringFlag{
+		Name:  "aeadid",
+		Value: "1",
+	},
+	cli.StringFlag{
+		Name:  "odoh-version",
+		Value: "draft",
+		Usage: "ODoH wire format of the minted config: draft or rfc9230",
+	},
+}
+
+// proxyClientFlags configure the HTTP client of the commands sending queries through oblivious proxies.
+var proxyClientFlags = append([]cli.Flag{
+	cli.StringFlag{
+		Name:  "header-policy",
+		Value: HEADER_POLICY_MINIMAL,
+		Usage: "Request headers to send: minimal, uniform for the same headers as every other client, or none for the Go defaults",
+	},
+}, proxyAuthFlags...)
+
+// proxyAuthFlags authenticate the client to the proxies.
+var proxyAuthFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "proxy-token",
+		Usage: "Bearer token presented to the proxy",
+	},
+	cli.StringFlag{
+		Name:  "proxy-token-file",
+		Usage: "File holding the bearer token presented to the proxy, reread for every request",
+	},
+	cli.StringFlag{
+		Name:  "proxy-basic",
+		Usage: "HTTP Basic credentials for the proxy as user:password",
+	},
+	cli.BoolFlag{
+		Name:  "proxy-insecure-auth",
+		Usage: "Send --proxy-token, --proxy-token-file and --proxy-basic credentials to proxies over plain HTTP",
+	},
+	cli.StringFlag{
+		Name:  "proxy-cert",
+		Usage: "TLS client certificate presented to an https:// proxy",
+	},
+	cli.StringFlag{
+		Name:  "proxy-key",
+		Usage: "TLS private key of --proxy-cert",
+	},
+}
+
+// keyConsistencyFlags configure the KeyID consistency check of odohconfig-consistency and odoh.
+var keyConsistencyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "consistency-direct",
+		Value: CONFIG_SOURCE_DNS + "," + CONFIG_SOURCE_WELLKNOWN,
+		Usage: "Config sources fetched without a proxy, among dns and well-known",
+	},
+	cli.IntFlag{
+		Name:  "min-vantage-points",
+		Value: 2,
+		Usage: "Number of vantage points that must return configs",
+	},
+	cli.StringFlag{
+		Name:  "key-history",
+		Value: "odoh-key-history.json",
+		Usage: "File recording the KeyIDs seen for each target, empty to keep no history",
+	},
+	cli.DurationFlag{
+		Name:  "rotation-window",
+		Value: 24 * time.Hour,
+	},
+	cli.IntFlag{
+		Name:  "max-rotations",
+		Value: 4,
+		Usage: "Number of KeyID changes allowed within --rotation-window",
+	},
+}
+
+// outboundProxyFlags route the connections to the proxies and config sources through outbound
+// SOCKS5 or HTTP CONNECT proxies, or Tor.
+var outboundProxyFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "outbound-proxy",
+		Usage: "Outbound proxy to connect through: socks5h://, socks5:// or http:// for HTTP CONNECT, with optional user:password@; repeat to chain them in order",
+	},
+	cli.BoolFlag{
+		Name:  "tor",
+		Usage: "Connect through Tor at --tor-socks, on circuits isolated from other applications",
+	},
+	cli.StringFlag{
+		Name:  "tor-socks",
+		Value: TOR_SOCKS_ADDRESS,
+		Usage: "Address of the Tor SOCKS port",
+	},
+}
+
+// timingFlags set the timing policy of the queries of odoh and bench.
+var timingFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "timing",
+		Value: TIMING_NONE,
+		Usage: "When queries are sent: none, jitter for a random delay up to --jitter, batch to release them together every --interval, or constant-rate for one query every --interval, dummies included",
+	},
+	cli.DurationFlag{
+		Name:  "jitter",
+		Value: 100 * time.Millisecond,
+	},
+	cli.DurationFlag{
+		Name:  "interval",
+		Value: time.Second,
+	},
+}
+
 var Commands = []cli.Command{
 	{
 		Name:   "doh",
@@ -28,7 +156,7 @@ var Commands = []cli.Command{
 		Name:   "odoh",
 		Usage:  "An application/oblivious-dns-message request",
 		Action: obliviousDnsRequest,
-		Flags: []cli.Flag{
+		Flags: append(append(append(append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "domain, d",
 				Value: "www.cloudflare.com.",
@@ -46,15 +174,97 @@ var Commands = []cli.Command{
 			},
 			cli.StringFlag{
 				Name:  "proxy, p",
-				Usage: "Hostname:Port format declaration of the proxy hostname",
+				Usage: "Hostname:Port format declaration of the proxy hostname, or its https:// URL",
 			},
-		},
+			cli.StringFlag{
+				Name:  "suites",
+				Usage: "Preferred HPKE suites as comma separated KEM:KDF:AEAD identifiers, e.g. 32:1:1,16:1:1",
+			},
+			cli.StringFlag{
+				Name:  "odoh-version",
+				Value: "auto",
+				Usage: "ODoH wire format: auto, draft or rfc9230",
+			},
+			cli.StringFlag{
+				Name:  "config-source",
+				Value: CONFIG_SOURCE_AUTO,
+				Usage: "Where to fetch the target configs from: auto, dns or well-known",
+			},
+			cli.BoolFlag{
+				Name:  "trace",
+				Usage: "Report the time spent in each phase of the request and the message sizes",
+			},
+			cli.StringFlag{
+				Name:  "protocol",
+				Value: PROTOCOL_ODOH,
+				Usage: "Oblivious protocol: odoh, or ohttp for DoH over Oblivious HTTP",
+			},
+			cli.StringFlag{
+				Name:  "relay",
+				Usage: "URL of the OHTTP relay resource, instead of the relay endpoint of --proxy",
+			},
+			cli.StringFlag{
+				Name:  "gateway",
+				Usage: "URL of the OHTTP gateway, defaults to " + OHTTP_GATEWAY_WELLKNOWN_URL + " on the target",
+			},
+			cli.StringFlag{
+				Name:  "key-consistency",
+				Value: KEY_CONSISTENCY_OFF,
+				Usage: "Check that the target hands out the same keys to every vantage point first: off, warn or refuse",
+			},
+			cli.StringSliceFlag{
+				Name:  "consistency-proxy",
+				Usage: "Proxy to fetch the configs through for --key-consistency, --proxy if omitted",
+			},
+			cli.BoolTFlag{
+				Name:  "strict",
+				Usage: "Check that the answer matches the question and scrub out-of-bailiwick additional records, --strict=false to accept any answer",
+			},
+			cli.StringFlag{
+				Name:  "resolution",
+				Value: RESOLUTION_SINGLE,
+				Usage: "single asks --target, race returns the first answer of --targets and majority the answer most of them agree on",
+			},
+			cli.StringSliceFlag{
+				Name:  "targets",
+				Usage: "Targets to race or cross-check, each through the next of --proxies",
+			},
+			cli.StringSliceFlag{
+				Name:  "proxies",
+				Usage: "Proxies to reach --targets through",
+			},
+			cli.BoolFlag{
+				Name:  "unanimous",
+				Usage: "With majority, reject the answer unless every target agrees",
+			},
+			cli.StringFlag{
+				Name:  "disagreement-log",
+				Usage: "File to append the disagreements between targets to, as JSON lines",
+			},
+			cli.StringSliceFlag{
+				Name:  "shard-targets",
+				Usage: "Targets to shard queries across by registrable domain, instead of --target",
+			},
+			cli.StringFlag{
+				Name:  "shard-key",
+				Value: "odoh-shard.key",
+				Usage: "File holding the secret key of the shard assignment, created if missing",
+			},
+			cli.Float64Flag{
+				Name:  "cover-ratio",
+				Usage: "Mean number of decoy queries sent along with the query, 0 to send none",
+			},
+			cli.StringFlag{
+				Name:  "cover-domains",
+				Usage: "File listing the popular domains decoys are drawn from, one per line or as rank,domain",
+			},
+		}, timingFlags...), keyConsistencyFlags...), outboundProxyFlags...), proxyClientFlags...),
 	},
 	{
 		Name:   "odohconfig-fetch",
 		Usage:  "Retrieves the ObliviousDoHConfigs of the target resolver",
 		Action: getTargetConfigs,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "target",
 				Value: "localhost:8080",
@@ -62,11 +272,83 @@ var Commands = []cli.Command{
 			cli.BoolFlag{
 				Name: "pretty",
 			},
-		},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "hex",
+				Usage: "Output format: hex, pretty, json, base64 or svcb",
+			},
+			cli.StringFlag{
+				Name:  "source",
+				Value: CONFIG_SOURCE_AUTO,
+				Usage: "Where to fetch the configs from: auto, dns or well-known",
+			},
+			cli.BoolFlag{
+				Name:  "lint",
+				Usage: "Check the configs published over DNS and the well-known endpoint for problems",
+			},
+		}, outboundProxyFlags...),
+	},
+	{
+		Name:   "odohconfig-consistency",
+		Usage:  "Compares the KeyIDs a target hands out directly and through proxies, to detect client fingerprinting",
+		Action: runKeyConsistency,
+		Flags: append(append(append([]cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "target",
+				Usage: "Target to check, may be repeated or comma separated",
+			},
+			cli.StringSliceFlag{
+				Name:  "proxy, p",
+				Usage: "Proxy to fetch the configs through, may be repeated or comma separated",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "text",
+				Usage: "Output format: text or json",
+			},
+		}, keyConsistencyFlags...), outboundProxyFlags...), proxyClientFlags...),
+	},
+	{
+		Name:   "odohconfig-probe",
+		Usage:  "Verifies every HPKE suite advertised by a target with real queries",
+		Action: probeTargetSuites,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "target",
+				Value: "localhost:8080",
+			},
+			cli.StringFlag{
+				Name:  "proxy, p",
+				Usage: "Hostname:Port format declaration of the proxy hostname",
+			},
+			cli.StringFlag{
+				Name:  "source",
+				Value: CONFIG_SOURCE_AUTO,
+				Usage: "Where to fetch the configs from: auto, dns or well-known",
+			},
+			cli.StringFlag{
+				Name:  "domain, d",
+				Value: "www.cloudflare.com.",
+			},
+			cli.StringFlag{
+				Name:  "dnstype, t",
+				Value: "A",
+			},
+			cli.IntFlag{
+				Name:  "count",
+				Value: 1,
+				Usage: "Number of queries per suite, the timings are averaged",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "text",
+				Usage: "Output format: text or json",
+			},
+		}, proxyClientFlags...),
 	},
 	{
 		Name:   "odohconfig-mint",
-		Usage:  "Mints a singleton ObliviousDoHConfig with the specified (KEM, KDF, AEAD) HPKE ciphersuite",
+		Usage:  "Mints ObliviousDoHConfigs with the specified (KEM, KDF, AEAD) HPKE ciphersuites",
 		Action: createConfigurations,
 		Flags: []cli.Flag{
 			cli.StringFlag{
@@ -81,13 +363,416 @@ var Commands = []cli.Command{
 				Name:  "aeadid",
 				Value: "1",
 			},
+			cli.StringFlag{
+				Name:  "odoh-version",
+				Value: "draft",
+				Usage: "ODoH wire format of the minted config: draft or rfc9230",
+			},
+			cli.StringFlag{
+				Name:  "suites",
+				Usage: "Mint one config per HPKE suite, as comma separated KEM:KDF:AEAD identifiers, instead of --kemid, --kdfid and --aeadid",
+			},
+			cli.StringFlag{
+				Name:  "seed",
+				Usage: "Hex encoded seed of at least 32 bytes to derive the keys from deterministically",
+			},
+			cli.StringFlag{
+				Name:  "config-out",
+				Usage: "File to write the ODOH CONFIGS PEM to, instead of stdout",
+			},
+			cli.StringFlag{
+				Name:  "private-key-out",
+				Usage: "File to write the ODOH PRIVATE KEY PEM blocks to with 0600 permissions, instead of stdout",
+			},
+			cli.StringFlag{
+				Name:  "manifest-out",
+				Usage: "File to write a JSON manifest of the minted configs and their KeyIDs to",
+			},
+		},
+	},
+	{
+		Name:  "odohconfig-rotate",
+		Usage: "Maintains a local keyring of active, next and retired ODoH keys for a target",
+		Subcommands: []cli.Command{
+			{
+				Name:   "init",
+				Usage:  "Creates a keyring with a single active key",
+				Action: rotateInit,
+				Flags: append(keyringMintFlags, cli.DurationFlag{
+					Name:  "max-ttl",
+					Value: 24 * time.Hour,
+					Usage: "Longest time clients may cache the published configs",
+				}),
+			},
+			{
+				Name:   "prepare",
+				Usage:  "Mints the next key and pre-publishes it next to the active key",
+				Action: rotatePrepare,
+				Flags:  keyringMintFlags,
+			},
+			{
+				Name:   "switch",
+				Usage:  "Makes the next key active and stops publishing the previous one",
+				Action: rotateSwitch,
+				Flags: []cli.Flag{
+					keyringFlag,
+					cli.BoolFlag{
+						Name:  "force",
+						Usage: "Switch even if the next key has been published for less than the max TTL",
+					},
+				},
+			},
+			{
+				Name:   "retire",
+				Usage:  "Erases the keys which have not been published for longer than the max TTL",
+				Action: rotateRetire,
+				Flags: []cli.Flag{
+					keyringFlag,
+					cli.BoolFlag{
+						Name:  "force",
+						Usage: "Retire unpublished keys even if clients may still have them cached",
+					},
+				},
+			},
+			{
+				Name:   "status",
+				Usage:  "Lists the keys in the keyring",
+				Action: rotateStatus,
+				Flags:  []cli.Flag{keyringFlag},
+			},
+			{
+				Name:   "publish",
+				Usage:  "Emits the ObliviousDoHConfigs to publish at the current stage",
+				Action: rotatePublish,
+				Flags: []cli.Flag{
+					keyringFlag,
+					cli.StringFlag{
+						Name:  "format",
+						Value: "pem",
+						Usage: "Output format of the configs: pem, hex or base64",
+					},
+					cli.StringFlag{
+						Name:  "config-out",
+						Usage: "File to write the configs to, instead of stdout",
+					},
+					cli.StringFlag{
+						Name:  "private-key-out",
+						Usage: "File to write the private keys the target must accept to, with 0600 permissions",
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:  "odoh-debug",
+		Usage: "Seals and opens ODoH messages offline, to debug interoperability",
+		Subcommands: []cli.Command{
+			{
+				Name:   "seal",
+				Usage:  "Encrypts a DNS query to an ObliviousDoHConfigs file and writes the message and query context",
+				Action: debugSeal,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "configs",
+						Value: "odohconfigs.pem",
+						Usage: "ObliviousDoHConfigs as a PEM file, raw bytes or hex",
+					},
+					cli.StringFlag{
+						Name:  "domain, d",
+						Value: "www.cloudflare.com.",
+					},
+					cli.StringFlag{
+						Name:  "dnstype, t",
+						Value: "AAAA",
+					},
+					cli.StringFlag{
+						Name:  "suites",
+						Usage: "Preferred HPKE suites as comma separated KEM:KDF:AEAD identifiers",
+					},
+					cli.StringFlag{
+						Name:  "odoh-version",
+						Value: "auto",
+						Usage: "ODoH wire format: auto, draft or rfc9230",
+					},
+					cli.StringFlag{
+						Name:  "out",
+						Value: "query.odoh",
+						Usage: "File to write the serialized ObliviousDoHMessage to",
+					},
+					cli.StringFlag{
+						Name:  "context-out",
+						Value: "query-context.json",
+						Usage: "File to write the query context to, with 0600 permissions",
+					},
+				},
+			},
+			{
+				Name:   "open-response",
+				Usage:  "Decrypts a captured response with a query context written by seal",
+				Action: debugOpenResponse,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "context",
+						Value: "query-context.json",
+					},
+					cli.StringFlag{
+						Name:  "in",
+						Usage: "Captured ObliviousDoHMessage, as raw bytes or hex",
+					},
+				},
+			},
+			{
+				Name:   "open-query",
+				Usage:  "Decrypts a captured query with an ODOH PRIVATE KEY",
+				Action: debugOpenQuery,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "configs",
+						Value: "odohconfigs.pem",
+						Usage: "ObliviousDoHConfigs as a PEM file, raw bytes or hex",
+					},
+					cli.StringFlag{
+						Name:  "private-key",
+						Value: "odoh-keys.pem",
+					},
+					cli.StringFlag{
+						Name:  "in",
+						Usage: "Captured ObliviousDoHMessage, as raw bytes or hex",
+					},
+					cli.StringFlag{
+						Name:  "context-out",
+						Usage: "File to write the target's query context to",
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:   "conformance",
+		Usage:  "Checks a proxy and target pair against the requirements of RFC 9230",
+		Action: runConformance,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "target",
+				Value: "localhost:8080",
+			},
+			cli.StringFlag{
+				Name:  "proxy, p",
+				Usage: "Hostname:Port format declaration of the proxy hostname, the target is checked directly if omitted",
+			},
+			cli.StringFlag{
+				Name:  "source",
+				Value: CONFIG_SOURCE_AUTO,
+				Usage: "Where to fetch the configs from: auto, dns or well-known",
+			},
+			cli.StringFlag{
+				Name:  "odoh-version",
+				Value: "auto",
+				Usage: "ODoH wire format to check: auto, draft or rfc9230",
+			},
+			cli.StringFlag{
+				Name:  "domain, d",
+				Value: "www.cloudflare.com.",
+			},
+			cli.StringFlag{
+				Name:  "dnstype, t",
+				Value: "A",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "text",
+				Usage: "Output format: text or json",
+			},
+		}, proxyClientFlags...),
+	},
+	{
+		Name:   "interop-matrix",
+		Usage:  "Resolves a set of query types through every proxy and target pair and prints the matrix",
+		Action: runInteropMatrix,
+		Flags: append([]cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "proxy, p",
+				Usage: "Proxy to include, may be repeated or comma separated",
+			},
+			cli.StringSliceFlag{
+				Name:  "target",
+				Usage: "Target to include, may be repeated or comma separated",
+			},
+			cli.StringFlag{
+				Name:  "discovery",
+				Value: "odoh-discovery.crypto-team.workers.dev",
+				Usage: "Discovery service listing the proxies and targets, used when none are given",
+			},
+			cli.BoolFlag{
+				Name:  "direct",
+				Usage: "Also query every target without a proxy",
+			},
+			cli.StringFlag{
+				Name:  "domain, d",
+				Value: "www.github.com.",
+			},
+			cli.StringFlag{
+				Name:  "dnstypes",
+				Value: "A,AAAA",
+				Usage: "Comma separated query types to resolve through each pair",
+			},
+			cli.StringFlag{
+				Name:  "source",
+				Value: CONFIG_SOURCE_AUTO,
+				Usage: "Where to fetch the configs from: auto, dns or well-known",
+			},
+			cli.StringFlag{
+				Name:  "odoh-version",
+				Value: "auto",
+				Usage: "ODoH wire format: auto, draft or rfc9230",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "markdown",
+				Usage: "Output format: markdown or json",
+			},
+		}, proxyClientFlags...),
+	},
+	{
+		Name:   "privacy-audit",
+		Usage:  "Sends queries through a proxy to a local recording target and reports whether the proxy leaks client identity",
+		Action: runPrivacyAudit,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "proxy, p",
+				Usage: "Hostname:Port or https:// URL of the proxy to audit",
+			},
+			cli.StringFlag{
+				Name:  "listen",
+				Value: "localhost:8443",
+				Usage: "Address the recording target listens on",
+			},
+			cli.StringFlag{
+				Name:  "target-name",
+				Usage: "Hostname:Port under which the proxy reaches the recording target, the listen address if omitted",
+			},
+			cli.StringFlag{
+				Name:  "cert",
+				Usage: "TLS certificate of the recording target, self-signed if omitted",
+			},
+			cli.StringFlag{
+				Name:  "key",
+				Usage: "TLS private key of the recording target",
+			},
+			cli.StringFlag{
+				Name:  "cert-out",
+				Usage: "File to write the self-signed certificate to, for the proxy to trust",
+			},
+			cli.StringSliceFlag{
+				Name:  "client-ip",
+				Usage: "Public address of the client to look for at the target, in addition to the local addresses",
+			},
+			cli.IntFlag{
+				Name:  "queries, n",
+				Value: 3,
+			},
+			cli.StringFlag{
+				Name:  "domain, d",
+				Value: "audit.example.",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Value: 10 * time.Second,
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "text",
+				Usage: "Output format: text or json",
+			},
+		}, proxyAuthFlags...),
+	},
+	{
+		Name:   "target",
+		Usage:  "Runs a local ODoH target serving the configs and keys minted by odohconfig-mint",
+		Action: runTarget,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "listen",
+				Value: "localhost:8443",
+			},
+			cli.StringFlag{
+				Name:  "config",
+				Value: "odohconfigs.pem",
+				Usage: "PEM file holding the ODOH CONFIGS block to serve",
+			},
+			cli.StringFlag{
+				Name:  "private-key",
+				Value: "odoh-keys.pem",
+				Usage: "PEM file holding the ODOH PRIVATE KEY blocks of the configs",
+			},
+			cli.StringFlag{
+				Name:  "upstream",
+				Value: "https://" + DEFAULT_DOH_SERVER + "/dns-query",
+				Usage: "Resolver for decrypted queries: udp://host:port, tcp://host:port or a DoH URL",
+			},
+			cli.DurationFlag{
+				Name:  "upstream-timeout",
+				Value: 5 * time.Second,
+			},
+			cli.StringFlag{
+				Name:  "zone",
+				Usage: "Answer from this zone file instead of an upstream resolver",
+			},
+			cli.DurationFlag{
+				Name:  "config-ttl",
+				Value: time.Hour,
+				Usage: "Cache-Control max-age of the well-known configs",
+			},
+			cli.StringFlag{
+				Name:  "cert",
+				Usage: "TLS certificate, a self-signed one is created if omitted",
+			},
+			cli.StringFlag{
+				Name:  "key",
+				Usage: "TLS private key of --cert",
+			},
+			cli.StringFlag{
+				Name:  "cert-out",
+				Usage: "File to write the self-signed certificate to",
+			},
+			cli.BoolFlag{
+				Name:  "ohttp",
+				Usage: "Also serve DoH over Oblivious HTTP on " + OHTTP_GATEWAY_WELLKNOWN_URL,
+			},
+		},
+	},
+	{
+		Name:   "proxy",
+		Usage:  "Runs a local oblivious proxy forwarding ODoH messages to targets",
+		Action: runProxy,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "listen",
+				Value: "localhost:8080",
+			},
+			cli.StringSliceFlag{
+				Name:  "allow-target",
+				Usage: "Only forward to this target host, may be repeated; without it, only targets with public addresses are reached",
+			},
+			cli.DurationFlag{
+				Name:  "target-timeout",
+				Value: 10 * time.Second,
+			},
+			cli.StringFlag{
+				Name:  "cert",
+				Usage: "TLS certificate, the proxy serves plain HTTP if omitted",
+			},
+			cli.StringFlag{
+				Name:  "key",
+				Usage: "TLS private key of --cert",
+			},
 		},
 	},
 	{
 		Name:   "bench",
 		Usage:  "Performs a benchmark for ODOH Target Resolver",
 		Action: benchmarkClient,
-		Flags: []cli.Flag{
+		Flags: append(append(append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "data",
 				Value: "dataset.csv",
@@ -112,6 +797,33 @@ var Commands = []cli.Command{
 				Name:  "discovery",
 				Value: "odoh-discovery.crypto-team.workers.dev",
 			},
-		},
+			cli.StringFlag{
+				Name:  "suites",
+				Usage: "Preferred HPKE suites as comma separated KEM:KDF:AEAD identifiers, e.g. 32:1:1,16:1:1",
+			},
+			cli.StringFlag{
+				Name:  "odoh-version",
+				Value: "auto",
+				Usage: "ODoH wire format: auto, draft or rfc9230, optionally per target as target=version, e.g. auto,target.example=draft",
+			},
+			cli.StringFlag{
+				Name:  "protocol",
+				Value: PROTOCOL_ODOH,
+				Usage: "Oblivious protocol: odoh, or ohttp for DoH over Oblivious HTTP through the proxies",
+			},
+			cli.StringFlag{
+				Name:  "relay",
+				Usage: "URL of an OHTTP relay resource to use instead of the relay endpoint of the proxies",
+			},
+			cli.Float64Flag{
+				Name:  "cover-ratio",
+				Usage: "Mean number of decoy queries for domains of the dataset sent along with each query",
+			},
+			cli.StringFlag{
+				Name:  "config-source",
+				Value: CONFIG_SOURCE_AUTO,
+				Usage: "Where to fetch the target configs from: auto, dns or well-known",
+			},
+		}, timingFlags...), outboundProxyFlags...), proxyClientFlags...),
 	},
 }
@@ -1,9 +1,65 @@
 package commands
 
+import "time"
+
 const (
-	DEFAULT_DOH_SERVER        = "cloudflare-dns.com"
-	OBLIVIOUS_DOH             = "application/oblivious-dns-message"
-	TARGET_HTTP_MODE          = "https"
-	PROXY_HTTP_MODE           = "http"
-	ODOH_CONFIG_WELLKNOWN_URL = "/.well-known/odohconfigs"
+	DEFAULT_DOH_SERVER          = "cloudflare-dns.com"
+	OBLIVIOUS_DOH               = "application/oblivious-dns-message"
+	TARGET_HTTP_MODE            = "https"
+	PROXY_HTTP_MODE             = "http"
+	ODOH_CONFIG_WELLKNOWN_URL   = "/.well-known/odohconfigs"
+	ODOH_VERSION_DRAFT          = uint16(0xff02)
+	ODOH_VERSION_RFC9230        = uint16(0x0001)
+	ODOH_LABEL_RESPONSE         = "odoh response"
+	ODOH_CONFIG_SVCB_KEY        = 32769
+	CONFIG_SOURCE_AUTO          = "auto"
+	CONFIG_SOURCE_DNS           = "dns"
+	CONFIG_SOURCE_WELLKNOWN     = "well-known"
+	LINT_ERROR                  = "error"
+	LINT_WARNING                = "warning"
+	MAX_OBLIVIOUS_MESSAGE_SIZE  = 65535
+	PROBE_OK                    = "ok"
+	PROBE_UNSUPPORTED           = "unsupported"
+	PROBE_SEAL_FAILED           = "seal-failed"
+	PROBE_EXCHANGE_FAILED       = "exchange-failed"
+	PROBE_OPEN_FAILED           = "open-failed"
+	PROBE_DNS_FAILED            = "dns-failed"
+	PROBE_CONFIG_FAILED         = "config-failed"
+	DOH_MESSAGE                 = "application/dns-message"
+	PROTOCOL_ODOH               = "odoh"
+	PROTOCOL_OHTTP              = "ohttp"
+	OHTTP_REQUEST               = "message/ohttp-req"
+	OHTTP_RESPONSE              = "message/ohttp-res"
+	OHTTP_KEYS                  = "application/ohttp-keys"
+	OHTTP_GATEWAY_WELLKNOWN_URL = "/.well-known/ohttp-gateway"
+	OHTTP_LABEL_REQUEST         = "message/bhttp request"
+	OHTTP_LABEL_RESPONSE        = "message/bhttp response"
+	HEADER_POLICY_NONE          = "none"
+	HEADER_POLICY_MINIMAL       = "minimal"
+	HEADER_POLICY_UNIFORM       = "uniform"
+	HEADER_POLICY_USER_AGENT    = "odoh-client"
+	AUDIT_PASS                  = "pass"
+	AUDIT_WARN                  = "warn"
+	AUDIT_LEAK                  = "leak"
+	KEY_CONSISTENCY_OFF         = "off"
+	KEY_CONSISTENCY_WARN        = "warn"
+	KEY_CONSISTENCY_REFUSE      = "refuse"
+	TIMING_NONE                 = "none"
+	TIMING_JITTER               = "jitter"
+	TIMING_BATCH                = "batch"
+	TIMING_CONSTANT_RATE        = "constant-rate"
+	COVER_PADDING_BLOCK         = 128
+	SHARD_VIRTUAL_NODES         = 64
+	SHARD_KEY_SIZE              = 32
+	RESOLUTION_SINGLE           = "single"
+	RESOLUTION_RACE             = "race"
+	RESOLUTION_MAJORITY         = "majority"
+	MAX_DISCOVERY_SIZE          = 1 << 20
+	HTTP_ERROR_BODY_SIZE        = 512
+	HTTP_DRAIN_SIZE             = 64 << 10
+	HTTP_CLIENT_TIMEOUT         = 30 * time.Second
+	OUTBOUND_SOCKS5             = "socks5"
+	OUTBOUND_SOCKS5H            = "socks5h"
+	OUTBOUND_HTTP               = "http"
+	TOR_SOCKS_ADDRESS           = "127.0.0.1:9050"
 )
@@ -0,0 +1,314 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type conformanceResult struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// conformanceRunner sends deliberately well-formed and malformed requests to a target, through the
+// proxy if one is given, and compares the answers with what RFC 9230 requires.
+type conformanceRunner struct {
+	client     *http.Client
+	targetName string
+	proxy      string
+	config     odoh.ObliviousDoHConfig
+	dnsQuery   []byte
+}
+
+type conformanceCheck struct {
+	name string
+	run  func(r *conformanceRunner) (bool, string)
+}
+
+// send posts the body as prepareHttpRequest would, with the method and Content-Type overridden.
+func (r *conformanceRunner) send(method string, contentType string, body []byte) (*http.Response, []byte, error) {
+	req, err := prepareHttpRequest(body, len(r.proxy) > 0, r.targetName, r.proxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Method = method
+	if method == http.MethodGet {
+		req.Body = nil
+		req.ContentLength = 0
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	} else {
+		req.Header.Del("Content-Type")
+	}
+	req.Header.Set("Accept", OBLIVIOUS_DOH)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeBody(resp.Body)
+	responseBody, err := readLimitedBody(resp.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	return resp, responseBody, err
+}
+
+func (r *conformanceRunner) seal(query *odoh.ObliviousDNSQuery) (odoh.ObliviousDNSMessage, odohQueryContext, error) {
+	return sealQuery(query, r.config)
+}
+
+// expectStatus sends the body and passes if the answer has one of the given status codes.
+func (r *conformanceRunner) expectStatus(method string, contentType string, body []byte, statuses ...int) (bool, string) {
+	resp, _, err := r.send(method, contentType, body)
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return true, fmt.Sprintf("status %d", resp.StatusCode)
+		}
+	}
+	expected := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		expected = append(expected, fmt.Sprint(status))
+	}
+	return false, fmt.Sprintf("status %d, expected %s", resp.StatusCode, strings.Join(expected, " or "))
+}
+
+// isCacheable reports whether a response may be stored by a shared cache, which would let the proxy
+// or an intermediary replay answers across clients.
+func isCacheable(header http.Header) bool {
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "private") {
+		return false
+	}
+	maxAge, ok := cacheControlMaxAge(cacheControl)
+	return ok && maxAge > 0
+}
+
+var conformanceChecks = []conformanceCheck{
+	{"valid query is answered", func(r *conformanceRunner) (bool, string) {
+		message, queryContext, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		resp, body, err := r.send(http.MethodPost, OBLIVIOUS_DOH, message.Marshal())
+		if err != nil {
+			return false, err.Error()
+		}
+		if resp.StatusCode != http.StatusOK {
+			return false, fmt.Sprintf("status %d", resp.StatusCode)
+		}
+		if !hasContentType(resp.Header.Get("Content-Type"), OBLIVIOUS_DOH) {
+			return false, fmt.Sprintf("Content-Type %q", resp.Header.Get("Content-Type"))
+		}
+		response, err := unmarshalObliviousMessage(body)
+		if err != nil {
+			return false, err.Error()
+		}
+		if _, err := validateEncryptedResponse(response, queryContext); err != nil {
+			return false, err.Error()
+		}
+		return true, ""
+	}},
+	{"answer is not cacheable", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		resp, _, err := r.send(http.MethodPost, OBLIVIOUS_DOH, message.Marshal())
+		if err != nil {
+			return false, err.Error()
+		}
+		if isCacheable(resp.Header) {
+			return false, fmt.Sprintf("Cache-Control %q", resp.Header.Get("Cache-Control"))
+		}
+		return true, fmt.Sprintf("Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}},
+	{"padded query is answered", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 128))
+		if err != nil {
+			return false, err.Error()
+		}
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, message.Marshal(), http.StatusOK)
+	}},
+	{"unknown key ID is rejected with 401", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		message.KeyID = append([]byte{}, message.KeyID...)
+		message.KeyID[0] ^= 0xff
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, message.Marshal(), http.StatusUnauthorized)
+	}},
+	{"non-zero padding is rejected", func(r *conformanceRunner) (bool, string) {
+		query := odoh.CreateObliviousDNSQuery(r.dnsQuery, 16)
+		query.Padding[len(query.Padding)-1] = 0x01
+		message, _, err := r.seal(query)
+		if err != nil {
+			return false, err.Error()
+		}
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, message.Marshal(), http.StatusBadRequest)
+	}},
+	{"truncated message is rejected", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		serialized := message.Marshal()
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, serialized[:len(serialized)/2], http.StatusBadRequest)
+	}},
+	{"truncated ciphertext is rejected", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		message.EncryptedMessage = message.EncryptedMessage[:len(message.EncryptedMessage)-1]
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, message.Marshal(), http.StatusBadRequest)
+	}},
+	{"response message type is rejected as a query", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		message.MessageType = odoh.ResponseType
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, message.Marshal(), http.StatusBadRequest)
+	}},
+	{"oversized message is rejected", func(r *conformanceRunner) (bool, string) {
+		return r.expectStatus(http.MethodPost, OBLIVIOUS_DOH, make([]byte, 2*MAX_OBLIVIOUS_MESSAGE_SIZE), http.StatusRequestEntityTooLarge, http.StatusBadRequest)
+	}},
+	{"GET is rejected", func(r *conformanceRunner) (bool, string) {
+		return r.expectStatus(http.MethodGet, "", nil, http.StatusMethodNotAllowed, http.StatusBadRequest)
+	}},
+	{"wrong Content-Type is rejected", func(r *conformanceRunner) (bool, string) {
+		message, _, err := r.seal(odoh.CreateObliviousDNSQuery(r.dnsQuery, 0))
+		if err != nil {
+			return false, err.Error()
+		}
+		return r.expectStatus(http.MethodPost, "application/dns-message", message.Marshal(), http.StatusUnsupportedMediaType, http.StatusBadRequest)
+	}},
+	{"error responses are not ODoH messages", func(r *conformanceRunner) (bool, string) {
+		resp, _, err := r.send(http.MethodPost, OBLIVIOUS_DOH, []byte{0x01})
+		if err != nil {
+			return false, err.Error()
+		}
+		if resp.StatusCode == http.StatusOK || hasContentType(resp.Header.Get("Content-Type"), OBLIVIOUS_DOH) {
+			return false, fmt.Sprintf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return true, fmt.Sprintf("status %d", resp.StatusCode)
+	}},
+}
+
+// checkWellKnownConfigs verifies that the target publishes usable configs on its well-known endpoint.
+func checkWellKnownConfigs(targetName string) conformanceResult {
+	result := conformanceResult{Check: "well-known configs are published"}
+	fetched, err := fetchRawTargetConfigsFromWellKnown(targetName)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	configs, err := fetched.parse()
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	usable := 0
+	for _, config := range configs.Configs {
+		if checkConfigSupported(config) == nil {
+			usable++
+		}
+	}
+	result.Passed = usable > 0
+	result.Detail = fmt.Sprintf("%d usable configs, max-age %d", usable, fetched.TTL)
+	return result
+}
+
+func runConformance(c *cli.Context) error {
+	targetName := c.String("target")
+	versions, err := parseOdohVersions(c.String("odoh-version"))
+	if err != nil {
+		return err
+	}
+
+	results := []conformanceResult{checkWellKnownConfigs(targetName)}
+	fetched, err := fetchRawTargetConfigs(targetName, c.String("source"))
+	if err != nil {
+		return err
+	}
+	configs, err := fetched.parse()
+	if err != nil {
+		return err
+	}
+	usableConfigs := orderConfigs(configs, versions, defaultSuitePreference)
+	if len(usableConfigs) == 0 {
+		return fmt.Errorf("%s publishes no usable ObliviousDoHConfig", targetName)
+	}
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(dns.Fqdn(c.String("domain")), dnsQueryStringToType(c.String("dnstype")))
+	dnsQuery.Id = 0
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		return err
+	}
+
+	client, err := newProxyHTTPClient(c, c.String("proxy"))
+	if err != nil {
+		return err
+	}
+	runner := &conformanceRunner{
+		client:     client,
+		targetName: targetName,
+		proxy:      c.String("proxy"),
+		config:     usableConfigs[0],
+		dnsQuery:   packedDnsQuery,
+	}
+	for _, check := range conformanceChecks {
+		passed, detail := check.run(runner)
+		results = append(results, conformanceResult{Check: check.name, Passed: passed, Detail: detail})
+	}
+
+	failures := 0
+	for _, result := range results {
+		if !result.Passed {
+			failures++
+		}
+	}
+
+	if c.String("output") == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		path := targetName
+		if len(runner.proxy) > 0 {
+			path = runner.proxy + " -> " + targetName
+		}
+		fmt.Printf("Conformance of %s with Version(0x%04x), %v:\n", path, runner.config.Version, suiteOfConfig(runner.config))
+		for _, result := range results {
+			status := "PASS"
+			if !result.Passed {
+				status = "FAIL"
+			}
+			if len(result.Detail) > 0 {
+				fmt.Printf("  %s %s (%s)\n", status, result.Check, result.Detail)
+			} else {
+				fmt.Printf("  %s %s\n", status, result.Check)
+			}
+		}
+		fmt.Printf("%d of %d checks passed\n", len(results)-failures, len(results))
+	}
+
+	if failures > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d conformance checks failed", failures), 1)
+	}
+	return nil
+}
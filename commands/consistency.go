@@ -0,0 +1,348 @@
+package commands
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A target could hand every client its own ObliviousDoHConfig and recognise the client by the KeyID
+// of its queries. The consistency check fetches the configs from several vantage points, directly
+// over DNS and the well-known endpoint and through each proxy, and expects the same KeyIDs from all
+// of them. A local history of the KeyIDs also catches targets that rotate their keys so often that
+// each client sees a different one.
+
+type keyVantage struct {
+	Vantage string   `json:"vantage"`
+	TTL     uint32   `json:"ttl"`
+	KeyIDs  []string `json:"keyIds,omitempty"`
+	Error   string   `json:"error,omitempty"`
+
+	fetched fetchedTargetConfigs
+}
+
+type keyObservation struct {
+	Seen   time.Time `json:"seen"`
+	KeyIDs []string  `json:"keyIds"`
+}
+
+// keyHistory holds, per target, every change of the KeyIDs observed by the consistency check.
+type keyHistory struct {
+	Targets map[string][]keyObservation `json:"targets"`
+}
+
+type keyConsistencyReport struct {
+	Target   string       `json:"target"`
+	Vantages []keyVantage `json:"vantages"`
+	// Rotations counts the KeyID changes recorded within the rotation window, this one included.
+	Rotations  int      `json:"rotations"`
+	Consistent bool     `json:"consistent"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+func readKeyHistory(path string) (*keyHistory, error) {
+	history := &keyHistory{Targets: make(map[string][]keyObservation)}
+	if len(path) == 0 {
+		return history, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, fmt.Errorf("unable to read the key history %v: %v", path, err)
+	}
+	if history.Targets == nil {
+		history.Targets = make(map[string][]keyObservation)
+	}
+	return history, nil
+}
+
+func (h *keyHistory) write(path string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// observe records the KeyIDs of the target if they changed since the last observation and returns
+// the number of changes within the window.
+func (h *keyHistory) observe(target string, keyIDs []string, now time.Time, window time.Duration) int {
+	observations := h.Targets[target]
+	if len(observations) == 0 || !sameKeyIDs(observations[len(observations)-1].KeyIDs, keyIDs) {
+		observations = append(observations, keyObservation{Seen: now, KeyIDs: keyIDs})
+		h.Targets[target] = observations
+	}
+	rotations := 0
+	// The first observation is where the history starts, not a change.
+	for _, observation := range observations[1:] {
+		if now.Sub(observation.Seen) <= window {
+			rotations++
+		}
+	}
+	return rotations
+}
+
+func sameKeyIDs(a []string, b []string) bool {
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+// configKeyIDs returns the sorted KeyIDs of a fetched configs list.
+func configKeyIDs(fetched fetchedTargetConfigs) ([]string, error) {
+	configs, err := fetched.parse()
+	if err != nil {
+		return nil, err
+	}
+	if len(configs.Configs) == 0 {
+		return nil, errors.New("no configs")
+	}
+	keyIDs := make([]string, 0, len(configs.Configs))
+	for _, config := range configs.Configs {
+		keyIDs = append(keyIDs, hex.EncodeToString(config.Contents.KeyID()))
+	}
+	sort.Strings(keyIDs)
+	return keyIDs, nil
+}
+
+// keyConsistencyChecker fetches the configs of targets from every vantage point.
+type keyConsistencyChecker struct {
+	// direct lists the config sources fetched without a proxy, dns and well-known.
+	direct         []string
+	proxies        []string
+	client         *http.Client
+	history        *keyHistory
+	window         time.Duration
+	maxRotations   int
+	minimumVantage int
+}
+
+func (k *keyConsistencyChecker) check(targetName string, now time.Time) keyConsistencyReport {
+	report := keyConsistencyReport{Target: targetName, Consistent: true}
+	type vantageFetch struct {
+		vantage string
+		fetch   func() (fetchedTargetConfigs, error)
+	}
+	var fetches []vantageFetch
+	for _, source := range k.direct {
+		source := source
+		fetches = append(fetches, vantageFetch{"direct " + source, func() (fetchedTargetConfigs, error) {
+			return fetchRawTargetConfigs(targetName, source)
+		}})
+	}
+	for _, proxy := range k.proxies {
+		proxy := proxy
+		fetches = append(fetches, vantageFetch{"via " + proxy, func() (fetchedTargetConfigs, error) {
+			return fetchRawTargetConfigsThroughProxy(targetName, proxy, k.client)
+		}})
+	}
+
+	var answered []keyVantage
+	for _, fetch := range fetches {
+		vantage := keyVantage{Vantage: fetch.vantage}
+		fetched, err := fetch.fetch()
+		if err == nil {
+			vantage.TTL = fetched.TTL
+			vantage.fetched = fetched
+			vantage.KeyIDs, err = configKeyIDs(fetched)
+		}
+		if err != nil {
+			vantage.Error = err.Error()
+		} else {
+			answered = append(answered, vantage)
+		}
+		report.Vantages = append(report.Vantages, vantage)
+	}
+
+	if len(answered) < k.minimumVantage {
+		report.Consistent = false
+		report.Problems = append(report.Problems, fmt.Sprintf("only %d of %d vantage points returned configs, %d needed", len(answered), len(fetches), k.minimumVantage))
+	}
+	for i := 1; i < len(answered); i++ {
+		vantage := answered[i]
+		if !sameKeyIDs(vantage.KeyIDs, answered[0].KeyIDs) {
+			report.Consistent = false
+			report.Problems = append(report.Problems, fmt.Sprintf("KeyIDs differ between %s (%s) and %s (%s)", answered[0].Vantage, strings.Join(answered[0].KeyIDs, ","), vantage.Vantage, strings.Join(vantage.KeyIDs, ",")))
+		}
+	}
+	if len(answered) > 0 && report.Consistent && k.history != nil {
+		report.Rotations = k.history.observe(targetName, answered[0].KeyIDs, now, k.window)
+		if report.Rotations > k.maxRotations {
+			report.Consistent = false
+			report.Problems = append(report.Problems, fmt.Sprintf("KeyIDs changed %d times within %v", report.Rotations, k.window))
+		}
+	}
+	return report
+}
+
+func (r keyConsistencyReport) print() {
+	fmt.Printf("Key consistency of %s:\n", r.Target)
+	for _, vantage := range r.Vantages {
+		if len(vantage.Error) > 0 {
+			fmt.Printf("  %-40s error: %s\n", vantage.Vantage, vantage.Error)
+		} else {
+			fmt.Printf("  %-40s KeyIDs %s (TTL %ds)\n", vantage.Vantage, strings.Join(vantage.KeyIDs, ","), vantage.TTL)
+		}
+	}
+	fmt.Printf("  %d KeyID changes within the rotation window\n", r.Rotations)
+	for _, problem := range r.Problems {
+		fmt.Printf("  PROBLEM %s\n", problem)
+	}
+	if r.Consistent {
+		fmt.Println("Consistent")
+	} else {
+		fmt.Println("Inconsistent")
+	}
+}
+
+// newKeyConsistencyChecker reads the flags shared by odohconfig-consistency and `odoh --key-consistency`.
+func newKeyConsistencyChecker(c *cli.Context, proxies []string) (*keyConsistencyChecker, error) {
+	client, err := newProxyHTTPClient(c, proxies...)
+	if err != nil {
+		return nil, err
+	}
+	history, err := readKeyHistory(c.String("key-history"))
+	if err != nil {
+		return nil, err
+	}
+	direct := splitList([]string{c.String("consistency-direct")})
+	for _, source := range direct {
+		if source != CONFIG_SOURCE_DNS && source != CONFIG_SOURCE_WELLKNOWN {
+			return nil, fmt.Errorf("unknown config source %q, expected %s or %s", source, CONFIG_SOURCE_DNS, CONFIG_SOURCE_WELLKNOWN)
+		}
+	}
+	return &keyConsistencyChecker{
+		direct:         direct,
+		proxies:        proxies,
+		client:         client,
+		history:        history,
+		window:         c.Duration("rotation-window"),
+		maxRotations:   c.Int("max-rotations"),
+		minimumVantage: c.Int("min-vantage-points"),
+	}, nil
+}
+
+// agreedConfigs returns the configs of a consistent report, preferably as fetched from the source,
+// for the query to be sealed with. Fetching them again would let the target tell the check and the
+// query apart, and hand the query a key of its own.
+func (r keyConsistencyReport) agreedConfigs(source string) (fetchedTargetConfigs, bool) {
+	var agreed *keyVantage
+	for i := range r.Vantages {
+		vantage := &r.Vantages[i]
+		if len(vantage.Error) > 0 {
+			continue
+		}
+		if agreed == nil || vantage.Vantage == "direct "+source {
+			agreed = vantage
+		}
+	}
+	if agreed == nil {
+		return fetchedTargetConfigs{}, false
+	}
+	return agreed.fetched, true
+}
+
+// keyConsistencyLock serialises the checks of the paths of `odoh --resolution`, which share the key
+// history.
+var keyConsistencyLock sync.Mutex
+
+// checkKeyConsistency runs the check before `odoh` uses the configs of the target through the proxy,
+// warning about or refusing an inconsistent target as --key-consistency asks. When the target is
+// consistent, it returns the configs the check agreed on, which the query must be sealed with.
+func checkKeyConsistency(c *cli.Context, targetName string, proxy string) (*fetchedTargetConfigs, error) {
+	mode := c.String("key-consistency")
+	switch mode {
+	case "", KEY_CONSISTENCY_OFF:
+		return nil, nil
+	case KEY_CONSISTENCY_WARN, KEY_CONSISTENCY_REFUSE:
+	default:
+		return nil, fmt.Errorf("unknown key consistency mode %q, expected %s, %s or %s", mode, KEY_CONSISTENCY_OFF, KEY_CONSISTENCY_WARN, KEY_CONSISTENCY_REFUSE)
+	}
+	keyConsistencyLock.Lock()
+	defer keyConsistencyLock.Unlock()
+	proxies := splitList(c.StringSlice("consistency-proxy"))
+	if len(proxies) == 0 && len(proxy) > 0 {
+		proxies = []string{proxy}
+	}
+	checker, err := newKeyConsistencyChecker(c, proxies)
+	if err != nil {
+		return nil, err
+	}
+	report := checker.check(targetName, time.Now())
+	if len(c.String("key-history")) > 0 {
+		if err := checker.history.write(c.String("key-history")); err != nil {
+			return nil, err
+		}
+	}
+	if report.Consistent {
+		if agreed, ok := report.agreedConfigs(c.String("config-source")); ok {
+			return &agreed, nil
+		}
+		return nil, fmt.Errorf("no vantage point returned the configs of %s", targetName)
+	}
+	problems := strings.Join(report.Problems, "; ")
+	if mode == KEY_CONSISTENCY_REFUSE {
+		return nil, fmt.Errorf("refusing to use %s: %s", targetName, problems)
+	}
+	fmt.Fprintf(os.Stderr, "warning: %s may be fingerprinting clients: %s\n", targetName, problems)
+	return nil, nil
+}
+
+func runKeyConsistency(c *cli.Context) error {
+	restore, err := useOutboundProxies(c)
+	defer restore()
+	if err != nil {
+		return err
+	}
+	targets := splitList(c.StringSlice("target"))
+	if len(targets) == 0 {
+		return errors.New("at least one --target is required")
+	}
+	checker, err := newKeyConsistencyChecker(c, splitList(c.StringSlice("proxy")))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	reports := make([]keyConsistencyReport, 0, len(targets))
+	inconsistent := 0
+	for _, target := range targets {
+		report := checker.check(target, now)
+		if !report.Consistent {
+			inconsistent++
+		}
+		reports = append(reports, report)
+	}
+	if len(c.String("key-history")) > 0 {
+		if err := checker.history.write(c.String("key-history")); err != nil {
+			return err
+		}
+	}
+
+	if c.String("output") == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, report := range reports {
+			report.print()
+		}
+	}
+	if inconsistent > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d targets hand out inconsistent keys", inconsistent, len(targets)), 1)
+	}
+	return nil
+}
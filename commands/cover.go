@@ -0,0 +1,175 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// Cover traffic hides each real query among decoy queries for popular domains. On the wire a decoy
+// is the same as a real query: it goes through the same proxy to the same target, carries the same
+// query type and headers, and every query is padded to the same block size with EDNS(0) padding.
+// Only the client knows which queries were real, which lets researchers measure how much the
+// decoys degrade a target's profile of the client.
+
+type coverTraffic struct {
+	domains []string
+	// ratio is the mean number of decoys sent per real query.
+	ratio float64
+}
+
+// newCoverTraffic draws decoys from the domains at the ratio, or returns nil for a zero ratio.
+func newCoverTraffic(domains []string, ratio float64) (*coverTraffic, error) {
+	if ratio < 0 {
+		return nil, errors.New("the cover ratio cannot be negative")
+	}
+	if ratio == 0 {
+		return nil, nil
+	}
+	cover := &coverTraffic{ratio: ratio}
+	for _, domain := range domains {
+		domain = strings.TrimSpace(domain)
+		if len(domain) == 0 || strings.HasPrefix(domain, "#") {
+			continue
+		}
+		// Popularity lists such as Tranco come as rank,domain.
+		if comma := strings.LastIndex(domain, ","); comma >= 0 {
+			domain = strings.TrimSpace(domain[comma+1:])
+		}
+		if _, ok := dns.IsDomainName(domain); ok && len(domain) > 0 {
+			cover.domains = append(cover.domains, dns.Fqdn(domain))
+		}
+	}
+	if len(cover.domains) == 0 {
+		return nil, errors.New("no decoy domains to draw cover traffic from")
+	}
+	return cover, nil
+}
+
+// newCoverTrafficFromFlags reads --cover-ratio and the --cover-domains file of odoh.
+func newCoverTrafficFromFlags(c *cli.Context) (*coverTraffic, error) {
+	if c.Float64("cover-ratio") == 0 {
+		return nil, nil
+	}
+	if len(c.String("cover-domains")) == 0 {
+		return nil, errors.New("--cover-ratio needs --cover-domains")
+	}
+	data, err := ioutil.ReadFile(c.String("cover-domains"))
+	if err != nil {
+		return nil, err
+	}
+	return newCoverTraffic(strings.Split(string(data), "\n"), c.Float64("cover-ratio"))
+}
+
+// randomIndex returns a uniformly random index below n.
+func randomIndex(n int) int {
+	index, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+	return int(index.Int64())
+}
+
+// decoyDomains draws the decoys of one real query: the integer part of the ratio, plus one more
+// with a probability of its fractional part.
+func (c *coverTraffic) decoyDomains() []string {
+	count := int(c.ratio)
+	const precision = 1 << 20
+	if randomIndex(precision) < int((c.ratio-float64(count))*precision) {
+		count++
+	}
+	domains := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		domains = append(domains, c.domains[randomIndex(len(c.domains))])
+	}
+	return domains
+}
+
+// padDnsQuery adds an EDNS(0) padding option bringing the packed query to a multiple of
+// COVER_PADDING_BLOCK bytes, the block padding policy RFC 8467 recommends for queries.
+func padDnsQuery(query *dns.Msg) error {
+	padding := &dns.EDNS0_PADDING{}
+	opt := query.IsEdns0()
+	if opt == nil {
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		opt = query.IsEdns0()
+	}
+	opt.Option = append(opt.Option, padding)
+	packed, err := query.Pack()
+	if err != nil {
+		return err
+	}
+	if remainder := len(packed) % COVER_PADDING_BLOCK; remainder != 0 {
+		padding.Padding = make([]byte, COVER_PADDING_BLOCK-remainder)
+	}
+	return nil
+}
+
+// packCoverQuery packs a padded query for the domain, so that real and decoy queries have the
+// same size.
+func packCoverQuery(domain string, dnsType uint16) ([]byte, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(domain), dnsType)
+	if err := padDnsQuery(query); err != nil {
+		return nil, err
+	}
+	return query.Pack()
+}
+
+// odohDecoy returns a decoy sent exactly as the real ODoH query, whose answer is opened and dropped.
+func odohDecoy(domain string, dnsType uint16, configs []odoh.ObliviousDoHConfig, useProxy bool, targetName string, proxy string, client *http.Client) func() {
+	return func() {
+		packed, err := packCoverQuery(domain, dnsType)
+		if err != nil {
+			return
+		}
+		message, queryContext, _, err := createOdohQuestionWithConfigs(packed, configs)
+		if err != nil {
+			return
+		}
+		response, err := resolveObliviousQueryWithContext(context.Background(), message, useProxy, targetName, proxy, client)
+		if err == nil {
+			validateEncryptedResponse(response, queryContext)
+		}
+	}
+}
+
+// ohttpDecoy is odohDecoy for DoH over Oblivious HTTP.
+func ohttpDecoy(domain string, dnsType uint16, targetName string, configs []ohttpKeyConfig, relayURL string, client *http.Client) func() {
+	return func() {
+		packed, err := packCoverQuery(domain, dnsType)
+		if err != nil {
+			return
+		}
+		encapsulated, requestContext, err := sealOHTTPQueryWithConfigs(packed, targetName, configs)
+		if err != nil {
+			return
+		}
+		response, err := exchangeOHTTP(context.Background(), encapsulated, relayURL, client)
+		if err == nil {
+			openOHTTPAnswer(response, requestContext)
+		}
+	}
+}
+
+// shuffleQueries puts the real query at a random position among the decoys.
+func shuffleQueries(query func(), decoys []func()) []func() {
+	queries := append([]func(){query}, decoys...)
+	for i := len(queries) - 1; i > 0; i-- {
+		j := randomIndex(i + 1)
+		queries[i], queries[j] = queries[j], queries[i]
+	}
+	return queries
+}
+
+func (c *coverTraffic) String() string {
+	return fmt.Sprintf("%.2f decoys per query from %d domains", c.ratio, len(c.domains))
+}
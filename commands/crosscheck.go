@@ -0,0 +1,374 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A single target sees every answer it gives, and can lie about any of them. The race and majority
+// resolutions ask the same question to several targets, each through its own proxy:
+//   - race returns the first answer, which also cuts the tail latency of a slow target.
+//   - majority waits for every target and returns the answer most of them agree on, logging the
+//     targets that disagree and rejecting the question when no answer has a majority.
+
+type resolverPath struct {
+	Target string `json:"target"`
+	Proxy  string `json:"proxy,omitempty"`
+}
+
+func (p resolverPath) String() string {
+	if len(p.Proxy) == 0 {
+		return p.Target
+	}
+	return p.Target + " via " + p.Proxy
+}
+
+type pathAnswer struct {
+	Path    resolverPath  `json:"path"`
+	Elapsed time.Duration `json:"elapsed"`
+	Answer  string        `json:"answer,omitempty"`
+	Error   string        `json:"error,omitempty"`
+
+	response *dns.Msg
+}
+
+type disagreement struct {
+	Time     time.Time    `json:"time"`
+	Domain   string       `json:"domain"`
+	DnsType  string       `json:"dnsType"`
+	Majority string       `json:"majority,omitempty"`
+	Answers  []pathAnswer `json:"answers"`
+}
+
+// resolverPaths pairs each of --targets with the next of --proxies, going round the proxies, so
+// that N targets are asked through N proxies when there are as many.
+func resolverPaths(targets []string, proxies []string) ([]resolverPath, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("--targets is required to race or cross-check targets")
+	}
+	paths := make([]resolverPath, 0, len(targets))
+	for i, target := range targets {
+		path := resolverPath{Target: target}
+		if len(proxies) > 0 {
+			path.Proxy = proxies[i%len(proxies)]
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// answerSet summarises a response for comparison: the response code and the sorted answer records,
+// without their TTLs, which differ between caches.
+func answerSet(response *dns.Msg) string {
+	records := make([]string, 0, len(response.Answer))
+	for _, rr := range response.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		records = append(records, rr.String())
+	}
+	sort.Strings(records)
+	return strings.Join(append([]string{dns.RcodeToString[response.Rcode]}, records...), "\n")
+}
+
+// preparedPath holds what a path needs to send queries: the configs of its target, and the relay
+// for Oblivious HTTP.
+type preparedPath struct {
+	path         resolverPath
+	odohConfigs  []odoh.ObliviousDoHConfig
+	ohttpConfigs []ohttpKeyConfig
+	relayURL     string
+}
+
+// preparePath fetches the configs of the target of the path for the protocol of `odoh --protocol`.
+// ODoH configs go through the key consistency check of --key-consistency first, through the proxy
+// of the path, and the query is sealed with the configs the check agreed on.
+func preparePath(c *cli.Context, path resolverPath, client *http.Client) (*preparedPath, error) {
+	prepared := &preparedPath{path: path}
+	if c.String("protocol") == PROTOCOL_OHTTP {
+		gatewayURL := ohttpGatewayURL(path.Target)
+		relayURL, err := ohttpRelayURL("", path.Proxy, gatewayURL)
+		if err != nil {
+			return nil, err
+		}
+		prepared.relayURL = relayURL
+		prepared.ohttpConfigs, err = fetchOHTTPKeyConfigs(gatewayURL, client)
+		if err != nil {
+			return nil, err
+		}
+		return prepared, nil
+	}
+
+	suitePreference, err := parseSuitePreference(c.String("suites"))
+	if err != nil {
+		return nil, err
+	}
+	versions, err := parseOdohVersions(c.String("odoh-version"))
+	if err != nil {
+		return nil, err
+	}
+	agreed, err := checkKeyConsistency(c, path.Target, path.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	var fetched fetchedTargetConfigs
+	if agreed != nil {
+		fetched = *agreed
+	} else if fetched, err = fetchRawTargetConfigs(path.Target, c.String("config-source")); err != nil {
+		return nil, err
+	}
+	odohConfigs, err := fetched.parse()
+	if err != nil {
+		return nil, err
+	}
+	prepared.odohConfigs = orderConfigs(odohConfigs, versions, suitePreference)
+	return prepared, nil
+}
+
+// exchange resolves the query through the path.
+func (p *preparedPath) exchange(ctx context.Context, dnsQuery *dns.Msg, client *http.Client) (*dns.Msg, error) {
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if p.ohttpConfigs != nil {
+		encapsulated, requestContext, err := sealOHTTPQueryWithConfigs(packedDnsQuery, p.path.Target, p.ohttpConfigs)
+		if err != nil {
+			return nil, err
+		}
+		encapsulatedResponse, err := exchangeOHTTP(ctx, encapsulated, p.relayURL, client)
+		if err != nil {
+			return nil, err
+		}
+		return openOHTTPAnswer(encapsulatedResponse, requestContext)
+	}
+
+	odohQuery, queryContext, _, err := createOdohQuestionWithConfigs(packedDnsQuery, p.odohConfigs)
+	if err != nil {
+		return nil, err
+	}
+	odohMessage, err := resolveObliviousQueryWithContext(ctx, odohQuery, len(p.path.Proxy) > 0, p.path.Target, p.path.Proxy, client)
+	if err != nil {
+		return nil, err
+	}
+	return validateEncryptedResponse(odohMessage, queryContext)
+}
+
+// decoy returns a decoy query for the domain through the path.
+func (p *preparedPath) decoy(domain string, dnsType uint16, client *http.Client) func() {
+	if p.ohttpConfigs != nil {
+		return ohttpDecoy(domain, dnsType, p.path.Target, p.ohttpConfigs, p.relayURL, client)
+	}
+	return odohDecoy(domain, dnsType, p.odohConfigs, len(p.path.Proxy) > 0, p.path.Target, p.path.Proxy, client)
+}
+
+// resolveAcross asks the question through every path at once, each under the timing policy and
+// among its own decoys of cover traffic. With race it returns as soon as one path answers and
+// cancels the others; otherwise it waits for all of them.
+func resolveAcross(c *cli.Context, paths []resolverPath, dnsQuery *dns.Msg, client *http.Client, race bool, timing timingPolicy, cover *coverTraffic) []pathAnswer {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	results := make(chan pathAnswer, len(paths))
+	for _, path := range paths {
+		go func(path resolverPath) {
+			answered := func(response *dns.Msg, err error) {
+				if err == nil && c.BoolT("strict") {
+					_, err = validateDnsResponse(dnsQuery, response)
+				}
+				answer := pathAnswer{Path: path, Elapsed: time.Since(start)}
+				if err != nil {
+					answer.Error = err.Error()
+				} else {
+					answer.response = response
+					answer.Answer = answerSet(response)
+				}
+				results <- answer
+			}
+			prepared, err := preparePath(c, path, client)
+			if err != nil {
+				answered(nil, err)
+				return
+			}
+			var decoys []func()
+			if cover != nil {
+				for _, domain := range cover.decoyDomains() {
+					decoys = append(decoys, prepared.decoy(domain, dnsQuery.Question[0].Qtype, client))
+				}
+			}
+			scheduleQuery(timing, func() {
+				answered(prepared.exchange(ctx, dnsQuery.Copy(), client))
+			}, decoys)
+		}(path)
+	}
+
+	answers := make([]pathAnswer, 0, len(paths))
+	for range paths {
+		answer := <-results
+		answers = append(answers, answer)
+		if race && answer.response != nil {
+			break
+		}
+	}
+	return answers
+}
+
+// majorityAnswer returns the answer more than half of the paths agree on, if any.
+func majorityAnswer(answers []pathAnswer, paths int) (pathAnswer, bool) {
+	votes := make(map[string]int)
+	for _, answer := range answers {
+		if answer.response != nil {
+			votes[answer.Answer]++
+		}
+	}
+	for _, answer := range answers {
+		if answer.response != nil && votes[answer.Answer]*2 > paths {
+			return answer, true
+		}
+	}
+	return pathAnswer{}, false
+}
+
+func logDisagreement(path string, record disagreement) error {
+	fmt.Fprintf(os.Stderr, "warning: targets disagree on %s %s\n", record.Domain, record.DnsType)
+	for _, answer := range record.Answers {
+		if len(answer.Error) > 0 {
+			fmt.Fprintf(os.Stderr, "  %s: error: %s\n", answer.Path, answer.Error)
+		} else if answer.Answer != record.Majority {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", answer.Path, strings.Replace(answer.Answer, "\n", "; ", -1))
+		}
+	}
+	if len(path) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(record)
+}
+
+// crossCheckRequest resolves the query for `odoh --resolution race` and `--resolution majority`.
+func crossCheckRequest(c *cli.Context) error {
+	mode := c.String("resolution")
+	// These flags choose a single target or path, which --targets and --proxies replace.
+	for _, flag := range []string{"proxy", "relay", "gateway"} {
+		if len(c.String(flag)) > 0 {
+			return fmt.Errorf("--%s cannot be combined with --resolution %s, use --targets and --proxies", flag, mode)
+		}
+	}
+	if len(splitList(c.StringSlice("shard-targets"))) > 0 {
+		return fmt.Errorf("--shard-targets cannot be combined with --resolution %s, use --targets", mode)
+	}
+	if c.String("protocol") == PROTOCOL_OHTTP && c.String("key-consistency") != KEY_CONSISTENCY_OFF {
+		return fmt.Errorf("--key-consistency checks ODoH configs and cannot be combined with --protocol %s", PROTOCOL_OHTTP)
+	}
+	paths, err := resolverPaths(splitList(c.StringSlice("targets")), splitList(c.StringSlice("proxies")))
+	if err != nil {
+		return err
+	}
+	timing, err := newTimingPolicy(c)
+	if err != nil {
+		return err
+	}
+	cover, err := newCoverTrafficFromFlags(c)
+	if err != nil {
+		return err
+	}
+	proxies := make([]string, 0, len(paths))
+	for _, path := range paths {
+		proxies = append(proxies, path.Proxy)
+	}
+	client, err := newProxyHTTPClient(c, proxies...)
+	if err != nil {
+		return err
+	}
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(c.String("domain"), dnsQueryStringToType(c.String("dnstype")))
+	if cover != nil {
+		if err := padDnsQuery(dnsQuery); err != nil {
+			return err
+		}
+	}
+	answers := resolveAcross(c, paths, dnsQuery, client, mode == RESOLUTION_RACE, timing, cover)
+	sort.Slice(answers, func(i, j int) bool { return answers[i].Elapsed < answers[j].Elapsed })
+
+	var chosen pathAnswer
+	var found bool
+	if mode == RESOLUTION_RACE {
+		for _, answer := range answers {
+			if answer.response != nil {
+				chosen, found = answer, true
+				break
+			}
+		}
+	} else {
+		chosen, found = majorityAnswer(answers, len(paths))
+		disagree := !found
+		for _, answer := range answers {
+			if answer.response != nil && answer.Answer != chosen.Answer {
+				disagree = true
+			}
+		}
+		if disagree {
+			record := disagreement{
+				Time:     time.Now(),
+				Domain:   c.String("domain"),
+				DnsType:  c.String("dnstype"),
+				Majority: chosen.Answer,
+				Answers:  answers,
+			}
+			if err := logDisagreement(c.String("disagreement-log"), record); err != nil {
+				return err
+			}
+			if found && c.Bool("unanimous") {
+				return fmt.Errorf("rejecting the answer for %s: the targets do not all agree", c.String("domain"))
+			}
+		}
+	}
+	if !found {
+		failures := make([]string, 0, len(answers))
+		for _, answer := range answers {
+			if len(answer.Error) > 0 {
+				failures = append(failures, fmt.Sprintf("%s: %s", answer.Path, answer.Error))
+			}
+		}
+		if mode == RESOLUTION_RACE {
+			return fmt.Errorf("no target answered: %s", strings.Join(failures, "; "))
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("no answer for %s has a majority of the %d targets: %s", c.String("domain"), len(paths), strings.Join(failures, "; "))
+		}
+		return fmt.Errorf("no answer for %s has a majority of the %d targets", c.String("domain"), len(paths))
+	}
+
+	fmt.Println(chosen.response)
+	if c.Bool("trace") {
+		fmt.Printf(";; %s RESOLUTION:\n", strings.ToUpper(mode))
+		for _, answer := range answers {
+			status := "agrees"
+			if len(answer.Error) > 0 {
+				status = "error: " + answer.Error
+			} else if answer.Answer != chosen.Answer {
+				status = "disagrees"
+			} else if answer.Path == chosen.Path {
+				status = "chosen"
+			}
+			fmt.Printf(";; %-40s %s %s\n", answer.Path.String()+":", formatDuration(answer.Elapsed), status)
+		}
+	}
+	return nil
+}
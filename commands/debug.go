@@ -0,0 +1,214 @@
+package commands
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// exportedQueryContext is the JSON form of an odohQueryContext, which is all that is needed to open
+// the response to a sealed query. It contains the HPKE exporter secret, so treat it as a key.
+type exportedQueryContext struct {
+	Version uint16 `json:"version"`
+	KemID   uint16 `json:"kemId"`
+	KdfID   uint16 `json:"kdfId"`
+	AeadID  uint16 `json:"aeadId"`
+	KeyID   string `json:"keyId,omitempty"`
+	Query   string `json:"query"`
+	Secret  string `json:"secret"`
+}
+
+func exportQueryContext(queryContext odohQueryContext, keyID []byte) exportedQueryContext {
+	return exportedQueryContext{
+		Version: queryContext.Version,
+		KemID:   uint16(queryContext.Suite.KemID),
+		KdfID:   uint16(queryContext.Suite.KdfID),
+		AeadID:  uint16(queryContext.Suite.AeadID),
+		KeyID:   hex.EncodeToString(keyID),
+		Query:   hex.EncodeToString(queryContext.Query),
+		Secret:  hex.EncodeToString(queryContext.Secret),
+	}
+}
+
+func (e exportedQueryContext) queryContext() (odohQueryContext, error) {
+	query, err := hex.DecodeString(e.Query)
+	if err != nil {
+		return odohQueryContext{}, fmt.Errorf("invalid query: %v", err)
+	}
+	secret, err := hex.DecodeString(e.Secret)
+	if err != nil {
+		return odohQueryContext{}, fmt.Errorf("invalid secret: %v", err)
+	}
+	return odohQueryContext{
+		Version: e.Version,
+		Suite:   hpkeSuite{hpke.KEMID(e.KemID), hpke.KDFID(e.KdfID), hpke.AEADID(e.AeadID)},
+		Query:   query,
+		Secret:  secret,
+	}, nil
+}
+
+// readBinaryOrHex reads a captured message, either as raw bytes or as hex such as printed by the
+// other commands and most packet dissectors.
+func readBinaryOrHex(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.Join(strings.Fields(string(data)), "")
+	if decoded, err := hex.DecodeString(text); err == nil && len(text) > 0 {
+		return decoded, nil
+	}
+	return data, nil
+}
+
+// readConfigsFile reads an ObliviousDoHConfigs list from an `odohconfig-mint` PEM file, or from the
+// raw or hex output of `odohconfig-fetch`.
+func readConfigsFile(path string) (odoh.ObliviousDoHConfigs, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		configs, _, err := readConfigsPEM(path)
+		return configs, err
+	}
+	serialized, err := readBinaryOrHex(path)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+	return parseObliviousDoHConfigs(serialized)
+}
+
+func writeJSON(path string, perm os.FileMode, value interface{}) error {
+	return writeOutput(path, perm, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	})
+}
+
+func readQueryContext(path string) (odohQueryContext, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return odohQueryContext{}, err
+	}
+	var exported exportedQueryContext
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return odohQueryContext{}, fmt.Errorf("unable to parse the query context %v: %v", path, err)
+	}
+	return exported.queryContext()
+}
+
+// debugSeal encrypts a DNS query as the odoh command would, but writes the ODoH message and the
+// query context to files instead of sending it.
+func debugSeal(c *cli.Context) error {
+	configs, err := readConfigsFile(c.String("configs"))
+	if err != nil {
+		return err
+	}
+	suitePreference, err := parseSuitePreference(c.String("suites"))
+	if err != nil {
+		return err
+	}
+	versions, err := parseOdohVersions(c.String("odoh-version"))
+	if err != nil {
+		return err
+	}
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(dns.Fqdn(c.String("domain")), dnsQueryStringToType(c.String("dnstype")))
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		return err
+	}
+
+	odohQuery, queryContext, config, err := createOdohQuestionWithConfigs(packedDnsQuery, orderConfigs(configs, versions, suitePreference))
+	if err != nil {
+		return err
+	}
+	serializedQuery := odohQuery.Marshal()
+	if err := ioutil.WriteFile(c.String("out"), serializedQuery, 0644); err != nil {
+		return err
+	}
+	// The context holds the exporter secret of the query.
+	if err := writeJSON(c.String("context-out"), 0600, exportQueryContext(queryContext, config.Contents.KeyID())); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sealed to Version(0x%04x), %v KeyID(%x)\n", config.Version, suiteOfConfig(config), config.Contents.KeyID())
+	fmt.Printf("ObliviousDoHMessage (%d bytes): %x\n", len(serializedQuery), serializedQuery)
+	return nil
+}
+
+// debugOpenResponse decrypts a captured response with the query context written by debugSeal.
+func debugOpenResponse(c *cli.Context) error {
+	queryContext, err := readQueryContext(c.String("context"))
+	if err != nil {
+		return err
+	}
+	data, err := readBinaryOrHex(c.String("in"))
+	if err != nil {
+		return err
+	}
+	message, err := unmarshalObliviousMessage(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ObliviousDoHMessage: type %d, key_id (%d bytes) %x, encrypted_message %d bytes\n",
+		message.MessageType, len(message.KeyID), message.KeyID, len(message.EncryptedMessage))
+
+	dnsResponse, err := validateEncryptedResponse(message, queryContext)
+	if err != nil {
+		return err
+	}
+	fmt.Println(dnsResponse)
+	return nil
+}
+
+// debugOpenQuery decrypts a captured query with a private key written by `odohconfig-mint`.
+func debugOpenQuery(c *cli.Context) error {
+	configs, err := readConfigsFile(c.String("configs"))
+	if err != nil {
+		return err
+	}
+	keys, err := readPrivateKeysPEM(c.String("private-key"), configs)
+	if err != nil {
+		return err
+	}
+	data, err := readBinaryOrHex(c.String("in"))
+	if err != nil {
+		return err
+	}
+	message, err := unmarshalObliviousMessage(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ObliviousDoHMessage: type %d, key_id %x, encrypted_message %d bytes\n",
+		message.MessageType, message.KeyID, len(message.EncryptedMessage))
+
+	query, queryContext, err := openQuery(message, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Opened with Version(0x%04x), %v, padding %d bytes\n", queryContext.Version, queryContext.Suite, len(query.Padding))
+
+	dnsQuery := new(dns.Msg)
+	if err := dnsQuery.Unpack(query.DnsMessage); err != nil {
+		return fmt.Errorf("malformed DNS query: %v", err)
+	}
+	fmt.Println(dnsQuery)
+
+	if len(c.String("context-out")) > 0 {
+		return writeJSON(c.String("context-out"), 0600, exportQueryContext(queryContext, message.KeyID))
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The client can reach the oblivious proxies and the config sources through a chain of outbound
+// proxies: SOCKS5 and HTTP CONNECT proxies for corporate egress, or Tor. Each hop is asked to
+// connect to the next one and the last hop to the destination. socks5h and HTTP CONNECT hops get
+// host names and resolve them remotely, so that no name is looked up locally; plain socks5 hops
+// resolve names locally first, as SOCKS5 clients traditionally do.
+
+type outboundProxy struct {
+	scheme   string
+	address  string
+	username string
+	password string
+	auth     bool
+}
+
+func (p outboundProxy) String() string {
+	return p.scheme + "://" + p.address
+}
+
+// parseOutboundProxy reads socks5://, socks5h:// or http:// proxy URLs, with optional credentials.
+func parseOutboundProxy(raw string) (outboundProxy, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return outboundProxy{}, fmt.Errorf("invalid outbound proxy %q: %v", raw, err)
+	}
+	proxy := outboundProxy{scheme: proxyURL.Scheme, address: proxyURL.Host}
+	port := ""
+	switch proxy.scheme {
+	case OUTBOUND_SOCKS5, OUTBOUND_SOCKS5H:
+		port = "1080"
+	case OUTBOUND_HTTP:
+		port = "80"
+	default:
+		return outboundProxy{}, fmt.Errorf("unsupported outbound proxy %q, expected %s://, %s:// or %s://", raw, OUTBOUND_SOCKS5, OUTBOUND_SOCKS5H, OUTBOUND_HTTP)
+	}
+	if len(proxyURL.Hostname()) == 0 {
+		return outboundProxy{}, fmt.Errorf("outbound proxy %q has no host", raw)
+	}
+	if len(proxyURL.Port()) == 0 {
+		proxy.address = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	if proxyURL.User != nil {
+		proxy.auth = true
+		proxy.username = proxyURL.User.Username()
+		proxy.password, _ = proxyURL.User.Password()
+	}
+	return proxy, nil
+}
+
+// dialerChain dials connections through its outbound proxies, in order.
+type dialerChain struct {
+	proxies []outboundProxy
+	dialer  *net.Dialer
+}
+
+func (d *dialerChain) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if len(d.proxies) == 0 {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("outbound proxies only carry TCP, not %s", network)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxies[0].address)
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy %v: %v", d.proxies[0], err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(HTTP_CLIENT_TIMEOUT)
+	}
+	conn.SetDeadline(deadline)
+	for i, proxy := range d.proxies {
+		next := address
+		if i+1 < len(d.proxies) {
+			next = d.proxies[i+1].address
+		}
+		tunnel := conn
+		if proxy.scheme == OUTBOUND_HTTP {
+			tunnel, err = proxy.connectHTTP(conn, next)
+		} else {
+			err = proxy.connectSOCKS5(ctx, conn, next)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("outbound proxy %v: %v", proxy, err)
+		}
+		conn = tunnel
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// connectSOCKS5 asks the SOCKS5 proxy on conn to connect to the address (RFC 1928), authenticating
+// with a username and password (RFC 1929) when the proxy has credentials.
+func (p outboundProxy) connectSOCKS5(ctx context.Context, conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port in %q", address)
+	}
+
+	method := byte(0x00)
+	if p.auth {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("not a SOCKS5 server, version %d", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if p.auth {
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return errors.New("SOCKS5 credentials longer than 255 bytes")
+		}
+		request := append([]byte{0x01, byte(len(p.username))}, p.username...)
+		request = append(append(request, byte(len(p.password))), p.password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && p.scheme == OUTBOUND_SOCKS5 {
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		if len(addresses) == 0 {
+			return fmt.Errorf("no address for %s", host)
+		}
+		ip = addresses[0].IP
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long for SOCKS5", host)
+		}
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	case ip.To4() != nil:
+		request = append(append(request, 0x01), ip.To4()...)
+	default:
+		request = append(append(request, 0x04), ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		if reason, ok := socks5Replies[header[1]]; ok {
+			return fmt.Errorf("unable to connect to %s: %s", address, reason)
+		}
+		return fmt.Errorf("unable to connect to %s: reply %d", address, header[1])
+	}
+	// The reply ends with the address the proxy bound, which the client has no use for.
+	var bound int
+	switch header[3] {
+	case 0x01:
+		bound = net.IPv4len
+	case 0x04:
+		bound = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		bound = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d in the SOCKS5 reply", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, bound+2))
+	return err
+}
+
+// bufferedConn is a connection whose first bytes were already read into a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connectHTTP asks the HTTP proxy on conn to open a tunnel to the address with CONNECT.
+func (p outboundProxy) connectHTTP(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		// An empty User-Agent keeps Go from announcing itself to the proxy.
+		Header: http.Header{"User-Agent": []string{""}},
+	}
+	if p.auth {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT to %s failed: %s", address, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// newOutboundChain reads --outbound-proxy, --tor and --tor-socks. With --tor, the Tor SOCKS port is
+// the last hop, with credentials drawn for this run: Tor isolates streams with different SOCKS
+// credentials on different circuits, so that the run shares no circuit with other applications.
+func newOutboundChain(c *cli.Context) (*dialerChain, error) {
+	chain := &dialerChain{dialer: &net.Dialer{Timeout: HTTP_CLIENT_TIMEOUT, KeepAlive: 30 * time.Second}}
+	for _, raw := range splitList(c.StringSlice("outbound-proxy")) {
+		proxy, err := parseOutboundProxy(raw)
+		if err != nil {
+			return nil, err
+		}
+		chain.proxies = append(chain.proxies, proxy)
+	}
+	if c.Bool("tor") {
+		isolation := make([]byte, 16)
+		if _, err := rand.Read(isolation); err != nil {
+			return nil, err
+		}
+		chain.proxies = append(chain.proxies, outboundProxy{
+			scheme:   OUTBOUND_SOCKS5H,
+			address:  c.String("tor-socks"),
+			username: "odoh-client",
+			password: hex.EncodeToString(isolation),
+			auth:     true,
+		})
+	}
+	return chain, nil
+}
+
+// useOutboundProxies routes the connections of the command through the outbound proxies, and
+// returns the function restoring the previous transport.
+func useOutboundProxies(c *cli.Context) (func(), error) {
+	chain, err := newOutboundChain(c)
+	if err != nil {
+		return func() {}, err
+	}
+	if len(chain.proxies) == 0 {
+		return func() {}, nil
+	}
+	transport, ok := httpTransport.(*http.Transport)
+	if !ok {
+		return func() {}, errors.New("outbound proxies need an http.Transport")
+	}
+	previousTransport := httpTransport
+	httpTransport = routeTransport(transport.Clone(), chain)
+	return func() { httpTransport = previousTransport }, nil
+}
+
+// routeTransport makes the transport dial through the chain. Proxy settings from the environment
+// are dropped, as they would bypass the chain.
+func routeTransport(transport *http.Transport, chain *dialerChain) *http.Transport {
+	transport.Proxy = nil
+	transport.DialContext = chain.DialContext
+	return transport
+}
@@ -0,0 +1,1720 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testSuiteX25519 = hpkeSuite{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128}
+	testSuiteP256   = hpkeSuite{hpke.DHKEM_P256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128}
+)
+
+func TestObliviousQuery(t *testing.T) {
+	for _, version := range []uint16{ODOH_VERSION_DRAFT, ODOH_VERSION_RFC9230} {
+		for _, useProxy := range []bool{false, true} {
+			h := newTestHarness(t)
+			target := h.addTarget(version)
+			args := []string{"odoh", "--domain", "example.test.", "--dnstype", "AAAA", "--target", target.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN}
+			if useProxy {
+				args = append(args, "--proxy", h.addProxy().host())
+			}
+
+			output, err := h.run(args...)
+			if err != nil {
+				t.Fatalf("%s, proxy %v: %v\n%s", odohVersionName(version), useProxy, err, output)
+			}
+			if !strings.Contains(output, "2001:db8::1") {
+				t.Fatalf("%s, proxy %v: answer missing from output:\n%s", odohVersionName(version), useProxy, output)
+			}
+		}
+	}
+}
+
+func TestObliviousQuerySelection(t *testing.T) {
+	h := newTestHarness(t)
+	draftX25519 := h.mintKey(testSuiteX25519, ODOH_VERSION_DRAFT)
+	draftP256 := h.mintKey(testSuiteP256, ODOH_VERSION_DRAFT)
+	rfcX25519 := h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230)
+	target := h.addTargetWithKeys([]mintedKey{draftX25519, draftP256, rfcX25519})
+	proxy := h.addProxy()
+
+	cases := []struct {
+		flags    []string
+		expected mintedKey
+	}{
+		{nil, rfcX25519},
+		{[]string{"--odoh-version", "draft"}, draftX25519},
+		{[]string{"--odoh-version", "draft", "--suites", "16:1:1"}, draftP256},
+	}
+	for i, c := range cases {
+		args := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN}
+		output, err := h.run(append(args, c.flags...)...)
+		if err != nil {
+			t.Fatalf("%v: %v\n%s", c.flags, err, output)
+		}
+		keyIDs := target.receivedKeyIDs()
+		if len(keyIDs) != i+1 || !bytes.Equal(keyIDs[i], c.expected.Config.Contents.KeyID()) {
+			t.Fatalf("%v: query sent to KeyID(%x), expected KeyID(%x)", c.flags, keyIDs[len(keyIDs)-1], c.expected.Config.Contents.KeyID())
+		}
+	}
+}
+
+func TestConfigFetch(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230, testSuiteX25519, testSuiteP256)
+
+	output, err := h.run("odohconfig-fetch", "--target", target.host(), "--source", CONFIG_SOURCE_WELLKNOWN, "--output", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report targetConfigsReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, output)
+	}
+	if report.Source != CONFIG_SOURCE_WELLKNOWN || report.TTL != 300 || len(report.Configs) != len(target.keys) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for i, config := range report.Configs {
+		if !config.Supported || config.Version != ODOH_VERSION_RFC9230 {
+			t.Fatalf("config %d: unexpected description %+v", i, config)
+		}
+	}
+}
+
+func TestMintSeed(t *testing.T) {
+	h := newTestHarness(t)
+	dir := t.TempDir()
+	seed := strings.Repeat("ab", 32)
+
+	mint := func(name string, suites string) mintManifest {
+		manifestFile := filepath.Join(dir, name)
+		if output, err := h.run("odohconfig-mint", "--suites", suites, "--seed", seed, "--config-out", filepath.Join(dir, name+".pem"), "--manifest-out", manifestFile); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		data, err := ioutil.ReadFile(manifestFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest mintManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if !manifest.Seeded || len(manifest.Keys) != 2 {
+			t.Fatalf("unexpected manifest: %+v", manifest)
+		}
+		return manifest
+	}
+
+	first := mint("first.json", "32:1:1,32:1:3")
+	if first.Keys[0].PublicKey == first.Keys[1].PublicKey || first.Keys[0].KeyID == first.Keys[1].KeyID {
+		t.Fatalf("suites sharing a KEM got the same key from one seed: %+v", first.Keys)
+	}
+	again := mint("again.json", "32:1:1,32:1:3")
+	for i := range first.Keys {
+		if first.Keys[i].PublicKey != again.Keys[i].PublicKey {
+			t.Fatalf("the same seed minted different keys: %+v and %+v", first.Keys[i], again.Keys[i])
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	h := newTestHarness(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keyring.json")
+	keyringArgs := []string{"--keyring", path}
+	publish := append([]string{"odohconfig-rotate", "publish", "--config-out", filepath.Join(dir, "configs.pem"), "--private-key-out", filepath.Join(dir, "keys.pem")}, keyringArgs...)
+	rotate := func(args ...string) (string, error) {
+		return h.run(append(append([]string{"odohconfig-rotate"}, args...), keyringArgs...)...)
+	}
+	load := func() *keyring {
+		ring, err := loadKeyring(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ring
+	}
+	// backdate moves a timestamp of the key in the state past the max TTL.
+	backdate := func(state string, field func(entry *keyringEntry) *time.Time) {
+		ring := load()
+		for _, i := range ring.keysInState(state) {
+			*field(&ring.Keys[i]) = time.Now().Add(-2 * ring.maxTTL())
+		}
+		if err := ring.save(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if output, err := rotate("init", "--max-ttl", "1h"); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if output, err := rotate("prepare"); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if _, err := rotate("switch"); err == nil || !strings.Contains(err.Error(), "not been published") {
+		t.Fatalf("expected the switch to wait for the next key to be published: %v", err)
+	}
+
+	// A key minted long ago but published just now must still wait for the max TTL.
+	backdate(KEY_STATE_NEXT, func(entry *keyringEntry) *time.Time { return &entry.Created })
+	if output, err := h.run(publish...); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if ring := load(); len(ring.published()) != 2 || ring.published()[1].Published.IsZero() {
+		t.Fatalf("expected the next key to be published: %+v", ring.Keys)
+	}
+	if _, err := rotate("switch"); err == nil || !strings.Contains(err.Error(), "only published") {
+		t.Fatalf("expected the switch to wait for the max TTL: %v", err)
+	}
+	backdate(KEY_STATE_NEXT, func(entry *keyringEntry) *time.Time { return &entry.Published })
+	if output, err := rotate("switch"); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+
+	// The previous key stays published until the next publish, and accepted for the max TTL after.
+	retire := func() []int {
+		if output, err := rotate("retire"); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		return load().keysInState(KEY_STATE_RETIRED)
+	}
+	backdate(KEY_STATE_RETIRING, func(entry *keyringEntry) *time.Time { return &entry.Deactivated })
+	if retired := retire(); len(retired) != 0 {
+		t.Fatal("a key still published was retired")
+	}
+	if output, err := h.run(publish...); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if retired := retire(); len(retired) != 0 {
+		t.Fatal("a key unpublished less than the max TTL ago was retired")
+	}
+	backdate(KEY_STATE_RETIRING, func(entry *keyringEntry) *time.Time { return &entry.Unpublished })
+	retired := retire()
+	if ring := load(); len(retired) != 1 || len(ring.Keys[retired[0]].PrivateKey) > 0 || len(ring.accepted()) != 1 {
+		t.Fatalf("expected the previous key to be retired and erased: %+v", ring.Keys)
+	}
+}
+
+// runBench runs `bench` through runBenchmark, with two clients querying the hostname twice within
+// the first tick of --rate. Later args override the defaults.
+func runBench(h *testHarness, hostname string, args ...string) ([]experimentResult, error) {
+	dataset := filepath.Join(h.t.TempDir(), "dataset.csv")
+	name := strings.TrimSuffix(hostname, ".")
+	if err := ioutil.WriteFile(dataset, []byte(name+"\n"+name), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+	var results []experimentResult
+	err := h.runAction(func(c *cli.Context) error {
+		var err error
+		results, err = runBenchmark(c, "test_instance", "EXP_TEST")
+		return err
+	}, append([]string{"bench", "--data", dataset, "--pick", "2", "--numclients", "2", "--rate", "60", "--discovery", h.discoveryHost(), "--config-source", CONFIG_SOURCE_WELLKNOWN}, args...)...)
+	return results, err
+}
+
+func TestBench(t *testing.T) {
+	h := newTestHarness(t)
+	h.addTarget(ODOH_VERSION_DRAFT)
+	h.addTarget(ODOH_VERSION_RFC9230)
+	h.addProxy()
+	h.addProxy()
+	services, err := fetchProxiesAndTargets(h.discoveryHost(), h.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := runBench(h, "example.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	for _, result := range results {
+		if !result.Status {
+			t.Fatalf("query via %v to %v failed: %s", result.Proxy, result.Target, result.DnsAnswer)
+		}
+		if !strings.Contains(strings.Join(services.Targets, " "), result.Target) || !strings.Contains(strings.Join(services.Proxies, " "), result.Proxy) || result.IngestedFrom != "test_instance" {
+			t.Fatalf("unexpected experiment %+v", result)
+		}
+		answer, err := parseDnsResponse(result.DnsAnswer)
+		if err != nil || len(answer.Answer) != 1 || !strings.Contains(answer.Answer[0].String(), "192.0.2.1") {
+			t.Fatalf("unexpected answer via %v to %v: %v", result.Proxy, result.Target, answer)
+		}
+	}
+
+	if _, err := runBench(h, "example.test.", "--protocol", "doq"); err == nil || !strings.Contains(err.Error(), "Unknown protocol") {
+		t.Fatalf("expected the protocol to be rejected: %v", err)
+	}
+}
+
+func TestDebugRoundTrip(t *testing.T) {
+	h := newTestHarness(t)
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	if output, err := h.run("odohconfig-mint", "--odoh-version", "rfc9230", "--config-out", file("configs.pem"), "--private-key-out", file("keys.pem")); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if output, err := h.run("odoh-debug", "seal", "--configs", file("configs.pem"), "--domain", "example.test.", "--dnstype", "A", "--out", file("query.odoh"), "--context-out", file("query-context.json")); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	output, err := h.run("odoh-debug", "open-query", "--configs", file("configs.pem"), "--private-key", file("keys.pem"), "--in", file("query.odoh"), "--context-out", file("target-context.json"))
+	if err != nil || !regexp.MustCompile(`example\.test\.\s+IN\s+A`).MatchString(output) {
+		t.Fatalf("expected the query to open: %v\n%s", err, output)
+	}
+
+	// The target seals an answer with its side of the context, which the client opens with its own.
+	targetContext, err := readQueryContext(file("target-context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := new(dns.Msg)
+	answer.SetQuestion("example.test.", dns.TypeA)
+	answer.Response = true
+	record, err := dns.NewRR(testZone[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer.Answer = []dns.RR{record}
+	packedAnswer, err := answer.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := targetContext.SealAnswer(packedAnswer, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file("response.hex"), []byte(hex.EncodeToString(response.Marshal())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err = h.run("odoh-debug", "open-response", "--context", file("query-context.json"), "--in", file("response.hex"))
+	if err != nil || !strings.Contains(output, "192.0.2.1") {
+		t.Fatalf("expected the response to open: %v\n%s", err, output)
+	}
+
+	// Malformed and tampered messages are rejected.
+	serializedQuery, err := ioutil.ReadFile(file("query.odoh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file("truncated.odoh"), serializedQuery[:len(serializedQuery)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := h.run("odoh-debug", "open-query", "--configs", file("configs.pem"), "--private-key", file("keys.pem"), "--in", file("truncated.odoh")); err == nil {
+		t.Fatalf("expected a truncated query to be rejected:\n%s", output)
+	}
+	tampered := response.Marshal()
+	tampered[len(tampered)-1] ^= 0x01
+	if err := ioutil.WriteFile(file("tampered.odoh"), tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := h.run("odoh-debug", "open-response", "--context", file("query-context.json"), "--in", file("tampered.odoh")); err == nil {
+		t.Fatalf("expected a tampered response to be rejected:\n%s", output)
+	}
+	if err := ioutil.WriteFile(file("garbage.pem"), []byte("not configs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := h.run("odoh-debug", "seal", "--configs", file("garbage.pem"), "--out", file("query.odoh"), "--context-out", file("query-context.json")); err == nil {
+		t.Fatalf("expected malformed configs to be rejected:\n%s", output)
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestHPKEKnownAnswers checks the RFC 9180 implementation in hpke.go against the base mode vectors of
+// RFC 9180 Appendix A.1.1 (DHKEM(X25519, HKDF-SHA256)) and A.3.1 (DHKEM(P-256, HKDF-SHA256)), both
+// with HKDF-SHA256 and AES-128-GCM.
+func TestHPKEKnownAnswers(t *testing.T) {
+	const info = "4f6465206f6e2061204772656369616e2055726e"
+	vectors := []struct {
+		name                            string
+		kem                             hpke.KEMID
+		ikmE, ikmR, skRm, pkRm, enc     string
+		sharedSecret, key, baseNonce    string
+		exporterSecret, firstCiphertext string
+		exports                         []string
+	}{
+		{
+			name:            "X25519",
+			kem:             hpke.DHKEM_X25519,
+			ikmE:            "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234",
+			ikmR:            "6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037",
+			skRm:            "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8",
+			pkRm:            "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d",
+			enc:             "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431",
+			sharedSecret:    "fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc",
+			key:             "4531685d41d65f03dc48f6b8302c05b0",
+			baseNonce:       "56d890e5accaaf011cff4b7d",
+			exporterSecret:  "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8",
+			firstCiphertext: "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a",
+			exports: []string{
+				"3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee",
+				"2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5",
+				"e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931",
+			},
+		},
+		{
+			name:            "P-256",
+			kem:             hpke.DHKEM_P256,
+			ikmE:            "4270e54ffd08d79d5928020af4686d8f6b7d35dbe470265f1f5aa22816ce860e",
+			ikmR:            "668b37171f1072f3cf12ea8a236a45df23fc13b82af3609ad1e354f6ef817550",
+			skRm:            "f3ce7fdae57e1a310d87f1ebbde6f328be0a99cdbcadf4d6589cf29de4b8ffd2",
+			pkRm:            "04fe8c19ce0905191ebc298a9245792531f26f0cece2460639e8bc39cb7f706a826a779b4cf969b8a0e539c7f62fb3d30ad6aa8f80e30f1d128aafd68a2ce72ea0",
+			enc:             "04a92719c6195d5085104f469a8b9814d5838ff72b60501e2c4466e5e67b325ac98536d7b61a1af4b78e5b7f951c0900be863c403ce65c9bfcb9382657222d18c4",
+			sharedSecret:    "c0d26aeab536609a572b07695d933b589dcf363ff9d93c93adea537aeabb8cb8",
+			key:             "868c066ef58aae6dc589b6cfdd18f97e",
+			baseNonce:       "4e0bc5018beba4bf004cca59",
+			exporterSecret:  "14ad94af484a7ad3ef40e9f3be99ecc6fa9036df9d4920548424df127ee0d99f",
+			firstCiphertext: "5ad590bb8baa577f8619db35a36311226a896e7342a6d836d8b7bcd2f20b6c7f9076ac232e3ab2523f39513434",
+			exports: []string{
+				"5e9bc3d236e1911d95e65b576a8a86d478fb827e8bdfe77b741b289890490d4d",
+				"6cff87658931bda83dc857e6353efe4987a201b849658d9b047aab4cf216e796",
+				"d8f1ea7942adbba7412c6d431c62d01371ea476b823eb697e1f6e6cae1dab85a",
+			},
+		},
+	}
+	plaintext := []byte("Beauty is truth, truth beauty")
+	aad := []byte("Count-0")
+	exportContexts := [][]byte{nil, {0x00}, []byte("TestContext")}
+
+	for _, v := range vectors {
+		suite, err := hpke.AssembleCipherSuite(v.kem, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kem, err := newDHKEM(v.kem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		skR, pkR, err := kem.deriveKeyPair(decodeHex(t, v.ikmR))
+		if err != nil || hex.EncodeToString(skR) != v.skRm || hex.EncodeToString(pkR) != v.pkRm {
+			t.Fatalf("%s: unexpected recipient key pair %x, %x: %v", v.name, skR, pkR, err)
+		}
+		sharedSecret, enc, err := kem.encap(bytes.NewReader(decodeHex(t, v.ikmE)), pkR)
+		if err != nil || hex.EncodeToString(enc) != v.enc || hex.EncodeToString(sharedSecret) != v.sharedSecret {
+			t.Fatalf("%s: unexpected encap %x, %x: %v", v.name, enc, sharedSecret, err)
+		}
+		if decapped, err := kem.decap(enc, skR); err != nil || hex.EncodeToString(decapped) != v.sharedSecret {
+			t.Fatalf("%s: unexpected decap %x: %v", v.name, decapped, err)
+		}
+
+		sender, err := hpkeV1KeySchedule(suite, sharedSecret, decodeHex(t, info))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(sender.baseNonce) != v.baseNonce || hex.EncodeToString(sender.exporterSecret) != v.exporterSecret {
+			t.Fatalf("%s: unexpected base_nonce %x or exporter_secret %x", v.name, sender.baseNonce, sender.exporterSecret)
+		}
+		// The context keeps only the AEAD, so check the key by sealing with it directly.
+		aead, err := suite.AEAD.New(decodeHex(t, v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := aead.Seal(nil, decodeHex(t, v.baseNonce), plaintext, aad)
+		ciphertext := sender.Seal(aad, plaintext)
+		if hex.EncodeToString(ciphertext) != v.firstCiphertext || !bytes.Equal(ciphertext, expected) {
+			t.Fatalf("%s: unexpected ciphertext %x", v.name, ciphertext)
+		}
+
+		receiver, err := setupBaseReceiverV1(suite, skR, enc, decodeHex(t, info))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened, err := receiver.Open(aad, ciphertext); err != nil || !bytes.Equal(opened, plaintext) {
+			t.Fatalf("%s: unable to open the ciphertext: %v", v.name, err)
+		}
+		for i, exporterContext := range exportContexts {
+			if exported := receiver.Export(exporterContext, 32); hex.EncodeToString(exported) != v.exports[i] {
+				t.Fatalf("%s: unexpected export for %q: %x", v.name, exporterContext, exported)
+			}
+		}
+	}
+}
+
+func TestInjectedFailures(t *testing.T) {
+	cases := []struct {
+		name   string
+		inject func(h *testHarness, target *harnessTarget, proxy *harnessProxy)
+	}{
+		{"target error", func(h *testHarness, target *harnessTarget, proxy *harnessProxy) {
+			target.faults.set(failWithStatus(http.StatusInternalServerError))
+		}},
+		{"proxy unavailable", func(h *testHarness, target *harnessTarget, proxy *harnessProxy) {
+			proxy.faults.set(failWithStatus(http.StatusBadGateway))
+		}},
+		{"proxy drops connection", func(h *testHarness, target *harnessTarget, proxy *harnessProxy) {
+			proxy.faults.set(dropConnection())
+		}},
+		{"wrong content type", func(h *testHarness, target *harnessTarget, proxy *harnessProxy) {
+			proxy.faults.set(withContentType("text/plain"))
+		}},
+		{"corrupted response", func(h *testHarness, target *harnessTarget, proxy *harnessProxy) {
+			target.faults.set(corruptBody())
+		}},
+		{"stale key", func(h *testHarness, target *harnessTarget, proxy *harnessProxy) {
+			target.faults.set(rewriteRequest(func(body []byte) []byte {
+				if len(body) > 3 {
+					body[3] ^= 0xff
+				}
+				return body
+			}))
+		}},
+	}
+
+	for _, c := range cases {
+		h := newTestHarness(t)
+		target := h.addTarget(ODOH_VERSION_RFC9230)
+		proxy := h.addProxy()
+
+		// The configs are fetched before the failure is injected, as a client with cached configs would.
+		configs, err := fetchTargetConfigsFromWellKnown(target.host())
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		c.inject(h, target, proxy)
+
+		output, err := h.run("odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN)
+		if err == nil {
+			t.Fatalf("%s: odoh succeeded:\n%s", c.name, output)
+		}
+
+		e := experiment{
+			Hostname:      "example.test.",
+			DnsType:       dns.TypeA,
+			TargetConfigs: orderConfigs(configs, []uint16{ODOH_VERSION_RFC9230}, defaultSuitePreference),
+			Target:        target.host(),
+			Proxy:         proxy.host(),
+		}
+		channel := make(chan experimentResult, 1)
+		e.run(h.client, channel)
+		if result := <-channel; result.Status {
+			t.Fatalf("%s: bench experiment succeeded", c.name)
+		}
+	}
+}
+
+func TestDiscoveryFailure(t *testing.T) {
+	h := newTestHarness(t)
+	h.addTarget(ODOH_VERSION_DRAFT)
+	h.addProxy()
+
+	h.discoveryFaults.set(rewriteResponse(func(header http.Header, body []byte) []byte {
+		return []byte("<html>maintenance</html>")
+	}))
+	if _, err := runBench(h, "example.test."); err == nil {
+		t.Fatal("expected a malformed discovery response to fail")
+	}
+
+	h.discoveryFaults.set(nil)
+	h.targets[0].faults.set(failWithStatus(http.StatusNotFound))
+	if _, err := runBench(h, "example.test."); err == nil {
+		t.Fatal("expected a target without configs to fail")
+	}
+}
+
+func TestObliviousQueryTrace(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+
+	output, err := h.run("odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"config fetch:       ", "source well-known", "hpke seal:", "tcp connect:", "time to first byte:", "hpke open:", "query size:", "response size:"} {
+		if !strings.Contains(output, phase) {
+			t.Fatalf("trace is missing %q:\n%s", phase, output)
+		}
+	}
+}
+
+func TestSuiteProbe(t *testing.T) {
+	h := newTestHarness(t)
+	suites := []hpkeSuite{
+		testSuiteX25519,
+		testSuiteP256,
+		{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_CHACHA20POLY1305},
+		{hpke.DHKEM_P256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM256},
+	}
+	target := h.addTarget(ODOH_VERSION_RFC9230, suites...)
+	proxy := h.addProxy()
+	args := []string{"odohconfig-probe", "--target", target.host(), "--proxy", proxy.host(), "--source", CONFIG_SOURCE_WELLKNOWN, "--domain", "example.test.", "--count", "2", "--output", "json"}
+
+	output, err := h.run(args...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	var results []suiteProbeResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, output)
+	}
+	if len(results) != len(suites) {
+		t.Fatalf("expected %d results, got %d", len(suites), len(results))
+	}
+	for i, result := range results {
+		if result.Status != PROBE_OK || result.Queries != 2 || uint16(suites[i].AeadID) != result.AeadID {
+			t.Fatalf("suite %v: unexpected result %+v", suites[i], result)
+		}
+	}
+
+	target.faults.set(corruptBody())
+	output, err = h.run(args...)
+	if err == nil {
+		t.Fatal("expected the probe to fail")
+	}
+	if err := json.Unmarshal([]byte(output), &results); err != nil || results[0].Status != PROBE_OPEN_FAILED {
+		t.Fatalf("expected %s, got %+v", PROBE_OPEN_FAILED, results)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, version := range []string{"draft", "rfc9230"} {
+		h := newTestHarness(t)
+		target := h.addTargetWithKeys([]mintedKey{
+			h.mintKey(testSuiteX25519, ODOH_VERSION_DRAFT),
+			h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230),
+		})
+		for _, proxy := range []string{"", h.addProxy().host()} {
+			args := []string{"conformance", "--target", target.host(), "--source", CONFIG_SOURCE_WELLKNOWN, "--odoh-version", version, "--domain", "example.test.", "--output", "json"}
+			if len(proxy) > 0 {
+				args = append(args, "--proxy", proxy)
+			}
+			output, err := h.run(args...)
+			var results []conformanceResult
+			if jsonErr := json.Unmarshal([]byte(output), &results); jsonErr != nil {
+				t.Fatalf("%s: invalid JSON output: %v\n%s", version, jsonErr, output)
+			}
+			for _, result := range results {
+				if !result.Passed {
+					t.Errorf("%s, proxy %q: %s failed: %s", version, proxy, result.Check, result.Detail)
+				}
+			}
+			if err != nil && !t.Failed() {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A target whose answers may be cached is reported.
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	target.faults.set(rewriteResponse(func(header http.Header, body []byte) []byte {
+		header.Set("Cache-Control", "max-age=300")
+		return body
+	}))
+	output, err := h.run("conformance", "--target", target.host(), "--source", CONFIG_SOURCE_WELLKNOWN, "--domain", "example.test.")
+	if err == nil || !strings.Contains(output, "FAIL answer is not cacheable") {
+		t.Fatalf("expected the cacheable answer to fail the check:\n%s", output)
+	}
+}
+
+func TestInteropMatrix(t *testing.T) {
+	h := newTestHarness(t)
+	working := h.addTarget(ODOH_VERSION_DRAFT)
+	broken := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+	broken.faults.set(rewriteRequest(func(body []byte) []byte {
+		return body[:len(body)/2]
+	}))
+
+	output, err := h.run("interop-matrix", "--discovery", h.discoveryHost(), "--direct", "--source", CONFIG_SOURCE_WELLKNOWN, "--domain", "example.test.", "--dnstypes", "A,AAAA", "--output", "json")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	var matrix interopMatrix
+	if err := json.Unmarshal([]byte(output), &matrix); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, output)
+	}
+	if len(matrix.Cells) != 4 {
+		t.Fatalf("expected 4 cells, got %d", len(matrix.Cells))
+	}
+	for _, cell := range matrix.Cells {
+		if cell.Proxy != "" && cell.Proxy != proxy.host() {
+			t.Fatalf("unexpected proxy %q", cell.Proxy)
+		}
+		if len(cell.Results) != 2 {
+			t.Fatalf("%s via %q: expected 2 results, got %+v", cell.Target, cell.Proxy, cell.Results)
+		}
+		if cell.Target == working.host() && !cell.Works {
+			t.Fatalf("%s via %q: expected to work, got %+v", cell.Target, cell.Proxy, cell.Results)
+		}
+		if cell.Target == broken.host() && (cell.Works || cell.Results[0].Status != PROBE_EXCHANGE_FAILED || len(cell.Results[0].Error) == 0) {
+			t.Fatalf("%s via %q: expected an exchange failure, got %+v", cell.Target, cell.Proxy, cell.Results)
+		}
+	}
+
+	output, err = h.run("interop-matrix", "--proxy", proxy.host(), "--target", working.host()+","+broken.host(), "--source", CONFIG_SOURCE_WELLKNOWN, "--domain", "example.test.", "--dnstypes", "aaaa")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 4 || lines[0] != "| Proxied Via | To Target | AAAA | Can Resolve? | Failures |" {
+		t.Fatalf("unexpected Markdown table:\n%s", output)
+	}
+	if !strings.Contains(lines[2], "| &check; | &check; |") || !strings.Contains(lines[3], "AAAA: "+PROBE_EXCHANGE_FAILED) {
+		t.Fatalf("unexpected Markdown rows:\n%s", output)
+	}
+}
+
+func TestBinaryHTTP(t *testing.T) {
+	// The key configuration, request and response of RFC 9458, Appendix A.
+	keys, err := hex.DecodeString("01002031e1f05a740102115220e9af918f738674aec95f54db6e04eb705aae8e79815500080001000100010003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := unmarshalOHTTPKeyConfig(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.KeyID != 1 || config.KemID != hpke.DHKEM_X25519 || len(config.Suites) != 2 || config.Suites[1].AeadID != hpke.AEAD_CHACHA20POLY1305 {
+		t.Fatalf("unexpected key config %+v", config)
+	}
+	if !bytes.Equal(config.Marshal(), keys) {
+		t.Fatalf("key config encodes to %x", config.Marshal())
+	}
+
+	serializedRequest, _ := hex.DecodeString("00034745540568747470730b6578616d706c652e636f6d012f")
+	request, err := unmarshalBinaryRequest(serializedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Method != "GET" || request.Scheme != "https" || request.Authority != "example.com" || request.Path != "/" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	response, err := unmarshalBinaryResponse([]byte{0x01, 0x40, 0xc8})
+	if err != nil || response.Status != http.StatusOK {
+		t.Fatalf("unexpected response %+v: %v", response, err)
+	}
+
+	request = bhttpRequest{Method: "POST", Scheme: "https", Authority: "target.test", Path: "/dns-query", Header: http.Header{"Content-Type": {DOH_MESSAGE}}, Content: []byte{1, 2, 3}}
+	decoded, err := unmarshalBinaryRequest(append(request.Marshal(), 0, 0))
+	if err != nil || decoded.Header.Get("Content-Type") != DOH_MESSAGE || !bytes.Equal(decoded.Content, request.Content) {
+		t.Fatalf("request did not round trip: %+v, %v", decoded, err)
+	}
+	if _, err := unmarshalBinaryRequest(append(request.Marshal(), 1)); err == nil {
+		t.Fatal("expected non-zero padding to be rejected")
+	}
+}
+
+func TestObliviousHTTPQuery(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+
+	for _, via := range [][]string{nil, {"--proxy", proxy.host()}} {
+		args := []string{"odoh", "--protocol", "ohttp", "--domain", "example.test.", "--dnstype", "AAAA", "--target", target.host(), "--trace"}
+		output, err := h.run(append(args, via...)...)
+		if err != nil {
+			t.Fatalf("%v: %v\n%s", via, err, output)
+		}
+		if !strings.Contains(output, "2001:db8::1") || !strings.Contains(output, "OHTTP KeyID(1)") {
+			t.Fatalf("%v: unexpected output:\n%s", via, output)
+		}
+	}
+
+	configs, err := fetchOHTTPKeyConfigs(ohttpGatewayURL(target.host()), h.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := experiment{
+		Hostname:     "example.test.",
+		DnsType:      dns.TypeA,
+		Protocol:     PROTOCOL_OHTTP,
+		OHTTPConfigs: configs,
+		Target:       target.host(),
+		Proxy:        proxy.host(),
+	}
+	channel := make(chan experimentResult, 1)
+	e.run(h.client, channel)
+	if result := <-channel; !result.Status || result.ProtocolType != "OHTTP" {
+		t.Fatalf("bench experiment failed: %s", result.DnsAnswer)
+	}
+
+	target.faults.set(corruptBody())
+	if output, err := h.run("odoh", "--protocol", "ohttp", "--domain", "example.test.", "--target", target.host(), "--proxy", proxy.host()); err == nil {
+		t.Fatalf("expected a corrupted response to fail:\n%s", output)
+	}
+}
+
+func TestProxyTargetRestriction(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	query := func(allowedTargets ...string) (string, error) {
+		proxy, err := newOdohProxy(httpTransport, 5*time.Second, allowedTargets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(proxy.handler())
+		defer server.Close()
+		return h.run("odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", strings.TrimPrefix(server.URL, "http://"), "--config-source", CONFIG_SOURCE_WELLKNOWN)
+	}
+
+	// Without --allow-target, the loopback target is out of reach.
+	if output, err := query(); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("expected the loopback target to be refused: %v\n%s", err, output)
+	}
+	if output, err := query(target.host()); err != nil {
+		t.Fatalf("an allowed target should be reachable: %v\n%s", err, output)
+	}
+
+	for address, refused := range map[string]bool{
+		"169.254.169.254:80":          true,
+		"10.1.2.3:443":                true,
+		"[::1]:443":                   true,
+		"[::ffff:c0a8:1]:53":          true,
+		"[::ffff:127.0.0.1]:443":      true,
+		"[::ffff:169.254.169.254]:80": true,
+		"[fd00::1]:443":               true,
+		"[64:ff9b::a00:1]:443":        true,
+		"[64:ff9b:1::1]:443":          true,
+		"198.18.0.1:443":              true,
+		"198.19.255.254:443":          true,
+		"192.0.0.1:443":               true,
+		"192.0.2.1:443":               true,
+		"198.51.100.1:443":            true,
+		"203.0.113.1:443":             true,
+		"224.0.0.1:443":               true,
+		"239.255.255.250:1900":        true,
+		"240.0.0.1:443":               true,
+		"255.255.255.255:443":         true,
+		"[ff02::1]:443":               true,
+		"[2001:db8::1]:443":           true,
+		"8.8.8.8:443":                 false,
+		"[::ffff:8.8.8.8]:443":        false,
+		"[2606:4700::1111]:443":       false,
+	} {
+		if err := refuseNonPublicAddress("tcp", address, nil); (err != nil) != refused {
+			t.Errorf("%s: unexpected result %v", address, err)
+		}
+	}
+}
+
+// requireAuthorization rejects the requests which do not carry the Authorization header.
+func requireAuthorization(authorization string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != authorization {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addHTTPSProxy()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	args := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.server.URL, "--config-source", CONFIG_SOURCE_WELLKNOWN}
+
+	proxy.faults.set(requireAuthorization("Bearer first"))
+	if output, err := h.run(args...); err == nil {
+		t.Fatalf("expected an anonymous query to be rejected:\n%s", output)
+	}
+	if output, err := h.run(append(args, "--proxy-token", "first")...); err != nil {
+		t.Fatalf("bearer token: %v\n%s", err, output)
+	}
+
+	// Rotated tokens are picked up from the file.
+	for _, token := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		proxy.faults.set(requireAuthorization("Bearer " + token))
+		if output, err := h.run(append(args, "--proxy-token-file", tokenFile)...); err != nil {
+			t.Fatalf("token file: %v\n%s", err, output)
+		}
+	}
+
+	proxy.faults.set(requireAuthorization("Basic dXNlcjpwYXNz"))
+	if output, err := h.run(append(args, "--proxy-basic", "user:pass", "--protocol", "ohttp")...); err != nil {
+		t.Fatalf("basic authentication over OHTTP: %v\n%s", err, output)
+	}
+
+	// Credentials only go over plain HTTP when asked to.
+	plain := h.addProxy()
+	plain.faults.set(requireAuthorization("Bearer first"))
+	plainArgs := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", plain.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--proxy-token", "first"}
+	if output, err := h.run(plainArgs...); err == nil || !strings.Contains(err.Error(), "plain HTTP") {
+		t.Fatalf("expected the credentials to be kept off plain HTTP: %v\n%s", err, output)
+	}
+	if len(plain.receivedHeaders()) > 0 {
+		t.Fatalf("the plain HTTP proxy was contacted: %v", plain.receivedHeaders())
+	}
+	if output, err := h.run(append(plainArgs, "--proxy-insecure-auth")...); err != nil {
+		t.Fatalf("--proxy-insecure-auth: %v\n%s", err, output)
+	}
+
+	for _, header := range target.receivedHeaders() {
+		if len(header.Get("Authorization")) > 0 {
+			t.Fatalf("the target received the proxy credentials: %v", header)
+		}
+	}
+}
+
+func TestProxyClientCertificate(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addTLSProxy()
+	certificate, certificatePEM, err := selfSignedCertificate([]string{"client.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir()
+	certificateFile, keyFile := filepath.Join(directory, "client.pem"), filepath.Join(directory, "client-key.pem")
+	if err := ioutil.WriteFile(certificateFile, certificatePEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.server.URL, "--config-source", CONFIG_SOURCE_WELLKNOWN}
+	if output, err := h.run(args...); err == nil {
+		t.Fatalf("expected the proxy to require a client certificate:\n%s", output)
+	}
+	output, err := h.run(append(args, "--proxy-cert", certificateFile, "--proxy-key", keyFile)...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "192.0.2.1") {
+		t.Fatalf("answer missing from output:\n%s", output)
+	}
+}
+
+// headerSummary renders the headers a server received, except the length of the body.
+func headerSummary(header http.Header) string {
+	var names, fields []string
+	for name := range header {
+		if name != "Content-Length" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, name+": "+strings.Join(header[name], ","))
+	}
+	return strings.Join(fields, "\n")
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+	args := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN}
+
+	for _, test := range []struct {
+		policy string
+		want   string
+	}{
+		{HEADER_POLICY_MINIMAL, "Accept: application/oblivious-dns-message\nAccept-Encoding: gzip\nContent-Type: application/oblivious-dns-message"},
+		{HEADER_POLICY_UNIFORM, "Accept: application/oblivious-dns-message\nAccept-Encoding: identity\nContent-Type: application/oblivious-dns-message\nUser-Agent: odoh-client"},
+	} {
+		before := len(proxy.receivedHeaders())
+		for i := 0; i < 2; i++ {
+			if output, err := h.run(append(args, "--header-policy", test.policy)...); err != nil {
+				t.Fatalf("%v: %v\n%s", test.policy, err, output)
+			}
+		}
+		received := proxy.receivedHeaders()[before:]
+		if len(received) != 2 {
+			t.Fatalf("%v: proxy received %d requests, expected 2", test.policy, len(received))
+		}
+		for _, header := range received {
+			if got := headerSummary(header); got != test.want {
+				t.Fatalf("%v: proxy received\n%s\nexpected\n%s", test.policy, got, test.want)
+			}
+		}
+	}
+
+	for _, header := range target.receivedHeaders() {
+		if header.Get("Content-Type") != OBLIVIOUS_DOH {
+			continue
+		}
+		if want := "Accept: application/oblivious-dns-message\nAccept-Encoding: gzip\nContent-Type: application/oblivious-dns-message"; headerSummary(header) != want {
+			t.Fatalf("target received\n%s\nexpected\n%s", headerSummary(header), want)
+		}
+	}
+
+	if output, err := h.run(append(args, "--header-policy", "verbose")...); err == nil {
+		t.Fatalf("expected an unknown header policy to be rejected:\n%s", output)
+	}
+}
+
+func TestHeaderPolicyStripsIdentifyingHeaders(t *testing.T) {
+	var recorder headerRecorder
+	server := httptest.NewServer(recorder.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "tracked"})
+	})))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := withHeaderPolicy(&http.Client{Jar: jar}, HEADER_POLICY_MINIMAL)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", OBLIVIOUS_DOH)
+		req.Header.Set("Accept-Language", "en-GB")
+		req.Header.Set("Cookie", "session=known")
+		req.Header.Set("User-Agent", "curious/1.0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for _, header := range recorder.receivedHeaders() {
+		if want := "Accept: application/oblivious-dns-message\nAccept-Encoding: gzip"; headerSummary(header) != want {
+			t.Fatalf("server received\n%s\nexpected\n%s", headerSummary(header), want)
+		}
+	}
+}
+
+// leakyTransport adds the headers a careless proxy adds to the requests it relays.
+type leakyTransport struct {
+	header    http.Header
+	transport http.RoundTripper
+}
+
+func (l leakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range l.header {
+		req.Header[name] = values
+	}
+	return l.transport.RoundTrip(req)
+}
+
+func TestPrivacyAudit(t *testing.T) {
+	h := newTestHarness(t)
+	certificate, certificatePEM, err := selfSignedCertificate([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.roots.AppendCertsFromPEM(certificatePEM) {
+		t.Fatal("unable to trust the recording target")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir()
+	certificateFile, keyFile := filepath.Join(directory, "target.pem"), filepath.Join(directory, "target-key.pem")
+	if err := ioutil.WriteFile(certificateFile, certificatePEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"privacy-audit", "--listen", "127.0.0.1:0", "--cert", certificateFile, "--key", keyFile, "--queries", "2"}
+
+	proxy := h.addProxy()
+	output, err := h.run(append(args, "--proxy", proxy.host())...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "2 queries sent, 2 received") || !strings.Contains(output, "No client identity reached the target") {
+		t.Fatalf("unexpected report:\n%s", output)
+	}
+
+	leaky := &odohProxy{client: &http.Client{Transport: leakyTransport{
+		header:    http.Header{"X-Forwarded-For": {"127.0.0.1"}, "Via": {"1.1 leaky"}},
+		transport: h.client.Transport,
+	}}}
+	leakyServer := httptest.NewServer(leaky.handler())
+	defer leakyServer.Close()
+	output, err = h.run(append(args, "--proxy", strings.TrimPrefix(leakyServer.URL, "http://"), "--output", "json")...)
+	if err == nil {
+		t.Fatalf("expected the audit to fail:\n%s", output)
+	}
+	var report auditReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	statuses := make(map[string]string)
+	for _, result := range report.Results {
+		statuses[result.Check] = result.Status
+	}
+	if !report.LeaksIdentity || statuses["no forwarding header names the client"] != AUDIT_LEAK || statuses["no forwarding headers are added"] != AUDIT_WARN || statuses["client headers are not passed on"] != AUDIT_PASS {
+		t.Fatalf("unexpected report:\n%s", output)
+	}
+
+	a := &auditor{clientAddresses: map[string]bool{"10.0.0.1": true, "2001:db8::1": true}}
+	for value, want := range map[string]string{
+		"10.0.0.12":                             "",
+		"10.0.0.1":                              "10.0.0.1",
+		"192.0.2.7, 10.0.0.1":                   "10.0.0.1",
+		"for=10.0.0.1:5353":                     "10.0.0.1",
+		"for=10.0.0.12;proto=https":             "",
+		`for="[2001:db8::1]:443", for=10.0.0.1`: "10.0.0.1,2001:db8::1",
+		"for=\"[2001:db8::10]\"":                "",
+		"/dns-query?client=2001%3Adb8%3A%3A1":   "2001:db8::1",
+	} {
+		if found := strings.Join(a.addresses(value), ","); found != want {
+			t.Errorf("%q: found %q, expected %q", value, found, want)
+		}
+	}
+}
+
+// serveConfigs answers the well-known configs requests with the configs returned by configs, as a
+// target handing out keys per client would.
+func serveConfigs(configs func() []mintedKey) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != ODOH_CONFIG_WELLKNOWN_URL {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var served []odoh.ObliviousDoHConfig
+			for _, key := range configs() {
+				served = append(served, key.Config)
+			}
+			w.Write(odoh.CreateObliviousDoHConfigs(served).Marshal())
+		})
+	}
+}
+
+func TestKeyConsistency(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	first, second := h.addProxy(), h.addProxy()
+	history := filepath.Join(t.TempDir(), "history.json")
+	args := []string{"odohconfig-consistency", "--target", target.host(), "--proxy", first.host() + "," + second.host(), "--consistency-direct", CONFIG_SOURCE_WELLKNOWN, "--key-history", history, "--max-rotations", "1", "--output", "json"}
+
+	check := func() ([]keyConsistencyReport, error) {
+		output, err := h.run(args...)
+		var reports []keyConsistencyReport
+		if jsonErr := json.Unmarshal([]byte(output), &reports); jsonErr != nil || len(reports) != 1 {
+			t.Fatalf("%v\n%s", jsonErr, output)
+		}
+		return reports, err
+	}
+
+	reports, err := check()
+	if err != nil || !reports[0].Consistent || len(reports[0].Vantages) != 3 {
+		t.Fatalf("expected a consistent target: %v %+v", err, reports)
+	}
+	for _, vantage := range reports[0].Vantages {
+		if len(vantage.Error) > 0 || !sameKeyIDs(vantage.KeyIDs, reports[0].Vantages[0].KeyIDs) {
+			t.Fatalf("unexpected vantage %+v", vantage)
+		}
+	}
+
+	// A key per client.
+	var lock sync.Mutex
+	fetches := 0
+	target.faults.set(serveConfigs(func() []mintedKey {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		if fetches == 2 {
+			return []mintedKey{h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230)}
+		}
+		return target.keys
+	}))
+	reports, err = check()
+	if err == nil || reports[0].Consistent || len(reports[0].Problems) != 1 {
+		t.Fatalf("expected per client keys to be detected: %v %+v", err, reports)
+	}
+
+	query := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", first.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--consistency-direct", CONFIG_SOURCE_WELLKNOWN, "--key-history", ""}
+	fetches = 0
+	if output, err := h.run(append(query, "--key-consistency", KEY_CONSISTENCY_REFUSE)...); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("expected the target to be refused: %v\n%s", err, output)
+	}
+	fetches = 0
+	if output, err := h.run(append(query, "--key-consistency", KEY_CONSISTENCY_WARN)...); err != nil {
+		t.Fatalf("a warning should not stop the query: %v\n%s", err, output)
+	}
+
+	// The same key for the check, and a key of its own for a fetch after it.
+	target.faults.set(serveConfigs(func() []mintedKey {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		if fetches > 2 {
+			return []mintedKey{h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230)}
+		}
+		return target.keys
+	}))
+	fetches = 0
+	if output, err := h.run(append(query, "--key-consistency", KEY_CONSISTENCY_REFUSE)...); err != nil || fetches != 2 {
+		t.Fatalf("the query should be sealed with the configs of the check: %v, %d fetches\n%s", err, fetches, output)
+	}
+
+	// The same key everywhere, but a new one on every run.
+	target.faults.set(serveConfigs(func() []mintedKey {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		if (fetches-1)%3 == 0 {
+			target.keys = []mintedKey{h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230)}
+		}
+		return target.keys
+	}))
+	fetches = 0
+	if reports, err = check(); err != nil || reports[0].Rotations != 1 {
+		t.Fatalf("a first rotation is expected: %v %+v", err, reports)
+	}
+	if reports, err = check(); err == nil || reports[0].Rotations != 2 || reports[0].Consistent {
+		t.Fatalf("expected frequent rotations to be detected: %v %+v", err, reports)
+	}
+}
+
+func TestTimingPolicies(t *testing.T) {
+	release := func(policy timingPolicy, queries int, wait time.Duration) ([]time.Time, int) {
+		var lock sync.Mutex
+		var released []time.Time
+		dummies := 0
+		scheduler := newQueryScheduler(policy, func() {
+			lock.Lock()
+			dummies++
+			lock.Unlock()
+		})
+		time.Sleep(wait)
+		for i := 0; i < queries; i++ {
+			scheduler.Submit(func() {
+				lock.Lock()
+				released = append(released, time.Now())
+				lock.Unlock()
+			})
+		}
+		scheduler.Close()
+		sort.Slice(released, func(i, j int) bool { return released[i].Before(released[j]) })
+		return released, dummies
+	}
+
+	start := time.Now()
+	released, _ := release(timingPolicy{Mode: TIMING_JITTER, Jitter: 30 * time.Millisecond}, 5, 0)
+	if len(released) != 5 || released[4].Sub(start) > 200*time.Millisecond {
+		t.Fatalf("jitter: %d queries released after %v", len(released), time.Since(start))
+	}
+
+	interval := 50 * time.Millisecond
+	released, dummies := release(timingPolicy{Mode: TIMING_BATCH, Interval: interval}, 3, 0)
+	if len(released) != 3 || dummies != 0 || released[2].Sub(released[0]) > 10*time.Millisecond {
+		t.Fatalf("batch: queries not released together: %v", released)
+	}
+	if offset := released[0].Sub(released[0].Truncate(interval)); offset > 20*time.Millisecond {
+		t.Fatalf("batch: released %v after the slot", offset)
+	}
+
+	interval = 20 * time.Millisecond
+	released, dummies = release(timingPolicy{Mode: TIMING_CONSTANT_RATE, Interval: interval}, 3, 3*interval)
+	if len(released) != 3 || dummies < 2 {
+		t.Fatalf("constant-rate: %d queries and %d dummies", len(released), dummies)
+	}
+	for i := 1; i < len(released); i++ {
+		if gap := released[i].Sub(released[i-1]); gap < interval/2 {
+			t.Fatalf("constant-rate: queries %v apart", gap)
+		}
+	}
+
+	if _, err := parseTimingPolicy(TIMING_BATCH, 0, 0); err == nil {
+		t.Fatal("expected batch without an interval to be rejected")
+	}
+}
+
+func TestTimingPolicyQueries(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+	output, err := h.run("odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--timing", TIMING_BATCH, "--interval", "50ms", "--trace")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "192.0.2.1") || !strings.Contains(output, ";; timing delay:") || !strings.Contains(output, "batch(50ms)") {
+		t.Fatalf("unexpected output:\n%s", output)
+	}
+
+	configs, err := fetchTargetConfigsFromWellKnown(target.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := timingPolicy{Mode: TIMING_JITTER, Jitter: 20 * time.Millisecond}
+	scheduler := newQueryScheduler(policy, nil)
+	e := experiment{Hostname: "example.test.", DnsType: dns.TypeA, TargetConfigs: configs.Configs, Target: target.host(), Proxy: proxy.host()}
+	channel := make(chan experimentResult, 1)
+	e.runScheduled(scheduler, policy, h.client, channel)
+	scheduler.Close()
+	result := <-channel
+	if !result.Status || result.TimingPolicy != "jitter(20ms)" || result.Timestamp.Queued == 0 || result.Timestamp.Start < result.Timestamp.Queued {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestCoverTraffic(t *testing.T) {
+	for _, domain := range []string{"a.test.", "example.test.", "a-much-longer-name.of.a.popular.domain.test."} {
+		packed, err := packCoverQuery(domain, dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed)%COVER_PADDING_BLOCK != 0 {
+			t.Fatalf("%v: padded query is %d bytes", domain, len(packed))
+		}
+	}
+
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+	domains := filepath.Join(t.TempDir(), "domains.csv")
+	if err := ioutil.WriteFile(domains, []byte("1,popular.test\n2,another-popular-domain.test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := h.run("odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--cover-ratio", "2", "--cover-domains", domains, "--trace")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "192.0.2.1") || !strings.Contains(output, ";; cover queries:      2 decoys") {
+		t.Fatalf("unexpected output:\n%s", output)
+	}
+
+	target.Lock()
+	received := append([]odoh.ObliviousDNSMessage{}, target.received...)
+	target.Unlock()
+	if len(received) != 3 {
+		t.Fatalf("target received %d queries, expected 3", len(received))
+	}
+	for _, message := range received[1:] {
+		if len(message.EncryptedMessage) != len(received[0].EncryptedMessage) {
+			t.Fatalf("queries of %d and %d bytes are distinguishable", len(received[0].EncryptedMessage), len(message.EncryptedMessage))
+		}
+	}
+	var headers []string
+	for _, header := range proxy.receivedHeaders() {
+		if header.Get("Content-Type") == OBLIVIOUS_DOH {
+			headers = append(headers, headerSummary(header)+"\nContent-Length: "+header.Get("Content-Length"))
+		}
+	}
+	if len(headers) != 3 || headers[0] != headers[1] || headers[0] != headers[2] {
+		t.Fatalf("proxy received distinguishable requests: %q", headers)
+	}
+
+	if _, err := newCoverTraffic([]string{"# no domains"}, 1); err == nil {
+		t.Fatal("expected cover traffic without domains to be rejected")
+	}
+}
+
+func TestSharding(t *testing.T) {
+	for name, want := range map[string]string{
+		"www.example.com.":          "example.com",
+		"a.b.example.co.uk.":        "example.co.uk",
+		"example.com.au":            "example.com.au",
+		"www.bbc.co.uk.":            "bbc.co.uk",
+		"localhost.":                "localhost",
+		"Mail.Example.ORG.":         "example.org",
+		"co.uk.":                    "co.uk",
+		"alice.github.io.":          "alice.github.io",
+		"bob.github.io.":            "bob.github.io",
+		"www.school.pvt.k12.ma.us.": "school.pvt.k12.ma.us",
+		"www.example.test.":         "example.test",
+	} {
+		if got := registrableDomain(name); got != want {
+			t.Fatalf("registrableDomain(%q) = %q, expected %q", name, got, want)
+		}
+	}
+
+	key := []byte("a shard key that stays the same")
+	targets := []string{"one.test", "two.test", "three.test", "four.test"}
+	ring, err := newShardRing(key, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reordered, _ := newShardRing(key, []string{"four.test", "two.test", "one.test", "three.test"})
+	shrunk, _ := newShardRing(key, targets[:3])
+	rekeyed, _ := newShardRing([]byte("another key"), targets)
+	shares := make(map[string]int)
+	moved, rekeyedMoved := 0, 0
+	const domains = 2000
+	for i := 0; i < domains; i++ {
+		domain := fmt.Sprintf("www.site%d.test.", i)
+		target := ring.targetFor(domain)
+		shares[target]++
+		if ring.targetFor(fmt.Sprintf("mail.site%d.test.", i)) != target {
+			t.Fatalf("names of site%d.test are on different shards", i)
+		}
+		if reordered.targetFor(domain) != target {
+			t.Fatalf("%v moved when the targets were reordered", domain)
+		}
+		if shrunk.targetFor(domain) != target {
+			if target != "four.test" {
+				t.Fatalf("%v moved from %v, which stayed", domain, target)
+			}
+			moved++
+		}
+		if rekeyed.targetFor(domain) != target {
+			rekeyedMoved++
+		}
+	}
+	for _, target := range targets {
+		if shares[target] < domains/8 {
+			t.Fatalf("uneven shards: %v", shares)
+		}
+	}
+	if moved != shares["four.test"] || rekeyedMoved < domains/2 {
+		t.Fatalf("%d domains moved with four.test, %d with another key", moved, rekeyedMoved)
+	}
+
+	h := newTestHarness(t)
+	first := h.addTarget(ODOH_VERSION_RFC9230)
+	second := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+	keyFile := filepath.Join(t.TempDir(), "shard.key")
+	shardTargets := first.host() + "," + second.host()
+	for i := 0; i < 2; i++ {
+		output, err := h.run("odoh", "--domain", "example.test.", "--dnstype", "A", "--shard-targets", shardTargets, "--shard-key", keyFile, "--proxy", proxy.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--trace")
+		if err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		if !strings.Contains(output, "192.0.2.1") || !strings.Contains(output, ";; shard:              example.test on ") {
+			t.Fatalf("unexpected output:\n%s", output)
+		}
+	}
+	key, err = loadShardKey(keyFile)
+	if err != nil || len(key) != SHARD_KEY_SIZE {
+		t.Fatalf("shard key %x: %v", key, err)
+	}
+	ring, _ = newShardRing(key, []string{first.host(), second.host()})
+	assigned, other := first, second
+	if ring.targetFor("example.test.") == second.host() {
+		assigned, other = second, first
+	}
+	if len(assigned.receivedKeyIDs()) != 2 || len(other.receivedKeyIDs()) != 0 {
+		t.Fatalf("assigned target received %d queries, the other %d", len(assigned.receivedKeyIDs()), len(other.receivedKeyIDs()))
+	}
+}
+
+func TestCrossCheckResolution(t *testing.T) {
+	h := newTestHarness(t)
+	honest := h.addTarget(ODOH_VERSION_RFC9230)
+	slow := h.addTarget(ODOH_VERSION_RFC9230)
+	liar := h.addTargetWithZone([]mintedKey{h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230)}, []string{"example.test. 300 IN A 192.0.2.66"})
+	first, second := h.addProxy(), h.addProxy()
+	slow.faults.set(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				time.Sleep(300 * time.Millisecond)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	run := func(resolution string, targets []*harnessTarget, extra ...string) (string, error) {
+		hosts := make([]string, 0, len(targets))
+		for _, target := range targets {
+			hosts = append(hosts, target.host())
+		}
+		args := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--resolution", resolution, "--targets", strings.Join(hosts, ","), "--proxies", first.host() + "," + second.host(), "--config-source", CONFIG_SOURCE_WELLKNOWN, "--trace"}
+		return h.run(append(args, extra...)...)
+	}
+
+	output, err := run(RESOLUTION_RACE, []*harnessTarget{slow, honest})
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "192.0.2.1") || !regexp.MustCompile(regexp.QuoteMeta(honest.host()+" via "+second.host()+":")+`\s+\S+ chosen`).MatchString(output) {
+		t.Fatalf("race not won by the fast target:\n%s", output)
+	}
+
+	disagreements := filepath.Join(t.TempDir(), "disagreements.json")
+	output, err = run(RESOLUTION_MAJORITY, []*harnessTarget{honest, liar, slow}, "--disagreement-log", disagreements)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "192.0.2.1") || strings.Contains(output, "192.0.2.66\n") || !strings.Contains(output, "disagrees") {
+		t.Fatalf("unexpected majority output:\n%s", output)
+	}
+	data, err := ioutil.ReadFile(disagreements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record disagreement
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	if len(record.Answers) != 3 || !strings.Contains(record.Majority, "192.0.2.1") || record.Domain != "example.test." {
+		t.Fatalf("unexpected disagreement %+v", record)
+	}
+
+	if output, err := run(RESOLUTION_MAJORITY, []*harnessTarget{honest, liar, slow}, "--unanimous"); err == nil {
+		t.Fatalf("expected --unanimous to reject a disagreement:\n%s", output)
+	}
+	if output, err := run(RESOLUTION_MAJORITY, []*harnessTarget{honest, liar}); err == nil || !strings.Contains(err.Error(), "majority") {
+		t.Fatalf("expected a split vote to be rejected: %v\n%s", err, output)
+	}
+	if output, err := run(RESOLUTION_MAJORITY, []*harnessTarget{honest, slow}, "--unanimous"); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+
+	// Each path goes through the key consistency check, and targets handing out a key per client
+	// are refused.
+	fingerprinters := []*harnessTarget{h.addTarget(ODOH_VERSION_RFC9230), h.addTarget(ODOH_VERSION_RFC9230)}
+	for _, fingerprinter := range fingerprinters {
+		fingerprinter.faults.set(serveConfigs(func() []mintedKey {
+			return []mintedKey{h.mintKey(testSuiteX25519, ODOH_VERSION_RFC9230)}
+		}))
+	}
+	consistency := []string{"--key-consistency", KEY_CONSISTENCY_REFUSE, "--consistency-direct", CONFIG_SOURCE_WELLKNOWN, "--key-history", ""}
+	output, err = run(RESOLUTION_MAJORITY, []*harnessTarget{honest, fingerprinters[0], fingerprinters[1]}, consistency...)
+	if err == nil || !strings.Contains(err.Error(), "majority") || !strings.Contains(err.Error(), "refusing to use "+fingerprinters[0].host()) {
+		t.Fatalf("expected the fingerprinting targets to be refused: %v\n%s", err, output)
+	}
+	if output, err := run(RESOLUTION_MAJORITY, []*harnessTarget{honest, slow}, consistency...); err != nil {
+		t.Fatalf("consistent targets should pass the check: %v\n%s", err, output)
+	}
+
+	// The timing policy and cover traffic apply to every path.
+	var lock sync.Mutex
+	queries := 0
+	honest.faults.set(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				lock.Lock()
+				queries++
+				lock.Unlock()
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	decoys := filepath.Join(t.TempDir(), "decoys.txt")
+	if err := ioutil.WriteFile(decoys, []byte("decoy.test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := run(RESOLUTION_MAJORITY, []*harnessTarget{honest}, "--timing", TIMING_JITTER, "--jitter", "10ms", "--cover-ratio", "2", "--cover-domains", decoys); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	// The answer does not wait for the decoys.
+	sent := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return queries
+	}
+	for deadline := time.Now().Add(time.Second); sent() < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent() != 3 {
+		t.Fatalf("expected the query and 2 decoys, got %d queries", sent())
+	}
+	honest.faults.set(nil)
+
+	for _, flag := range [][]string{{"--proxy", first.host()}, {"--shard-targets", honest.host()}, {"--relay", "https://relay.test/"}} {
+		if output, err := run(RESOLUTION_RACE, []*harnessTarget{honest}, flag...); err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+			t.Fatalf("expected %s to be rejected: %v\n%s", flag[0], err, output)
+		}
+	}
+}
+
+func TestStrictResponseValidation(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.test.", dns.TypeA)
+	reply := func(records ...string) *dns.Msg {
+		response := new(dns.Msg)
+		response.SetReply(query)
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Answer = append(response.Answer, rr)
+		}
+		return response
+	}
+
+	for _, test := range []struct {
+		name     string
+		response func() *dns.Msg
+		reason   string
+	}{
+		{"answer", func() *dns.Msg { return reply("www.example.test. 300 IN A 192.0.2.1") }, ""},
+		{"mixed case", func() *dns.Msg { return reply("WWW.Example.TEST. 300 IN A 192.0.2.1") }, ""},
+		{"cname chain", func() *dns.Msg {
+			return reply("www.example.test. 300 IN CNAME cdn.example.net.", "cdn.example.net. 300 IN CNAME edge.example.org.", "edge.example.org. 300 IN A 192.0.2.1")
+		}, ""},
+		{"dname", func() *dns.Msg {
+			return reply("example.test. 300 IN DNAME example.net.", "www.example.test. 300 IN CNAME www.example.net.", "www.example.net. 300 IN A 192.0.2.1")
+		}, ""},
+		{"id", func() *dns.Msg { r := reply(); r.Id++; return r }, "does not match query ID"},
+		{"qr", func() *dns.Msg { r := reply(); r.Response = false; return r }, "QR bit not set"},
+		{"name", func() *dns.Msg { r := reply(); r.Question[0].Name = "mail.example.test."; return r }, "the query asked for www.example.test."},
+		{"type", func() *dns.Msg { r := reply(); r.Question[0].Qtype = dns.TypeAAAA; return r }, "type AAAA"},
+		{"class", func() *dns.Msg { r := reply(); r.Question[0].Qclass = dns.ClassCHAOS; return r }, "class CH"},
+		{"questions", func() *dns.Msg { r := reply(); r.Question = nil; return r }, "0 questions"},
+		{"out of bailiwick", func() *dns.Msg {
+			return reply("www.example.test. 300 IN A 192.0.2.1", "bank.example. 300 IN A 192.0.2.66")
+		}, "answer record for bank.example. is out of bailiwick"},
+	} {
+		_, err := validateDnsResponse(query, test.response())
+		if len(test.reason) == 0 && err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(test.reason) > 0 && (err == nil || !strings.Contains(err.Error(), test.reason)) {
+			t.Fatalf("%s: expected %q, got %v", test.name, test.reason, err)
+		}
+	}
+
+	response := reply("www.example.test. 300 IN A 192.0.2.1")
+	for _, record := range []string{"ns.example.test. 300 IN A 192.0.2.53", "bank.example. 300 IN A 192.0.2.66"} {
+		rr, _ := dns.NewRR(record)
+		response.Extra = append(response.Extra, rr)
+	}
+	response.SetEdns0(dns.DefaultMsgSize, false)
+	if scrubbed, err := validateDnsResponse(query, response); err != nil || scrubbed != 1 {
+		t.Fatalf("scrubbed %d records: %v", scrubbed, err)
+	}
+	if len(response.Extra) != 2 || response.Extra[0].Header().Name != "ns.example.test." || response.IsEdns0() == nil {
+		t.Fatalf("unexpected additional section %v", response.Extra)
+	}
+}
+
+func TestHTTPResponseHandling(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	configs, err := fetchTargetConfigsFromWellKnown(target.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.test.", dns.TypeA)
+	packed, _ := query.Pack()
+	resolve := func() error {
+		message, queryContext, _, err := createOdohQuestionWithConfigs(packed, configs.Configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := resolveObliviousQuery(message, false, target.host(), "", h.client)
+		if err == nil {
+			_, err = validateEncryptedResponse(response, queryContext)
+		}
+		return err
+	}
+	serve := func(status int, contentType string, body []byte) func(next http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.WriteHeader(status)
+				w.Write(body)
+			})
+		}
+	}
+
+	target.faults.set(withContentType(OBLIVIOUS_DOH + "; charset=utf-8"))
+	if err := resolve(); err != nil {
+		t.Fatalf("media type parameters rejected: %v", err)
+	}
+
+	explanation := append([]byte("upstream resolver exploded\n"), bytes.Repeat([]byte("x"), 8<<10)...)
+	target.faults.set(serve(http.StatusBadGateway, "text/plain", explanation))
+	if err := resolve(); err == nil || !strings.Contains(err.Error(), "status 502 Bad Gateway: upstream resolver exploded") || len(err.Error()) > HTTP_ERROR_BODY_SIZE+200 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	target.faults.set(serve(http.StatusOK, OBLIVIOUS_DOH, make([]byte, MAX_OBLIVIOUS_MESSAGE_SIZE+1)))
+	if err := resolve(); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("expected an oversized response to be rejected, got %v", err)
+	}
+
+	target.faults.set(serve(http.StatusOK, "text/html", []byte("<html>captive portal</html>")))
+	if err := resolve(); err == nil || !strings.Contains(err.Error(), `unexpected Content-Type "text/html"`) {
+		t.Fatalf("expected the wrong media type to be rejected, got %v", err)
+	}
+
+	target.faults.set(serve(http.StatusNotFound, "text/plain", []byte("no configs here")))
+	if _, err := fetchRawTargetConfigs(target.host(), CONFIG_SOURCE_WELLKNOWN); err == nil || !strings.Contains(err.Error(), "404 Not Found: no configs here") {
+		t.Fatalf("unexpected configs fetch error %v", err)
+	}
+}
+
+func TestOutboundProxies(t *testing.T) {
+	h := newTestHarness(t)
+	target := h.addTarget(ODOH_VERSION_RFC9230)
+	proxy := h.addProxy()
+	// The proxy is named, so that the SOCKS5 server shows whether names are resolved remotely.
+	proxyName := strings.Replace(proxy.host(), "127.0.0.1", "localhost", 1)
+	socks := startSOCKS5Server(t, true, "alice", "secret")
+	connect := startHTTPConnectServer(t)
+	args := []string{"odoh", "--domain", "example.test.", "--dnstype", "A", "--target", target.host(), "--proxy", proxyName, "--config-source", CONFIG_SOURCE_WELLKNOWN}
+
+	output, err := h.run(append(args, "--outbound-proxy", "socks5h://alice:secret@"+socks.address())...)
+	if err != nil || !strings.Contains(output, "192.0.2.1") {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	relayed := strings.Join(socks.relayed(), "\n")
+	if !strings.Contains(relayed, "ip "+target.host()) || !strings.Contains(relayed, "name "+proxyName) {
+		t.Fatalf("SOCKS5 server relayed:\n%s", relayed)
+	}
+
+	before := len(socks.relayed())
+	output, err = h.run(append(args, "--outbound-proxy", "http://"+connect.address(), "--outbound-proxy", "socks5://alice:secret@"+socks.address())...)
+	if err != nil || !strings.Contains(output, "192.0.2.1") {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if relayed := connect.relayed(); len(relayed) == 0 || relayed[0] != socks.address() {
+		t.Fatalf("CONNECT proxy relayed %v, expected the SOCKS5 server", relayed)
+	}
+	for _, destination := range socks.relayed()[before:] {
+		if strings.HasPrefix(destination, "name ") {
+			t.Fatalf("socks5 sent the name %v instead of resolving it locally", destination)
+		}
+	}
+
+	output, err = h.run(append(args, "--outbound-proxy", "socks5h://alice:wrong@"+socks.address())...)
+	if err == nil || !strings.Contains(output+err.Error(), "SOCKS5 authentication failed") {
+		t.Fatalf("expected the SOCKS5 authentication to fail: %v\n%s", err, output)
+	}
+	if output, err := h.run(append(args, "--outbound-proxy", "ftp://"+socks.address())...); err == nil {
+		t.Fatalf("expected an unsupported outbound proxy to be rejected:\n%s", output)
+	}
+
+	// Each run draws its own SOCKS credentials, which Tor maps to its own circuits.
+	tor := startSOCKS5Server(t, true, "", "")
+	for i := 0; i < 2; i++ {
+		output, err = h.run("odohconfig-fetch", "--target", target.host(), "--source", CONFIG_SOURCE_WELLKNOWN, "--tor", "--tor-socks", tor.address())
+		if err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+	}
+	tor.Lock()
+	credentials := append([]string{}, tor.credentials...)
+	tor.Unlock()
+	if len(credentials) != 2 || credentials[0] == credentials[1] || !strings.HasPrefix(credentials[0], "odoh-client:") {
+		t.Fatalf("Tor streams were not isolated: %v", credentials)
+	}
+}
@@ -1,36 +1,87 @@
 package commands
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"strings"
 	"fmt"
 	odoh "github.com/cloudflare/odoh-go"
 	"github.com/miekg/dns"
 	"github.com/urfave/cli"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 )
 
-func fetchTargetConfigsFromWellKnown(targetName string) (odoh.ObliviousDoHConfigs, error) {
+// fetchedTargetConfigs is a serialized ObliviousDoHConfigs list along with where it was obtained.
+type fetchedTargetConfigs struct {
+	Source string
+	// TTL is the DNS record TTL, or the Cache-Control max-age of the well-known response.
+	TTL uint32
+	Raw []byte
+}
+
+func (f fetchedTargetConfigs) parse() (odoh.ObliviousDoHConfigs, error) {
+	return parseObliviousDoHConfigs(f.Raw)
+}
+
+// cacheControlMaxAge returns the max-age directive of a Cache-Control header, if present.
+func cacheControlMaxAge(header string) (uint32, bool) {
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			maxAge, err := strconv.ParseUint(strings.Trim(directive[len("max-age="):], "\""), 10, 32)
+			if err == nil {
+				return uint32(maxAge), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func fetchRawTargetConfigsFromWellKnown(targetName string) (fetchedTargetConfigs, error) {
 	req, err := http.NewRequest(http.MethodGet, TARGET_HTTP_MODE+"://"+targetName+ODOH_CONFIG_WELLKNOWN_URL, nil)
 	if err != nil {
-		return odoh.ObliviousDoHConfigs{}, err
+		return fetchedTargetConfigs{}, err
 	}
+	return fetchRawConfigsResponse(req, newHTTPClient(), CONFIG_SOURCE_WELLKNOWN)
+}
 
-	client := http.Client{}
+// fetchRawTargetConfigsThroughProxy reads the well-known configs of the target through the proxy,
+// so that the target cannot tell which client asked for them.
+func fetchRawTargetConfigsThroughProxy(targetName string, proxy string, client *http.Client) (fetchedTargetConfigs, error) {
+	req, err := http.NewRequest(http.MethodGet, proxyBaseURL(proxy)+"/proxy", nil)
+	if err != nil {
+		return fetchedTargetConfigs{}, err
+	}
+	queries := req.URL.Query()
+	queries.Add("targethost", targetName)
+	queries.Add("targetpath", ODOH_CONFIG_WELLKNOWN_URL)
+	req.URL.RawQuery = queries.Encode()
+	return fetchRawConfigsResponse(req, client, CONFIG_SOURCE_WELLKNOWN+" via "+proxy)
+}
+
+func fetchRawConfigsResponse(req *http.Request, client *http.Client, source string) (fetchedTargetConfigs, error) {
 	resp, err := client.Do(req)
 	if err != nil {
-		return odoh.ObliviousDoHConfigs{}, err
+		return fetchedTargetConfigs{}, err
 	}
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	defer closeBody(resp.Body)
+	bodyBytes, err := readResponse(resp, "", MAX_OBLIVIOUS_MESSAGE_SIZE)
 	if err != nil {
-		return odoh.ObliviousDoHConfigs{}, err
+		return fetchedTargetConfigs{}, fmt.Errorf("configs fetch failed: %v", err)
 	}
 
-	return odoh.UnmarshalObliviousDoHConfigs(bodyBytes)
+	ttl, _ := cacheControlMaxAge(resp.Header.Get("Cache-Control"))
+	return fetchedTargetConfigs{
+		Source: source,
+		TTL:    ttl,
+		Raw:    bodyBytes,
+	}, nil
 }
 
-func fetchTargetConfigsFromDNS(targetName string) (odoh.ObliviousDoHConfigs, error) {
+func fetchRawTargetConfigsFromDNS(targetName string) (fetchedTargetConfigs, error) {
 	if !strings.HasSuffix(targetName, ".") {
 		targetName = targetName + "."
 	}
@@ -40,65 +91,164 @@ func fetchTargetConfigsFromDNS(targetName string) (odoh.ObliviousDoHConfigs, err
 	dnsQuery.RecursionDesired = true
 	packedDnsQuery, err := dnsQuery.Pack()
 	if err != nil {
-		return odoh.ObliviousDoHConfigs{}, err
+		return fetchedTargetConfigs{}, err
 	}
 
 	response, err := createPlainQueryResponse(DEFAULT_DOH_SERVER, packedDnsQuery)
 	if err != nil {
-		return odoh.ObliviousDoHConfigs{}, err
+		return fetchedTargetConfigs{}, err
 	}
 
 	if response.Rcode != dns.RcodeSuccess {
-		return odoh.ObliviousDoHConfigs{}, errors.New(fmt.Sprintf("DNS response failure: %v", response.Rcode))
+		return fetchedTargetConfigs{}, errors.New(fmt.Sprintf("DNS response failure: %v", response.Rcode))
 	}
 
 	for _, answer := range response.Answer {
 		httpsResponse, ok := answer.(*dns.HTTPS)
 		if ok {
 			for _, value := range httpsResponse.Value {
-				if value.Key() == 32769 {
+				if value.Key() == ODOH_CONFIG_SVCB_KEY {
 					parameter, ok := value.(*dns.SVCBLocal)
 					if ok {
-						odohConfigs, err := odoh.UnmarshalObliviousDoHConfigs(parameter.Data)
-						if err == nil {
-							return odohConfigs, nil
-						}
+						return fetchedTargetConfigs{
+							Source: CONFIG_SOURCE_DNS,
+							TTL:    httpsResponse.Hdr.Ttl,
+							Raw:    parameter.Data,
+						}, nil
 					}
 				}
 			}
 		}
 	}
 
-	return odoh.ObliviousDoHConfigs{}, nil
+	return fetchedTargetConfigs{}, errors.New(fmt.Sprintf("no odohconfig found in the HTTPS records of %v", targetName))
 }
 
-func fetchTargetConfigs(targetName string) (odoh.ObliviousDoHConfigs, error) {
-	odohConfigs, err := fetchTargetConfigsFromDNS(targetName)
-	if err == nil {
-		return odohConfigs, err
+// fetchRawTargetConfigs reads the configs from the given source: "dns", "well-known", or "auto"
+// which tries DNS first and falls back to the well-known endpoint.
+func fetchRawTargetConfigs(targetName string, source string) (fetchedTargetConfigs, error) {
+	switch source {
+	case CONFIG_SOURCE_DNS:
+		return fetchRawTargetConfigsFromDNS(targetName)
+	case CONFIG_SOURCE_WELLKNOWN:
+		return fetchRawTargetConfigsFromWellKnown(targetName)
+	case "", CONFIG_SOURCE_AUTO:
+		fetched, err := fetchRawTargetConfigsFromDNS(targetName)
+		if err == nil {
+			if _, err = fetched.parse(); err == nil {
+				return fetched, nil
+			}
+		}
+		// Fall back to the well-known endpoint if we can't read from DNS
+		return fetchRawTargetConfigsFromWellKnown(targetName)
+	default:
+		return fetchedTargetConfigs{}, errors.New(fmt.Sprintf("unknown config source %q, expected auto, dns or well-known", source))
 	}
+}
 
-	// Fall back to the well-known endpoint if we can't read from DNS
-	return fetchTargetConfigsFromWellKnown(targetName)
+func fetchTargetConfigsFromWellKnown(targetName string) (odoh.ObliviousDoHConfigs, error) {
+	fetched, err := fetchRawTargetConfigsFromWellKnown(targetName)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+	return fetched.parse()
+}
+
+func fetchTargetConfigsFromDNS(targetName string) (odoh.ObliviousDoHConfigs, error) {
+	fetched, err := fetchRawTargetConfigsFromDNS(targetName)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+	return fetched.parse()
+}
+
+// targetConfigsReport is the JSON form of the `odohconfig-fetch` output.
+type targetConfigsReport struct {
+	Target  string              `json:"target"`
+	Source  string              `json:"source"`
+	TTL     uint32              `json:"ttl"`
+	Configs []configDescription `json:"configs"`
+}
+
+func httpsPresentation(targetName string, fetched fetchedTargetConfigs) string {
+	record := &dns.HTTPS{
+		SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   dns.Fqdn(targetName),
+				Rrtype: dns.TypeHTTPS,
+				Class:  dns.ClassINET,
+				Ttl:    fetched.TTL,
+			},
+			Priority: 1,
+			Target:   ".",
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBLocal{KeyCode: ODOH_CONFIG_SVCB_KEY, Data: fetched.Raw},
+			},
+		},
+	}
+	return record.String()
 }
 
 func getTargetConfigs(c *cli.Context) error {
+	restore, err := useOutboundProxies(c)
+	defer restore()
+	if err != nil {
+		return err
+	}
 	targetName := c.String("target")
-	pretty := c.Bool("pretty")
+	output := c.String("output")
+	if c.Bool("pretty") {
+		output = "pretty"
+	}
+
+	if c.Bool("lint") {
+		return lintTargetConfigs(targetName, c.String("source"), output == "json")
+	}
 
-	odohConfigs, err := fetchTargetConfigs(targetName)
+	fetched, err := fetchRawTargetConfigs(targetName, c.String("source"))
+	if err != nil {
+		return err
+	}
+	rawConfigs, err := splitObliviousDoHConfigs(fetched.Raw)
 	if err != nil {
 		return err
 	}
 
-	if pretty {
-		fmt.Println("ObliviousDoHConfigs:")
-		for i, config := range odohConfigs.Configs {
-			configContents := config.Contents
-			fmt.Printf("  Config %d: Version(0x%04x), KEM(0x%04x), KDF(0x%04x), AEAD(0x%04x) KeyID(%x)\n", (i + 1), config.Version, configContents.KemID, configContents.KdfID, configContents.AeadID, configContents.KeyID())
+	switch output {
+	case "pretty":
+		fmt.Printf("ObliviousDoHConfigs (source: %s, TTL: %ds):\n", fetched.Source, fetched.TTL)
+		for i, rawConfig := range rawConfigs {
+			description := describeConfig(rawConfig)
+			fmt.Printf("  Config %d: Version(0x%04x), KEM(0x%04x), KDF(0x%04x), AEAD(0x%04x) KeyID(%s)", (i + 1), description.Version, description.KemID, description.KdfID, description.AeadID, description.KeyID)
+			if !description.Supported {
+				fmt.Printf(" [unsupported: %s]", description.Problem)
+			}
+			fmt.Println()
+		}
+	case "json":
+		report := targetConfigsReport{
+			Target:  targetName,
+			Source:  fetched.Source,
+			TTL:     fetched.TTL,
+			Configs: make([]configDescription, 0, len(rawConfigs)),
+		}
+		for _, rawConfig := range rawConfigs {
+			report.Configs = append(report.Configs, describeConfig(rawConfig))
 		}
-	} else {
-		fmt.Printf("%x", odohConfigs.Marshal())
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "base64":
+		fmt.Fprintf(os.Stderr, "source: %s, TTL: %ds\n", fetched.Source, fetched.TTL)
+		fmt.Println(base64.StdEncoding.EncodeToString(fetched.Raw))
+	case "svcb":
+		fmt.Printf("; source: %s\n", fetched.Source)
+		fmt.Println(httpsPresentation(targetName, fetched))
+	case "", "hex":
+		fmt.Fprintf(os.Stderr, "source: %s, TTL: %ds\n", fetched.Source, fetched.TTL)
+		fmt.Printf("%x", fetched.Raw)
+	default:
+		return errors.New(fmt.Sprintf("unknown output format %q, expected hex, pretty, json, base64 or svcb", output))
 	}
 	return nil
 }
@@ -0,0 +1,524 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The harness stands up a discovery service, ODoH targets and oblivious proxies on loopback with
+// httptest, and points the HTTP clients of the commands at them. Every server can be made to
+// misbehave through its faultInjector.
+
+var testZone = []string{
+	"example.test. 300 IN A 192.0.2.1",
+	"example.test. 300 IN AAAA 2001:db8::1",
+}
+
+// faultInjector wraps a server's handler with a middleware that can be swapped while the server runs.
+type faultInjector struct {
+	sync.Mutex
+	fault func(next http.Handler) http.Handler
+}
+
+func (f *faultInjector) set(fault func(next http.Handler) http.Handler) {
+	f.Lock()
+	defer f.Unlock()
+	f.fault = fault
+}
+
+func (f *faultInjector) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		fault := f.fault
+		f.Unlock()
+		if fault != nil {
+			fault(next).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// failWithStatus answers every request with the status code, without calling the server.
+func failWithStatus(status int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(status), status)
+		})
+	}
+}
+
+// rewriteResponse lets the server answer, then alters the Content-Type and body of the answer.
+func rewriteResponse(rewrite func(header http.Header, body []byte) []byte) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := httptest.NewRecorder()
+			next.ServeHTTP(recorder, r)
+			body := rewrite(recorder.Header(), recorder.Body.Bytes())
+			for name, values := range recorder.Header() {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(recorder.Code)
+			w.Write(body)
+		})
+	}
+}
+
+func withContentType(contentType string) func(next http.Handler) http.Handler {
+	return rewriteResponse(func(header http.Header, body []byte) []byte {
+		header.Set("Content-Type", contentType)
+		return body
+	})
+}
+
+// corruptBody flips the last bit of the answer, which breaks the AEAD tag of an ODoH response.
+func corruptBody() func(next http.Handler) http.Handler {
+	return rewriteResponse(func(header http.Header, body []byte) []byte {
+		if len(body) > 0 {
+			body[len(body)-1] ^= 0x01
+		}
+		return body
+	})
+}
+
+// dropConnection closes the connection without answering.
+func dropConnection() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+// rewriteRequest alters the body of each request before the server sees it.
+func rewriteRequest(rewrite func(body []byte) []byte) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			body = rewrite(body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headerRecorder keeps the request headers a server received, before any fault applies.
+type headerRecorder struct {
+	sync.Mutex
+	headers []http.Header
+}
+
+func (r *headerRecorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.Lock()
+		r.headers = append(r.headers, req.Header.Clone())
+		r.Unlock()
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *headerRecorder) receivedHeaders() []http.Header {
+	r.Lock()
+	defer r.Unlock()
+	return append([]http.Header{}, r.headers...)
+}
+
+type harnessTarget struct {
+	keys   []mintedKey
+	server *httptest.Server
+	faults *faultInjector
+	headerRecorder
+
+	sync.Mutex
+	received []odoh.ObliviousDNSMessage
+}
+
+func (t *harnessTarget) host() string {
+	return strings.TrimPrefix(t.server.URL, "https://")
+}
+
+// receivedKeyIDs lists the key_id of every query that reached the target.
+func (t *harnessTarget) receivedKeyIDs() [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	keyIDs := make([][]byte, 0, len(t.received))
+	for _, message := range t.received {
+		keyIDs = append(keyIDs, message.KeyID)
+	}
+	return keyIDs
+}
+
+type harnessProxy struct {
+	server *httptest.Server
+	faults *faultInjector
+	headerRecorder
+}
+
+func (p *harnessProxy) host() string {
+	return strings.TrimPrefix(p.server.URL, "http://")
+}
+
+type testHarness struct {
+	t         *testing.T
+	roots     *x509.CertPool
+	client    *http.Client
+	targets   []*harnessTarget
+	proxies   []*harnessProxy
+	discovery *httptest.Server
+	// discoveryFaults applies to the discovery service.
+	discoveryFaults *faultInjector
+}
+
+func newTestHarness(t *testing.T) *testHarness {
+	h := &testHarness{
+		t:               t,
+		roots:           x509.NewCertPool(),
+		discoveryFaults: &faultInjector{},
+	}
+	h.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: h.roots},
+		},
+	}
+
+	previousTransport := httpTransport
+	previousExiter := cli.OsExiter
+	httpTransport = h.client.Transport
+	cli.OsExiter = func(int) {}
+	t.Cleanup(func() {
+		httpTransport = previousTransport
+		cli.OsExiter = previousExiter
+	})
+
+	h.discovery = httptest.NewTLSServer(h.discoveryFaults.wrap(http.HandlerFunc(h.discoveryHandler)))
+	h.roots.AddCert(h.discovery.Certificate())
+	t.Cleanup(h.discovery.Close)
+	return h
+}
+
+func (h *testHarness) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	response := DiscoveryServiceResponse{
+		Proxies: make([]string, 0, len(h.proxies)),
+		Targets: make([]string, 0, len(h.targets)),
+	}
+	for _, proxy := range h.proxies {
+		response.Proxies = append(response.Proxies, proxy.host())
+	}
+	for _, target := range h.targets {
+		response.Targets = append(response.Targets, target.host())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *testHarness) discoveryHost() string {
+	return strings.TrimPrefix(h.discovery.URL, "https://")
+}
+
+// addTarget starts a target publishing one freshly minted config per suite, in the given version.
+func (h *testHarness) addTarget(version uint16, suites ...hpkeSuite) *harnessTarget {
+	if len(suites) == 0 {
+		suites = []hpkeSuite{{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128}}
+	}
+	keys := make([]mintedKey, 0, len(suites))
+	for _, suite := range suites {
+		keys = append(keys, h.mintKey(suite, version))
+	}
+	return h.addTargetWithKeys(keys)
+}
+
+func (h *testHarness) mintKey(suite hpkeSuite, version uint16) mintedKey {
+	key, err := mintKey(suite, version, nil)
+	if err != nil {
+		h.t.Fatalf("unable to mint a key for %v: %v", suite, err)
+	}
+	return key
+}
+
+func (h *testHarness) addTargetWithKeys(keys []mintedKey) *harnessTarget {
+	return h.addTargetWithZone(keys, testZone)
+}
+
+// addTargetWithZone starts a target answering from the zone instead of testZone.
+func (h *testHarness) addTargetWithZone(keys []mintedKey, zone []string) *harnessTarget {
+	configs := make([]odoh.ObliviousDoHConfig, 0, len(keys))
+	for _, key := range keys {
+		configs = append(configs, key.Config)
+	}
+	resolver := zoneResolver{records: make(map[string][]dns.RR)}
+	for _, record := range zone {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		resolver.records[rr.Header().Name] = append(resolver.records[rr.Header().Name], rr)
+	}
+	ohttpKey, err := newOHTTPGatewayKey(1, testSuiteX25519)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	target := &odohTarget{
+		keys:      keys,
+		configs:   odoh.CreateObliviousDoHConfigs(configs).Marshal(),
+		configTTL: 300,
+		resolver:  resolver,
+		ohttpKeys: []ohttpGatewayKey{ohttpKey},
+	}
+
+	harnessTarget := &harnessTarget{keys: keys, faults: &faultInjector{}}
+	observer := rewriteRequest(func(body []byte) []byte {
+		if message, err := unmarshalObliviousMessage(body); err == nil {
+			harnessTarget.Lock()
+			harnessTarget.received = append(harnessTarget.received, message)
+			harnessTarget.Unlock()
+		}
+		return body
+	})
+	harnessTarget.server = httptest.NewTLSServer(harnessTarget.headerRecorder.wrap(harnessTarget.faults.wrap(observer(target.handler()))))
+	h.roots.AddCert(harnessTarget.server.Certificate())
+	h.t.Cleanup(harnessTarget.server.Close)
+	h.targets = append(h.targets, harnessTarget)
+	return harnessTarget
+}
+
+// addProxy starts a plain HTTP proxy, as prepareHttpRequest expects.
+func (h *testHarness) addProxy() *harnessProxy {
+	proxy := &odohProxy{client: h.client}
+	harnessProxy := &harnessProxy{faults: &faultInjector{}}
+	harnessProxy.server = httptest.NewServer(harnessProxy.headerRecorder.wrap(harnessProxy.faults.wrap(proxy.handler())))
+	h.t.Cleanup(harnessProxy.server.Close)
+	h.proxies = append(h.proxies, harnessProxy)
+	return harnessProxy
+}
+
+// addTLSProxy starts an HTTPS proxy which requires a client certificate. It is addressed by its URL,
+// server.URL, and is not listed by the discovery service.
+func (h *testHarness) addTLSProxy() *harnessProxy {
+	return h.startTLSProxy(tls.RequireAnyClientCert)
+}
+
+// addHTTPSProxy starts an HTTPS proxy without client certificates, addressed by its URL.
+func (h *testHarness) addHTTPSProxy() *harnessProxy {
+	return h.startTLSProxy(tls.NoClientCert)
+}
+
+func (h *testHarness) startTLSProxy(clientAuth tls.ClientAuthType) *harnessProxy {
+	proxy := &odohProxy{client: h.client}
+	harnessProxy := &harnessProxy{faults: &faultInjector{}}
+	harnessProxy.server = httptest.NewUnstartedServer(harnessProxy.headerRecorder.wrap(harnessProxy.faults.wrap(proxy.handler())))
+	harnessProxy.server.TLS = &tls.Config{ClientAuth: clientAuth}
+	harnessProxy.server.StartTLS()
+	h.roots.AddCert(harnessProxy.server.Certificate())
+	h.t.Cleanup(harnessProxy.server.Close)
+	return harnessProxy
+}
+
+// run executes a command line against the harness and returns what it printed to stdout.
+func (h *testHarness) run(args ...string) (string, error) {
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	app := cli.NewApp()
+	app.Commands = Commands
+	err = app.Run(append([]string{"odoh-client"}, args...))
+
+	os.Stdout = stdout
+	writer.Close()
+	return <-output, err
+}
+
+// runAction parses the command line with the flags of the command it names, args[0], and runs
+// action instead of the command, for commands whose action does more than the test wants.
+func (h *testHarness) runAction(action func(c *cli.Context) error, args ...string) error {
+	for _, command := range Commands {
+		if command.Name == args[0] {
+			command.Action = action
+			app := cli.NewApp()
+			app.Commands = []cli.Command{command}
+			return app.Run(append([]string{"odoh-client"}, args...))
+		}
+	}
+	h.t.Fatalf("unknown command %q", args[0])
+	return nil
+}
+
+// outboundServer is a SOCKS5 or HTTP CONNECT proxy on loopback that records the destination of
+// every connection it relays.
+type outboundServer struct {
+	listener net.Listener
+	// auth asks SOCKS5 clients for a username and password, which must match username and password
+	// unless username is empty.
+	auth     bool
+	username string
+	password string
+
+	sync.Mutex
+	destinations []string
+	credentials  []string
+}
+
+func (s *outboundServer) address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *outboundServer) relayed() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.destinations...)
+}
+
+func (s *outboundServer) record(destination string) {
+	s.Lock()
+	defer s.Unlock()
+	s.destinations = append(s.destinations, destination)
+}
+
+func startSOCKS5Server(t *testing.T, auth bool, username string, password string) *outboundServer {
+	return startOutboundServer(t, &outboundServer{auth: auth, username: username, password: password}, serveSOCKS5)
+}
+
+func startHTTPConnectServer(t *testing.T) *outboundServer {
+	return startOutboundServer(t, &outboundServer{}, serveHTTPConnect)
+}
+
+func startOutboundServer(t *testing.T, s *outboundServer, serve func(s *outboundServer, conn net.Conn)) *outboundServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = listener
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(s, conn)
+		}
+	}()
+	return s
+}
+
+// relayConn copies between the client, whose first bytes may be buffered in reader, and upstream.
+func relayConn(conn net.Conn, reader io.Reader, upstream net.Conn) {
+	go func() {
+		io.Copy(upstream, reader)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+// serveSOCKS5 records destinations as "name host:port" or "ip address:port", by address type.
+func serveSOCKS5(s *outboundServer, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		conn.Close()
+		return
+	}
+	io.ReadFull(reader, make([]byte, greeting[1]))
+	if s.auth {
+		conn.Write([]byte{0x05, 0x02})
+		version := make([]byte, 2)
+		io.ReadFull(reader, version)
+		username := make([]byte, version[1])
+		io.ReadFull(reader, username)
+		length := make([]byte, 1)
+		io.ReadFull(reader, length)
+		password := make([]byte, length[0])
+		io.ReadFull(reader, password)
+		if len(s.username) > 0 && (string(username) != s.username || string(password) != s.password) {
+			conn.Write([]byte{0x01, 0x01})
+			conn.Close()
+			return
+		}
+		s.Lock()
+		s.credentials = append(s.credentials, string(username)+":"+string(password))
+		s.Unlock()
+		conn.Write([]byte{0x01, 0x00})
+	} else {
+		conn.Write([]byte{0x05, 0x00})
+	}
+
+	request := make([]byte, 4)
+	io.ReadFull(reader, request)
+	var kind, host string
+	switch request[3] {
+	case 0x01, 0x04:
+		address := make([]byte, net.IPv4len)
+		if request[3] == 0x04 {
+			address = make([]byte, net.IPv6len)
+		}
+		io.ReadFull(reader, address)
+		kind, host = "ip", net.IP(address).String()
+	case 0x03:
+		length := make([]byte, 1)
+		io.ReadFull(reader, length)
+		name := make([]byte, length[0])
+		io.ReadFull(reader, name)
+		kind, host = "name", string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(reader, port)
+	destination := net.JoinHostPort(host, fmt.Sprint(int(port[0])<<8|int(port[1])))
+	s.record(kind + " " + destination)
+
+	upstream, err := net.Dial("tcp", destination)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	relayConn(conn, reader, upstream)
+}
+
+func serveHTTPConnect(s *outboundServer, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil || request.Method != http.MethodConnect {
+		conn.Close()
+		return
+	}
+	s.record(request.Host)
+	upstream, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	relayConn(conn, reader, upstream)
+}
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The header policy decides which request headers leave the client, since anything beyond the
+// message itself, such as a User-Agent naming the Go version, Accept-Language or cookies, can link
+// queries that the proxy should not be able to tell apart.
+
+// allowedRequestHeaders are the only headers the commands set that the policies let through.
+var allowedRequestHeaders = []string{"Accept", "Content-Type"}
+
+// headerPolicy rewrites the headers of every request before they are sent.
+type headerPolicy struct {
+	policy    string
+	transport http.RoundTripper
+}
+
+func parseHeaderPolicy(policy string) (string, error) {
+	switch policy {
+	case "", HEADER_POLICY_MINIMAL:
+		return HEADER_POLICY_MINIMAL, nil
+	case HEADER_POLICY_UNIFORM, HEADER_POLICY_NONE:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown header policy %q, expected %s, %s or %s", policy, HEADER_POLICY_MINIMAL, HEADER_POLICY_UNIFORM, HEADER_POLICY_NONE)
+	}
+}
+
+// requestHeaders returns the headers sent under the policy:
+//   - none leaves the headers as set, with the User-Agent of net/http.
+//   - minimal keeps only allowedRequestHeaders and sends no User-Agent. net/http still adds
+//     Accept-Encoding: gzip to requests without an Accept-Encoding.
+//   - uniform keeps only allowedRequestHeaders and adds a fixed User-Agent and Accept-Encoding, so
+//     that all clients send exactly the same headers for the same kind of request.
+func (p *headerPolicy) requestHeaders(header http.Header) http.Header {
+	if p.policy == HEADER_POLICY_NONE {
+		return header
+	}
+	filtered := make(http.Header)
+	for _, name := range allowedRequestHeaders {
+		if value := header.Get(name); len(value) > 0 {
+			filtered.Set(name, value)
+		}
+	}
+	if p.policy == HEADER_POLICY_UNIFORM {
+		filtered.Set("User-Agent", HEADER_POLICY_USER_AGENT)
+		filtered.Set("Accept-Encoding", "identity")
+	} else {
+		// An empty User-Agent stops net/http from sending its own.
+		filtered.Set("User-Agent", "")
+	}
+	return filtered
+}
+
+func (p *headerPolicy) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	req.Header = p.requestHeaders(req.Header)
+	return p.transport.RoundTrip(req)
+}
+
+// withHeaderPolicy returns a client sending the requests of client under the policy. Such a client
+// never keeps cookies, whatever the jar of client.
+func withHeaderPolicy(client *http.Client, policy string) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport:     &headerPolicy{policy: policy, transport: transport},
+		CheckRedirect: client.CheckRedirect,
+		Timeout:       client.Timeout,
+	}
+}
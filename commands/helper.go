@@ -3,8 +3,18 @@ package commands
 import (
 	odoh "github.com/cloudflare/odoh-go"
 	"github.com/miekg/dns"
+	"net/http"
 )
 
+// httpTransport carries the requests of the commands to proxies, targets and DoH servers. The tests
+// replace it with a transport trusting their own servers.
+var httpTransport http.RoundTripper = http.DefaultTransport
+
+// newHTTPClient returns a client sending the minimal headers.
+func newHTTPClient() *http.Client {
+	return withHeaderPolicy(&http.Client{Transport: httpTransport, Timeout: HTTP_CLIENT_TIMEOUT}, HEADER_POLICY_MINIMAL)
+}
+
 // Function for Converting CLI DNS Query Type to the uint16 Datatype
 func dnsQueryStringToType(stringType string) uint16 {
 	switch stringType {
@@ -27,11 +37,11 @@ func parseDnsResponse(data []byte) (*dns.Msg, error) {
 	return msg, err
 }
 
-func createOdohQuestion(dnsMessage []byte, publicKey odoh.ObliviousDoHConfigContents) (odoh.ObliviousDNSMessage, odoh.QueryContext, error) {
+func createOdohQuestion(dnsMessage []byte, config odoh.ObliviousDoHConfig) (odoh.ObliviousDNSMessage, odohQueryContext, error) {
 	odohQuery := odoh.CreateObliviousDNSQuery(dnsMessage, 0)
-	odnsMessage, queryContext, err := publicKey.EncryptQuery(odohQuery)
+	odnsMessage, queryContext, err := sealQuery(odohQuery, config)
 	if err != nil {
-		return odoh.ObliviousDNSMessage{}, odoh.QueryContext{}, err
+		return odoh.ObliviousDNSMessage{}, odohQueryContext{}, err
 	}
 
 	return odnsMessage, queryContext, nil
@@ -0,0 +1,281 @@
+package commands
+
+import (
+	"crypto/cipher"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"math/big"
+)
+
+// The vendored go-hpke implements draft-irtf-cfrg-hpke-06, which is what the draft ObliviousDoH
+// deployments speak. RFC 9230 targets use the final RFC 9180 HPKE, which only differs in the
+// version label mixed into every labeled KDF call. This file implements the base mode of RFC 9180
+// on top of the KDF and AEAD primitives exposed by go-hpke.
+
+const (
+	HPKE_V1_LABEL  = "HPKE-v1"
+	HPKE_MODE_BASE = uint8(0x00)
+)
+
+// hpkeSenderContext is satisfied by both the go-hpke draft-06 and the RFC 9180 sender contexts.
+type hpkeSenderContext interface {
+	Seal(aad, pt []byte) []byte
+	Export(exporterContext []byte, L int) []byte
+}
+
+// hpkeReceiverContext is satisfied by both the go-hpke draft-06 and the RFC 9180 receiver contexts.
+type hpkeReceiverContext interface {
+	Open(aad, ct []byte) ([]byte, error)
+	Export(exporterContext []byte, L int) []byte
+}
+
+func hpkeSuiteID(suite hpke.CipherSuite) []byte {
+	suiteID := make([]byte, 6)
+	binary.BigEndian.PutUint16(suiteID[0:], uint16(suite.KEM.ID()))
+	binary.BigEndian.PutUint16(suiteID[2:], uint16(suite.KDF.ID()))
+	binary.BigEndian.PutUint16(suiteID[4:], uint16(suite.AEAD.ID()))
+	return append([]byte("HPKE"), suiteID...)
+}
+
+func kemSuiteID(kemID hpke.KEMID) []byte {
+	suiteID := make([]byte, 2)
+	binary.BigEndian.PutUint16(suiteID, uint16(kemID))
+	return append([]byte("KEM"), suiteID...)
+}
+
+func labeledExtract(kdf hpke.KDFScheme, salt []byte, suiteID []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte(HPKE_V1_LABEL), suiteID...)
+	labeledIKM = append(labeledIKM, []byte(label)...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return kdf.Extract(salt, labeledIKM)
+}
+
+func labeledExpand(kdf hpke.KDFScheme, prk []byte, suiteID []byte, label string, info []byte, L int) []byte {
+	labeledInfo := make([]byte, 2)
+	binary.BigEndian.PutUint16(labeledInfo, uint16(L))
+	labeledInfo = append(labeledInfo, []byte(HPKE_V1_LABEL)...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, []byte(label)...)
+	labeledInfo = append(labeledInfo, info...)
+	return kdf.Expand(prk, labeledInfo, L)
+}
+
+// dhkem implements DHKEM from RFC 9180 on serialized keys, so that private keys minted by
+// `odohconfig-mint` can be used regardless of the HPKE version spoken on the wire.
+type dhkem struct {
+	id    hpke.KEMID
+	kdf   hpke.KDFScheme
+	curve elliptic.Curve
+}
+
+func newDHKEM(kemID hpke.KEMID) (dhkem, error) {
+	switch kemID {
+	case hpke.DHKEM_X25519:
+		suite, err := hpke.AssembleCipherSuite(kemID, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+		return dhkem{id: kemID, kdf: suite.KDF}, err
+	case hpke.DHKEM_P256:
+		suite, err := hpke.AssembleCipherSuite(kemID, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+		return dhkem{id: kemID, kdf: suite.KDF, curve: elliptic.P256()}, err
+	case hpke.DHKEM_P521:
+		suite, err := hpke.AssembleCipherSuite(kemID, hpke.KDF_HKDF_SHA512, hpke.AEAD_AESGCM128)
+		return dhkem{id: kemID, kdf: suite.KDF, curve: elliptic.P521()}, err
+	default:
+		return dhkem{}, fmt.Errorf("KEM 0x%04x is not supported with RFC 9180 HPKE", uint16(kemID))
+	}
+}
+
+func (k dhkem) privateKeySize() int {
+	if k.curve == nil {
+		return 32
+	}
+	return (k.curve.Params().BitSize + 7) >> 3
+}
+
+func (k dhkem) publicKey(sk []byte) ([]byte, error) {
+	if len(sk) != k.privateKeySize() {
+		return nil, errors.New("invalid private key length")
+	}
+	if k.curve == nil {
+		return curve25519.X25519(sk, curve25519.Basepoint)
+	}
+	scalar := new(big.Int).SetBytes(sk)
+	if scalar.Sign() == 0 || scalar.Cmp(k.curve.Params().N) >= 0 {
+		return nil, errors.New("invalid private key")
+	}
+	x, y := k.curve.ScalarBaseMult(sk)
+	return elliptic.Marshal(k.curve, x, y), nil
+}
+
+func (k dhkem) dh(sk []byte, pk []byte) ([]byte, error) {
+	if k.curve == nil {
+		if len(pk) != 32 {
+			return nil, errors.New("invalid X25519 public key")
+		}
+		return curve25519.X25519(sk, pk)
+	}
+	x, y := elliptic.Unmarshal(k.curve, pk)
+	if x == nil {
+		return nil, errors.New("invalid public key")
+	}
+	sharedX, _ := k.curve.ScalarMult(x, y, sk)
+	xx := sharedX.Bytes()
+	pad := make([]byte, k.privateKeySize()-len(xx))
+	return append(pad, xx...), nil
+}
+
+func (k dhkem) deriveKeyPair(ikm []byte) ([]byte, []byte, error) {
+	suiteID := kemSuiteID(k.id)
+	dkpPRK := labeledExtract(k.kdf, nil, suiteID, "dkp_prk", ikm)
+	if k.curve == nil {
+		sk := labeledExpand(k.kdf, dkpPRK, suiteID, "sk", nil, k.privateKeySize())
+		pk, err := k.publicKey(sk)
+		return sk, pk, err
+	}
+
+	bitmask := uint8(0xff)
+	if k.id == hpke.DHKEM_P521 {
+		bitmask = 0x01
+	}
+	for counter := 0; counter < 256; counter++ {
+		sk := labeledExpand(k.kdf, dkpPRK, suiteID, "candidate", []byte{uint8(counter)}, k.privateKeySize())
+		sk[0] &= bitmask
+		if pk, err := k.publicKey(sk); err == nil {
+			return sk, pk, nil
+		}
+	}
+	return nil, nil, errors.New("unable to derive a key pair")
+}
+
+func (k dhkem) generateKeyPair(random io.Reader) ([]byte, []byte, error) {
+	ikm := make([]byte, k.privateKeySize())
+	if _, err := io.ReadFull(random, ikm); err != nil {
+		return nil, nil, err
+	}
+	return k.deriveKeyPair(ikm)
+}
+
+func (k dhkem) extractAndExpand(dh []byte, kemContext []byte) []byte {
+	suiteID := kemSuiteID(k.id)
+	eaePRK := labeledExtract(k.kdf, nil, suiteID, "eae_prk", dh)
+	return labeledExpand(k.kdf, eaePRK, suiteID, "shared_secret", kemContext, k.kdf.OutputSize())
+}
+
+func (k dhkem) encap(random io.Reader, pkR []byte) ([]byte, []byte, error) {
+	skE, pkE, err := k.generateKeyPair(random)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := k.dh(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	kemContext := append(append([]byte{}, pkE...), pkR...)
+	return k.extractAndExpand(dh, kemContext), pkE, nil
+}
+
+func (k dhkem) decap(enc []byte, skR []byte) ([]byte, error) {
+	pkR, err := k.publicKey(skR)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := k.dh(skR, enc)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	return k.extractAndExpand(dh, kemContext), nil
+}
+
+// hpkeV1Context is an RFC 9180 encryption context, used by either the sender or the receiver.
+type hpkeV1Context struct {
+	suite          hpke.CipherSuite
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+func hpkeV1KeySchedule(suite hpke.CipherSuite, sharedSecret []byte, info []byte) (*hpkeV1Context, error) {
+	suiteID := hpkeSuiteID(suite)
+	pskIDHash := labeledExtract(suite.KDF, nil, suiteID, "psk_id_hash", nil)
+	infoHash := labeledExtract(suite.KDF, nil, suiteID, "info_hash", info)
+	keyScheduleContext := append([]byte{HPKE_MODE_BASE}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+
+	secret := labeledExtract(suite.KDF, sharedSecret, suiteID, "secret", nil)
+	key := labeledExpand(suite.KDF, secret, suiteID, "key", keyScheduleContext, suite.AEAD.KeySize())
+	aead, err := suite.AEAD.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeV1Context{
+		suite:          suite,
+		aead:           aead,
+		baseNonce:      labeledExpand(suite.KDF, secret, suiteID, "base_nonce", keyScheduleContext, suite.AEAD.NonceSize()),
+		exporterSecret: labeledExpand(suite.KDF, secret, suiteID, "exp", keyScheduleContext, suite.KDF.OutputSize()),
+	}, nil
+}
+
+func setupBaseSenderV1(suite hpke.CipherSuite, random io.Reader, pkR []byte, info []byte) ([]byte, *hpkeV1Context, error) {
+	kem, err := newDHKEM(suite.KEM.ID())
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, enc, err := kem.encap(random, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err := hpkeV1KeySchedule(suite, sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+func setupBaseReceiverV1(suite hpke.CipherSuite, skR []byte, enc []byte, info []byte) (*hpkeV1Context, error) {
+	kem, err := newDHKEM(suite.KEM.ID())
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := kem.decap(enc, skR)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeV1KeySchedule(suite, sharedSecret, info)
+}
+
+func (c *hpkeV1Context) computeNonce() []byte {
+	nonce := make([]byte, len(c.baseNonce))
+	copy(nonce, c.baseNonce)
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, c.seq)
+	for i := range seq {
+		nonce[len(nonce)-8+i] ^= seq[i]
+	}
+	return nonce
+}
+
+func (c *hpkeV1Context) Seal(aad, pt []byte) []byte {
+	ct := c.aead.Seal(nil, c.computeNonce(), pt, aad)
+	c.seq++
+	return ct
+}
+
+func (c *hpkeV1Context) Open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.computeNonce(), ct, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.seq++
+	return pt, nil
+}
+
+func (c *hpkeV1Context) Export(exporterContext []byte, L int) []byte {
+	return labeledExpand(c.suite.KDF, c.exporterSecret, hpkeSuiteID(c.suite), "sec", exporterContext, L)
+}
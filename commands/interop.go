@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// interopQueryResult is the outcome of one query type sent through a proxy to a target.
+type interopQueryResult struct {
+	DnsType string `json:"dnsType"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// interopCell is one proxy and target pair of the interoperability matrix. An empty Proxy stands
+// for queries sent directly to the target.
+type interopCell struct {
+	Proxy   string               `json:"proxy"`
+	Target  string               `json:"target"`
+	Works   bool                 `json:"works"`
+	Version uint16               `json:"version,omitempty"`
+	Results []interopQueryResult `json:"results"`
+}
+
+type interopMatrix struct {
+	Domain   string        `json:"domain"`
+	DnsTypes []string      `json:"dnsTypes"`
+	Proxies  []string      `json:"proxies"`
+	Targets  []string      `json:"targets"`
+	Cells    []interopCell `json:"cells"`
+}
+
+// splitList accepts repeated flags as well as comma separated values.
+func splitList(values []string) []string {
+	list := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// runInteropPair sends one query of each type through the proxy to the target, sealed to the
+// preferred config of the target.
+func runInteropPair(proxy string, target string, configs []odoh.ObliviousDoHConfig, configErr error, domain string, dnsTypes []string, client *http.Client) interopCell {
+	cell := interopCell{Proxy: proxy, Target: target, Works: true}
+	for _, dnsType := range dnsTypes {
+		result := interopQueryResult{DnsType: dnsType, Status: PROBE_OK}
+		if configErr != nil {
+			result.Status, result.Error = PROBE_CONFIG_FAILED, configErr.Error()
+		} else {
+			cell.Version = configs[0].Version
+			dnsQuery := new(dns.Msg)
+			dnsQuery.SetQuestion(dns.Fqdn(domain), dns.StringToType[dnsType])
+			packedDnsQuery, err := dnsQuery.Pack()
+			if err != nil {
+				result.Status, result.Error = PROBE_SEAL_FAILED, err.Error()
+			} else {
+				probed := probeConfig(configs[0], packedDnsQuery, 1, len(proxy) > 0, target, proxy, client)
+				result.Status, result.Error = probed.Status, probed.Error
+			}
+		}
+		if result.Status != PROBE_OK {
+			cell.Works = false
+		}
+		cell.Results = append(cell.Results, result)
+	}
+	return cell
+}
+
+func markdownEscape(text string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(text)
+}
+
+// writeMarkdown writes the matrix in the layout of the Experiments table of the README.
+func (m interopMatrix) writeMarkdown(w io.Writer) {
+	header := []string{"Proxied Via", "To Target"}
+	header = append(header, m.DnsTypes...)
+	header = append(header, "Can Resolve?", "Failures")
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	separators := make([]string, len(header))
+	for i := range separators {
+		separators[i] = "---"
+	}
+	fmt.Fprintf(w, "|%s|\n", strings.Join(separators, "|"))
+
+	for _, cell := range m.Cells {
+		proxy := cell.Proxy
+		if len(proxy) == 0 {
+			proxy = "(direct)"
+		}
+		row := []string{proxy, cell.Target}
+		failures := make([]string, 0)
+		for _, result := range cell.Results {
+			if result.Status == PROBE_OK {
+				row = append(row, "&check;")
+				continue
+			}
+			row = append(row, "&cross;")
+			failures = append(failures, fmt.Sprintf("%s: %s: %s", result.DnsType, result.Status, markdownEscape(result.Error)))
+		}
+		if cell.Works {
+			row = append(row, "&check;")
+		} else {
+			row = append(row, "&cross;")
+		}
+		row = append(row, strings.Join(failures, "<br>"))
+		fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+	}
+}
+
+// runInteropMatrix resolves every query type through every proxy and target pair, taking the pairs
+// from the flags or from the discovery service.
+func runInteropMatrix(c *cli.Context) error {
+	proxies := splitList(c.StringSlice("proxy"))
+	targets := splitList(c.StringSlice("target"))
+	if len(proxies) == 0 && len(targets) == 0 {
+		services, err := fetchProxiesAndTargets(c.String("discovery"), newHTTPClient())
+		if err != nil {
+			return err
+		}
+		proxies, targets = services.Proxies, services.Targets
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets to test")
+	}
+	if c.Bool("direct") {
+		proxies = append([]string{""}, proxies...)
+	}
+	if len(proxies) == 0 {
+		return fmt.Errorf("no proxies to test, pass --direct to query the targets directly")
+	}
+	dnsTypes := splitList([]string{strings.ToUpper(c.String("dnstypes"))})
+	for _, dnsType := range dnsTypes {
+		if _, ok := dns.StringToType[dnsType]; !ok {
+			return fmt.Errorf("unknown DNS type %q", dnsType)
+		}
+	}
+	versions, err := parseOdohVersions(c.String("odoh-version"))
+	if err != nil {
+		return err
+	}
+	client, err := newProxyHTTPClient(c, proxies...)
+	if err != nil {
+		return err
+	}
+
+	matrix := interopMatrix{Domain: dns.Fqdn(c.String("domain")), DnsTypes: dnsTypes, Proxies: proxies, Targets: targets}
+	for _, target := range targets {
+		var configs []odoh.ObliviousDoHConfig
+		fetched, err := fetchRawTargetConfigs(target, c.String("source"))
+		if err == nil {
+			var parsed odoh.ObliviousDoHConfigs
+			if parsed, err = fetched.parse(); err == nil {
+				configs = orderConfigs(parsed, versions, defaultSuitePreference)
+				if len(configs) == 0 {
+					err = fmt.Errorf("no usable ObliviousDoHConfig")
+				}
+			}
+		}
+		for _, proxy := range proxies {
+			matrix.Cells = append(matrix.Cells, runInteropPair(proxy, target, configs, err, matrix.Domain, dnsTypes, client))
+		}
+	}
+
+	if c.String("output") == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(matrix)
+	}
+	matrix.writeMarkdown(os.Stdout)
+	return nil
+}
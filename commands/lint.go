@@ -0,0 +1,190 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/urfave/cli"
+	"os"
+)
+
+// configDescription is an ObliviousDoHConfig as published, including the ones this client cannot use.
+type configDescription struct {
+	Version     uint16 `json:"version"`
+	VersionName string `json:"versionName"`
+	KemID       uint16 `json:"kemId"`
+	KdfID       uint16 `json:"kdfId"`
+	AeadID      uint16 `json:"aeadId"`
+	PublicKey   string `json:"publicKey"`
+	KeyID       string `json:"keyId,omitempty"`
+	Supported   bool   `json:"supported"`
+	Problem     string `json:"problem,omitempty"`
+}
+
+func describeConfig(rawConfig rawObliviousDoHConfig) configDescription {
+	description := configDescription{
+		Version:     rawConfig.Version,
+		VersionName: odohVersionName(rawConfig.Version),
+	}
+
+	contents := rawConfig.Contents
+	if len(contents) < 8 {
+		description.Problem = "truncated ObliviousDoHConfigContents"
+		return description
+	}
+	description.KemID = binary.BigEndian.Uint16(contents[0:])
+	description.KdfID = binary.BigEndian.Uint16(contents[2:])
+	description.AeadID = binary.BigEndian.Uint16(contents[4:])
+	publicKeyLength := int(binary.BigEndian.Uint16(contents[6:]))
+	if len(contents[8:]) < publicKeyLength {
+		description.Problem = fmt.Sprintf("public key truncated, expected %d bytes, got %d", publicKeyLength, len(contents[8:]))
+		return description
+	}
+	publicKey := contents[8 : 8+publicKeyLength]
+	description.PublicKey = hex.EncodeToString(publicKey)
+
+	suite, err := hpke.AssembleCipherSuite(hpke.KEMID(description.KemID), hpke.KDFID(description.KdfID), hpke.AEADID(description.AeadID))
+	if err != nil {
+		description.Problem = fmt.Sprintf("unknown HPKE suite: %v", err)
+		return description
+	}
+	configContents := odoh.ObliviousDoHConfigContents{
+		KemID:          hpke.KEMID(description.KemID),
+		KdfID:          hpke.KDFID(description.KdfID),
+		AeadID:         hpke.AEADID(description.AeadID),
+		PublicKeyBytes: publicKey,
+	}
+	description.KeyID = hex.EncodeToString(configContents.KeyID())
+
+	switch {
+	case len(publicKey) != suite.KEM.PublicKeySize():
+		description.Problem = fmt.Sprintf("malformed public key, expected %d bytes, got %d", suite.KEM.PublicKeySize(), len(publicKey))
+	case len(contents) != 8+publicKeyLength:
+		description.Problem = fmt.Sprintf("%d trailing bytes after the public key", len(contents)-8-publicKeyLength)
+	default:
+		if _, err := suite.KEM.Deserialize(publicKey); err != nil {
+			description.Problem = fmt.Sprintf("malformed public key: %v", err)
+		} else if err := checkConfigSupported(odoh.ObliviousDoHConfig{Version: rawConfig.Version, Contents: configContents}); err != nil {
+			description.Problem = err.Error()
+		}
+	}
+	description.Supported = len(description.Problem) == 0
+	return description
+}
+
+type lintFinding struct {
+	Severity string `json:"severity"`
+	Source   string `json:"source,omitempty"`
+	Message  string `json:"message"`
+}
+
+// lintFetchedConfigs checks a single ObliviousDoHConfigs list for problems.
+func lintFetchedConfigs(fetched fetchedTargetConfigs) []lintFinding {
+	findings := make([]lintFinding, 0)
+	report := func(severity string, format string, args ...interface{}) {
+		findings = append(findings, lintFinding{Severity: severity, Source: fetched.Source, Message: fmt.Sprintf(format, args...)})
+	}
+
+	rawConfigs, err := splitObliviousDoHConfigs(fetched.Raw)
+	if err != nil {
+		report(LINT_ERROR, "malformed ObliviousDoHConfigs: %v", err)
+		return findings
+	}
+	if len(rawConfigs) == 0 {
+		report(LINT_ERROR, "empty ObliviousDoHConfigs list")
+	}
+	if fetched.TTL == 0 {
+		report(LINT_WARNING, "no TTL or max-age, clients cannot tell how long to cache the configs")
+	}
+
+	usable := 0
+	seenKeyIDs := make(map[string]int)
+	for i, rawConfig := range rawConfigs {
+		description := describeConfig(rawConfig)
+		if !isSupportedConfigVersion(rawConfig.Version) {
+			report(LINT_WARNING, "config %d: unsupported version 0x%04x", i+1, rawConfig.Version)
+			continue
+		}
+		if description.Supported {
+			usable++
+		} else {
+			report(LINT_ERROR, "config %d: %s", i+1, description.Problem)
+		}
+		// The same key may legitimately be published once per version during a migration.
+		if len(description.KeyID) > 0 {
+			versionedKeyID := fmt.Sprintf("%04x/%s", rawConfig.Version, description.KeyID)
+			if previous, ok := seenKeyIDs[versionedKeyID]; ok {
+				report(LINT_ERROR, "config %d: duplicate KeyID(%s), also used by config %d", i+1, description.KeyID, previous)
+			} else {
+				seenKeyIDs[versionedKeyID] = i + 1
+			}
+		}
+	}
+	if len(rawConfigs) > 0 && usable == 0 {
+		report(LINT_ERROR, "no config is usable by this client")
+	}
+	return findings
+}
+
+func lintTargetConfigs(targetName string, source string, asJSON bool) error {
+	findings := make([]lintFinding, 0)
+	fetchedBySource := make(map[string]fetchedTargetConfigs)
+
+	sources := []string{CONFIG_SOURCE_DNS, CONFIG_SOURCE_WELLKNOWN}
+	if source == CONFIG_SOURCE_DNS || source == CONFIG_SOURCE_WELLKNOWN {
+		sources = []string{source}
+	}
+	for _, configSource := range sources {
+		fetched, err := fetchRawTargetConfigs(targetName, configSource)
+		if err != nil {
+			findings = append(findings, lintFinding{Severity: LINT_WARNING, Source: configSource, Message: fmt.Sprintf("unable to fetch configs: %v", err)})
+			continue
+		}
+		fetchedBySource[configSource] = fetched
+		findings = append(findings, lintFetchedConfigs(fetched)...)
+	}
+
+	if len(fetchedBySource) == 0 {
+		findings = append(findings, lintFinding{Severity: LINT_ERROR, Message: "no source returned any ObliviousDoHConfigs"})
+	}
+	fromDNS, okDNS := fetchedBySource[CONFIG_SOURCE_DNS]
+	fromWellKnown, okWellKnown := fetchedBySource[CONFIG_SOURCE_WELLKNOWN]
+	if okDNS && okWellKnown && !bytes.Equal(fromDNS.Raw, fromWellKnown.Raw) {
+		findings = append(findings, lintFinding{Severity: LINT_ERROR, Message: "DNS and well-known endpoint publish different ObliviousDoHConfigs"})
+	}
+
+	errorCount := 0
+	for _, finding := range findings {
+		if finding.Severity == LINT_ERROR {
+			errorCount++
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			return err
+		}
+	} else {
+		for _, finding := range findings {
+			if len(finding.Source) > 0 {
+				fmt.Printf("%s [%s]: %s\n", finding.Severity, finding.Source, finding.Message)
+			} else {
+				fmt.Printf("%s: %s\n", finding.Severity, finding.Message)
+			}
+		}
+		if len(findings) == 0 {
+			fmt.Printf("No problems found in the ObliviousDoHConfigs of %s\n", targetName)
+		}
+	}
+
+	if errorCount > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d problems found in the ObliviousDoHConfigs of %s", errorCount, targetName), 1)
+	}
+	return nil
+}
@@ -1,64 +1,305 @@
 package commands
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	hpke "github.com/cisco/go-hpke"
 	odoh "github.com/cloudflare/odoh-go"
 	"github.com/urfave/cli"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 )
 
-func createConfigurations(c *cli.Context) error {
+// mintedKey is a single minted ObliviousDoHConfig and its serialized HPKE private key.
+type mintedKey struct {
+	Config     odoh.ObliviousDoHConfig
+	PrivateKey []byte
+}
+
+// mintManifestEntry describes a minted config without any private material.
+type mintManifestEntry struct {
+	Version   uint16 `json:"version"`
+	KemID     uint16 `json:"kemId"`
+	KdfID     uint16 `json:"kdfId"`
+	AeadID    uint16 `json:"aeadId"`
+	KeyID     string `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+type mintManifest struct {
+	Seeded  bool                `json:"seeded"`
+	Configs string              `json:"configs"`
+	Keys    []mintManifestEntry `json:"keys"`
+}
+
+// mintKey creates an ObliviousDoHConfig for the suite, deterministically if a seed is given. Every suite
+// and version derives its own IKM from the seed, so suites which share a KEM never share a key pair.
+func mintKey(suite hpkeSuite, version uint16, seed []byte) (mintedKey, error) {
+	cipherSuite, err := hpke.AssembleCipherSuite(suite.KemID, suite.KdfID, suite.AeadID)
+	if err != nil {
+		return mintedKey{}, err
+	}
+
+	var ikm []byte
+	if seed != nil {
+		ikm = seedIKM(cipherSuite, version, seed)
+	} else {
+		ikm = make([]byte, cipherSuite.KEM.PrivateKeySize())
+		if _, err := io.ReadFull(rand.Reader, ikm); err != nil {
+			return mintedKey{}, err
+		}
+	}
+
+	keyPair, err := odoh.CreateKeyPairFromSeed(suite.KemID, suite.KdfID, suite.AeadID, ikm)
+	if err != nil {
+		return mintedKey{}, err
+	}
+	// The key pair does not expose its private key, so derive it again from the same IKM.
+	privateKey, _, err := cipherSuite.KEM.DeriveKeyPair(ikm)
+	if err != nil {
+		return mintedKey{}, err
+	}
+
+	config := keyPair.Config
+	config.Version = version
+	return mintedKey{
+		Config:     config,
+		PrivateKey: cipherSuite.KEM.SerializePrivate(privateKey),
+	}, nil
+}
+
+// seedIKM derives the IKM of the suite and version from the mint seed with the suite's own KDF.
+func seedIKM(suite hpke.CipherSuite, version uint16, seed []byte) []byte {
+	suiteID := hpkeSuiteID(suite)
+	info := make([]byte, 2)
+	binary.BigEndian.PutUint16(info, version)
+	prk := labeledExtract(suite.KDF, nil, suiteID, "odoh_mint_seed", seed)
+	return labeledExpand(suite.KDF, prk, suiteID, "ikm", info, suite.KEM.PrivateKeySize())
+}
+
+func mintSuites(c *cli.Context) ([]hpkeSuite, error) {
+	if len(c.String("suites")) > 0 {
+		return parseSuitePreference(c.String("suites"))
+	}
+
 	kemID, err := strconv.ParseUint(c.String("kemid"), 10, 16)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	kdfID, err := strconv.ParseUint(c.String("kdfid"), 10, 16)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	aeadID, err := strconv.ParseUint(c.String("aeadid"), 10, 16)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return []hpkeSuite{{hpke.KEMID(kemID), hpke.KDFID(kdfID), hpke.AEADID(aeadID)}}, nil
+}
+
+func parseMintVersion(name string) (uint16, error) {
+	switch name {
+	case "draft":
+		return ODOH_VERSION_DRAFT, nil
+	case "rfc9230":
+		return ODOH_VERSION_RFC9230, nil
+	default:
+		return 0, fmt.Errorf("unknown ODoH version %q, expected draft or rfc9230", name)
 	}
+}
 
-	suite, err := hpke.AssembleCipherSuite(hpke.KEMID(kemID), hpke.KDFID(kdfID), hpke.AEADID(aeadID))
+// writeOutput writes to the named file with the given permissions, or to stdout if the name is empty.
+func writeOutput(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	if len(path) == 0 {
+		return write(os.Stdout)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
+	// OpenFile keeps the mode of an existing file, so tighten it explicitly.
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	// A failed close may have lost the end of the file, such as a truncated private key.
+	return f.Close()
+}
 
-	ikm := make([]byte, suite.KEM.PrivateKeySize())
-	rand.Reader.Read(ikm)
-	privateKey, publicKey, err := suite.KEM.DeriveKeyPair(ikm)
+func writeConfigsPEM(w io.Writer, serializedConfigs []byte) error {
+	return pem.Encode(w, &pem.Block{
+		Type:  "ODOH CONFIGS",
+		Bytes: serializedConfigs,
+	})
+}
+
+func writePrivateKeysPEM(w io.Writer, keys []mintedKey) error {
+	for _, key := range keys {
+		err := pem.Encode(w, &pem.Block{
+			Type:    "ODOH PRIVATE KEY",
+			Headers: map[string]string{"KeyID": hex.EncodeToString(key.Config.Contents.KeyID())},
+			Bytes:   key.PrivateKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPEMBlocks(path string, blockType string) ([]*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	blocks := make([]*pem.Block, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == blockType {
+			blocks = append(blocks, block)
+		}
 	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("no %v PEM block found in %v", blockType, path)
+	}
+	return blocks, nil
+}
 
-	configContents, err := odoh.CreateObliviousDoHConfigContents(hpke.KEMID(kemID), hpke.KDFID(kdfID), hpke.AEADID(aeadID), suite.KEM.Serialize(publicKey))
+// readConfigsPEM reads the ObliviousDoHConfigs written by `odohconfig-mint` and returns them both
+// parsed and serialized.
+func readConfigsPEM(path string) (odoh.ObliviousDoHConfigs, []byte, error) {
+	blocks, err := readPEMBlocks(path, "ODOH CONFIGS")
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, nil, err
+	}
+	configs, err := parseObliviousDoHConfigs(blocks[0].Bytes)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, nil, err
+	}
+	return configs, blocks[0].Bytes, nil
+}
+
+// readPrivateKeysPEM pairs each config with its private key, found by the KeyID header or, failing
+// that, by the public key it derives.
+func readPrivateKeysPEM(path string, configs odoh.ObliviousDoHConfigs) ([]mintedKey, error) {
+	blocks, err := readPEMBlocks(path, "ODOH PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]mintedKey, 0, len(configs.Configs))
+	for _, config := range configs.Configs {
+		keyID := hex.EncodeToString(config.Contents.KeyID())
+		var privateKey []byte
+		for _, block := range blocks {
+			if block.Headers["KeyID"] == keyID {
+				privateKey = block.Bytes
+				break
+			}
+		}
+		if privateKey == nil {
+			if kem, err := newDHKEM(config.Contents.KemID); err == nil {
+				for _, block := range blocks {
+					if publicKey, err := kem.publicKey(block.Bytes); err == nil && bytes.Equal(publicKey, config.Contents.PublicKeyBytes) {
+						privateKey = block.Bytes
+						break
+					}
+				}
+			}
+		}
+		if privateKey == nil {
+			return nil, fmt.Errorf("no private key in %v for KeyID(%s)", path, keyID)
+		}
+		keys = append(keys, mintedKey{Config: config, PrivateKey: privateKey})
+	}
+	return keys, nil
+}
+
+func createConfigurations(c *cli.Context) error {
+	suites, err := mintSuites(c)
 	if err != nil {
 		return err
 	}
 
-	config := odoh.CreateObliviousDoHConfig(configContents)
+	version, err := parseMintVersion(c.String("odoh-version"))
+	if err != nil {
+		return err
+	}
 
-	configsBlock := &pem.Block{
-		Type:  "ODOH CONFIGS",
-		Bytes: config.Marshal(),
+	var seed []byte
+	if len(c.String("seed")) > 0 {
+		seed, err = hex.DecodeString(c.String("seed"))
+		if err != nil {
+			return fmt.Errorf("invalid hex seed: %v", err)
+		}
+		if len(seed) < 32 {
+			return errors.New("the seed must be at least 32 bytes long")
+		}
 	}
-	if err := pem.Encode(os.Stdout, configsBlock); err != nil {
-		log.Fatal(err)
+
+	keys := make([]mintedKey, 0, len(suites))
+	configs := make([]odoh.ObliviousDoHConfig, 0, len(suites))
+	for _, suite := range suites {
+		key, err := mintKey(suite, version, seed)
+		if err != nil {
+			return fmt.Errorf("unable to mint a config for %v: %v", suite, err)
+		}
+		keys = append(keys, key)
+		configs = append(configs, key.Config)
 	}
+	serializedConfigs := odoh.CreateObliviousDoHConfigs(configs).Marshal()
 
-	privateConfigsBlock := &pem.Block{
-		Type:  "ODOH PRIVATE KEY",
-		Bytes: suite.KEM.SerializePrivate(privateKey),
+	err = writeOutput(c.String("config-out"), 0644, func(w io.Writer) error {
+		return writeConfigsPEM(w, serializedConfigs)
+	})
+	if err != nil {
+		return err
 	}
-	if err := pem.Encode(os.Stdout, privateConfigsBlock); err != nil {
-		log.Fatal(err)
+
+	err = writeOutput(c.String("private-key-out"), 0600, func(w io.Writer) error {
+		return writePrivateKeysPEM(w, keys)
+	})
+	if err != nil {
+		return err
 	}
 
+	if len(c.String("manifest-out")) > 0 {
+		manifest := mintManifest{
+			Seeded:  seed != nil,
+			Configs: hex.EncodeToString(serializedConfigs),
+			Keys:    make([]mintManifestEntry, 0, len(keys)),
+		}
+		for _, key := range keys {
+			manifest.Keys = append(manifest.Keys, mintManifestEntry{
+				Version:   key.Config.Version,
+				KemID:     uint16(key.Config.Contents.KemID),
+				KdfID:     uint16(key.Config.Contents.KdfID),
+				AeadID:    uint16(key.Config.Contents.AeadID),
+				KeyID:     hex.EncodeToString(key.Config.Contents.KeyID()),
+				PublicKey: hex.EncodeToString(key.Config.Contents.PublicKeyBytes),
+			})
+		}
+		return writeOutput(c.String("manifest-out"), 0644, func(w io.Writer) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(manifest)
+		})
+	}
 	return nil
 }
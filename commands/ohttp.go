@@ -0,0 +1,394 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	"github.com/miekg/dns"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Oblivious HTTP (RFC 9458) is the alternative to ODoH selected with `--protocol ohttp`: the DoH
+// request to the target is encoded as Binary HTTP, encapsulated with RFC 9180 HPKE to the key of
+// the gateway, and sent through a relay which only learns the gateway.
+
+var errUnknownOHTTPKey = errors.New("unknown OHTTP key")
+
+type ohttpSymmetricSuite struct {
+	KdfID  hpke.KDFID
+	AeadID hpke.AEADID
+}
+
+// ohttpKeyConfig is a single key configuration of an application/ohttp-keys list.
+type ohttpKeyConfig struct {
+	KeyID     uint8
+	KemID     hpke.KEMID
+	PublicKey []byte
+	Suites    []ohttpSymmetricSuite
+}
+
+func (k dhkem) publicKeySize() int {
+	if k.curve == nil {
+		return 32
+	}
+	return 1 + 2*k.privateKeySize()
+}
+
+func (c ohttpKeyConfig) Marshal() []byte {
+	config := []byte{c.KeyID}
+	config = append(config, byte(c.KemID>>8), byte(c.KemID))
+	config = append(config, c.PublicKey...)
+	suites := make([]byte, 0, 4*len(c.Suites))
+	for _, suite := range c.Suites {
+		suites = append(suites, byte(suite.KdfID>>8), byte(suite.KdfID), byte(suite.AeadID>>8), byte(suite.AeadID))
+	}
+	return append(config, encodeLengthPrefixed(suites)...)
+}
+
+func unmarshalOHTTPKeyConfig(data []byte) (ohttpKeyConfig, error) {
+	if len(data) < 3 {
+		return ohttpKeyConfig{}, errors.New("truncated OHTTP key config")
+	}
+	config := ohttpKeyConfig{KeyID: data[0], KemID: hpke.KEMID(binary.BigEndian.Uint16(data[1:3]))}
+	kem, err := newDHKEM(config.KemID)
+	if err != nil {
+		return ohttpKeyConfig{}, err
+	}
+	rest := data[3:]
+	if len(rest) < kem.publicKeySize() {
+		return ohttpKeyConfig{}, errors.New("truncated OHTTP key config")
+	}
+	config.PublicKey = rest[:kem.publicKeySize()]
+	suites, rest, err := decodeLengthPrefixed(rest[kem.publicKeySize():])
+	if err != nil {
+		return ohttpKeyConfig{}, err
+	}
+	if len(rest) > 0 || len(suites)%4 != 0 || len(suites) == 0 {
+		return ohttpKeyConfig{}, errors.New("malformed OHTTP key config")
+	}
+	for i := 0; i < len(suites); i += 4 {
+		config.Suites = append(config.Suites, ohttpSymmetricSuite{
+			KdfID:  hpke.KDFID(binary.BigEndian.Uint16(suites[i:])),
+			AeadID: hpke.AEADID(binary.BigEndian.Uint16(suites[i+2:])),
+		})
+	}
+	return config, nil
+}
+
+func marshalOHTTPKeyConfigs(configs []ohttpKeyConfig) []byte {
+	var serialized []byte
+	for _, config := range configs {
+		serialized = append(serialized, encodeLengthPrefixed(config.Marshal())...)
+	}
+	return serialized
+}
+
+// parseOHTTPKeyConfigs reads an application/ohttp-keys list, skipping the configs whose KEM is not
+// supported.
+func parseOHTTPKeyConfigs(data []byte) ([]ohttpKeyConfig, error) {
+	configs := make([]ohttpKeyConfig, 0)
+	for len(data) > 0 {
+		serialized, rest, err := decodeLengthPrefixed(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		if config, err := unmarshalOHTTPKeyConfig(serialized); err == nil {
+			configs = append(configs, config)
+		}
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no usable OHTTP key config")
+	}
+	return configs, nil
+}
+
+// cipherSuite picks the first symmetric suite of the config that go-hpke implements.
+func (c ohttpKeyConfig) cipherSuite() (hpke.CipherSuite, hpkeSuite, error) {
+	for _, suite := range c.Suites {
+		cipherSuite, err := hpke.AssembleCipherSuite(c.KemID, suite.KdfID, suite.AeadID)
+		if err == nil {
+			return cipherSuite, hpkeSuite{c.KemID, suite.KdfID, suite.AeadID}, nil
+		}
+	}
+	return hpke.CipherSuite{}, hpkeSuite{}, fmt.Errorf("no supported HPKE suite in OHTTP key %d", c.KeyID)
+}
+
+func ohttpRequestHeader(keyID uint8, suite hpkeSuite) []byte {
+	header := []byte{keyID, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(suite.KemID))
+	binary.BigEndian.PutUint16(header[3:], uint16(suite.KdfID))
+	binary.BigEndian.PutUint16(header[5:], uint16(suite.AeadID))
+	return header
+}
+
+func ohttpRequestInfo(header []byte) []byte {
+	return append(append([]byte(OHTTP_LABEL_REQUEST), 0x00), header...)
+}
+
+// ohttpRequestContext is what a client keeps after encapsulating a request in order to open the
+// response, and what a gateway keeps after decapsulating it in order to encapsulate the response.
+type ohttpRequestContext struct {
+	KeyID  uint8
+	Suite  hpkeSuite
+	Enc    []byte
+	Secret []byte
+}
+
+func ohttpResponseNonceSize(suite hpke.CipherSuite) int {
+	if suite.AEAD.KeySize() > suite.AEAD.NonceSize() {
+		return suite.AEAD.KeySize()
+	}
+	return suite.AEAD.NonceSize()
+}
+
+func newOHTTPRequestContext(keyID uint8, suite hpkeSuite, cipherSuite hpke.CipherSuite, enc []byte, ctx hpkeSenderContext) ohttpRequestContext {
+	return ohttpRequestContext{
+		KeyID:  keyID,
+		Suite:  suite,
+		Enc:    enc,
+		Secret: ctx.Export([]byte(OHTTP_LABEL_RESPONSE), ohttpResponseNonceSize(cipherSuite)),
+	}
+}
+
+// encapsulateRequest seals a Binary HTTP request to the key config.
+func encapsulateRequest(config ohttpKeyConfig, request []byte) ([]byte, ohttpRequestContext, error) {
+	cipherSuite, suite, err := config.cipherSuite()
+	if err != nil {
+		return nil, ohttpRequestContext{}, err
+	}
+	header := ohttpRequestHeader(config.KeyID, suite)
+	enc, ctx, err := setupBaseSenderV1(cipherSuite, rand.Reader, config.PublicKey, ohttpRequestInfo(header))
+	if err != nil {
+		return nil, ohttpRequestContext{}, err
+	}
+	encapsulated := append(append(header, enc...), ctx.Seal(nil, request)...)
+	return encapsulated, newOHTTPRequestContext(config.KeyID, suite, cipherSuite, enc, ctx), nil
+}
+
+func (c ohttpRequestContext) responseAEAD(responseNonce []byte) (cipher.AEAD, []byte, error) {
+	cipherSuite, err := hpke.AssembleCipherSuite(c.Suite.KemID, c.Suite.KdfID, c.Suite.AeadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	salt := append(append([]byte{}, c.Enc...), responseNonce...)
+	prk := cipherSuite.KDF.Extract(salt, c.Secret)
+	aead, err := cipherSuite.AEAD.New(cipherSuite.KDF.Expand(prk, []byte("key"), cipherSuite.AEAD.KeySize()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, cipherSuite.KDF.Expand(prk, []byte("nonce"), cipherSuite.AEAD.NonceSize()), nil
+}
+
+// OpenResponse decrypts an encapsulated response into the Binary HTTP response.
+func (c ohttpRequestContext) OpenResponse(encapsulated []byte) ([]byte, error) {
+	nonceSize := len(c.Secret)
+	if len(encapsulated) < nonceSize {
+		return nil, errors.New("truncated OHTTP response")
+	}
+	aead, nonce, err := c.responseAEAD(encapsulated[:nonceSize])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, encapsulated[nonceSize:], nil)
+}
+
+// SealResponse encrypts a Binary HTTP response to the client of the request.
+func (c ohttpRequestContext) SealResponse(response []byte) ([]byte, error) {
+	responseNonce := make([]byte, len(c.Secret))
+	if _, err := io.ReadFull(rand.Reader, responseNonce); err != nil {
+		return nil, err
+	}
+	aead, nonce, err := c.responseAEAD(responseNonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(responseNonce, nonce, response, nil), nil
+}
+
+// ohttpGatewayKey is a key config together with its private key, as held by a gateway.
+type ohttpGatewayKey struct {
+	Config     ohttpKeyConfig
+	PrivateKey []byte
+}
+
+func newOHTTPGatewayKey(keyID uint8, suite hpkeSuite) (ohttpGatewayKey, error) {
+	kem, err := newDHKEM(suite.KemID)
+	if err != nil {
+		return ohttpGatewayKey{}, err
+	}
+	privateKey, publicKey, err := kem.generateKeyPair(rand.Reader)
+	if err != nil {
+		return ohttpGatewayKey{}, err
+	}
+	return ohttpGatewayKey{
+		Config: ohttpKeyConfig{
+			KeyID:     keyID,
+			KemID:     suite.KemID,
+			PublicKey: publicKey,
+			Suites:    []ohttpSymmetricSuite{{suite.KdfID, suite.AeadID}},
+		},
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// decapsulateRequest opens an encapsulated request with the matching gateway key.
+func decapsulateRequest(encapsulated []byte, keys []ohttpGatewayKey) ([]byte, ohttpRequestContext, error) {
+	if len(encapsulated) < 7 {
+		return nil, ohttpRequestContext{}, errors.New("truncated OHTTP request")
+	}
+	header := encapsulated[:7]
+	suite := hpkeSuite{
+		KemID:  hpke.KEMID(binary.BigEndian.Uint16(header[1:])),
+		KdfID:  hpke.KDFID(binary.BigEndian.Uint16(header[3:])),
+		AeadID: hpke.AEADID(binary.BigEndian.Uint16(header[5:])),
+	}
+	for _, key := range keys {
+		if key.Config.KeyID != header[0] || key.Config.KemID != suite.KemID {
+			continue
+		}
+		supported := false
+		for _, symmetric := range key.Config.Suites {
+			supported = supported || (symmetric.KdfID == suite.KdfID && symmetric.AeadID == suite.AeadID)
+		}
+		if !supported {
+			continue
+		}
+
+		cipherSuite, err := hpke.AssembleCipherSuite(suite.KemID, suite.KdfID, suite.AeadID)
+		if err != nil {
+			return nil, ohttpRequestContext{}, err
+		}
+		encSize := len(key.Config.PublicKey)
+		if len(encapsulated) < 7+encSize {
+			return nil, ohttpRequestContext{}, errors.New("truncated OHTTP request")
+		}
+		enc := encapsulated[7 : 7+encSize]
+		ctx, err := setupBaseReceiverV1(cipherSuite, key.PrivateKey, enc, ohttpRequestInfo(header))
+		if err != nil {
+			return nil, ohttpRequestContext{}, err
+		}
+		request, err := ctx.Open(nil, encapsulated[7+encSize:])
+		if err != nil {
+			return nil, ohttpRequestContext{}, err
+		}
+		return request, newOHTTPRequestContext(header[0], suite, cipherSuite, enc, ctx), nil
+	}
+	return nil, ohttpRequestContext{}, errUnknownOHTTPKey
+}
+
+// ohttpGatewayURL is where the gateway of a target publishes its keys (RFC 9540) and accepts
+// encapsulated requests.
+func ohttpGatewayURL(target string) string {
+	return TARGET_HTTP_MODE + "://" + target + OHTTP_GATEWAY_WELLKNOWN_URL
+}
+
+// ohttpRelayURL is where encapsulated requests are posted: the relay if one is given, else the relay
+// endpoint of the oblivious proxy addressing the gateway as prepareHttpRequest does for ODoH, else
+// the gateway itself.
+func ohttpRelayURL(relay string, proxy string, gatewayURL string) (string, error) {
+	if len(relay) > 0 {
+		return relay, nil
+	}
+	if len(proxy) == 0 {
+		return gatewayURL, nil
+	}
+	gateway, err := url.Parse(gatewayURL)
+	if err != nil {
+		return "", err
+	}
+	queries := url.Values{}
+	queries.Set("targethost", gateway.Host)
+	queries.Set("targetpath", gateway.Path)
+	return fmt.Sprintf("%s/ohttp-relay?%s", proxyBaseURL(proxy), queries.Encode()), nil
+}
+
+func fetchOHTTPKeyConfigs(gatewayURL string, client *http.Client) ([]ohttpKeyConfig, error) {
+	req, err := http.NewRequest(http.MethodGet, gatewayURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", OHTTP_KEYS)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body)
+	body, err := readResponse(resp, OHTTP_KEYS, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the OHTTP keys of %v: %v", gatewayURL, err)
+	}
+	return parseOHTTPKeyConfigs(body)
+}
+
+// sealOHTTPQuery wraps a DoH POST of the DNS query to the target in Binary HTTP and encapsulates it.
+func sealOHTTPQuery(dnsMessage []byte, target string, config ohttpKeyConfig) ([]byte, ohttpRequestContext, error) {
+	request := bhttpRequest{
+		Method:    http.MethodPost,
+		Scheme:    TARGET_HTTP_MODE,
+		Authority: target,
+		Path:      "/dns-query",
+		Header: http.Header{
+			"Content-Type": []string{DOH_MESSAGE},
+			"Accept":       []string{DOH_MESSAGE},
+		},
+		Content: dnsMessage,
+	}
+	return encapsulateRequest(config, request.Marshal())
+}
+
+// sealOHTTPQueryWithConfigs seals the query to the first key config with a supported suite.
+func sealOHTTPQueryWithConfigs(dnsMessage []byte, target string, configs []ohttpKeyConfig) ([]byte, ohttpRequestContext, error) {
+	err := errors.New("no usable OHTTP key config")
+	for _, config := range configs {
+		var encapsulated []byte
+		var requestContext ohttpRequestContext
+		if encapsulated, requestContext, err = sealOHTTPQuery(dnsMessage, target, config); err == nil {
+			return encapsulated, requestContext, nil
+		}
+	}
+	return nil, ohttpRequestContext{}, err
+}
+
+// exchangeOHTTP posts an encapsulated request to the relay, or to the gateway directly, and returns
+// the encapsulated response.
+func exchangeOHTTP(ctx context.Context, encapsulated []byte, relayURL string, client *http.Client) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, relayURL, bytes.NewReader(encapsulated))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", OHTTP_REQUEST)
+	req.Header.Set("Accept", OHTTP_RESPONSE)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body)
+	return readResponse(resp, OHTTP_RESPONSE, MAX_OBLIVIOUS_MESSAGE_SIZE)
+}
+
+// openOHTTPAnswer decrypts the encapsulated response and returns the DNS answer of the DoH response.
+func openOHTTPAnswer(encapsulated []byte, requestContext ohttpRequestContext) (*dns.Msg, error) {
+	serialized, err := requestContext.OpenResponse(encapsulated)
+	if err != nil {
+		return nil, err
+	}
+	response, err := unmarshalBinaryResponse(serialized)
+	if err != nil {
+		return nil, err
+	}
+	if response.Status != http.StatusOK {
+		return nil, fmt.Errorf("target answered with status %d", response.Status)
+	}
+	if !hasContentType(response.Header.Get("Content-Type"), DOH_MESSAGE) {
+		return nil, fmt.Errorf("unexpected Content-Type %q from the target", response.Header.Get("Content-Type"))
+	}
+	return parseDnsResponse(response.Content)
+}
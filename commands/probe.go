@@ -0,0 +1,171 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"net/http"
+	"os"
+	"time"
+)
+
+// suiteProbeResult is the outcome of sending real queries sealed to one advertised config.
+type suiteProbeResult struct {
+	Version uint16 `json:"version"`
+	KemID   uint16 `json:"kemId"`
+	KdfID   uint16 `json:"kdfId"`
+	AeadID  uint16 `json:"aeadId"`
+	KeyID   string `json:"keyId,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Queries int    `json:"queries"`
+	// Mean durations over the successful queries, in milliseconds.
+	SealMs      float64 `json:"sealMs"`
+	OpenMs      float64 `json:"openMs"`
+	RoundTripMs float64 `json:"roundTripMs"`
+}
+
+func durationMs(total time.Duration, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total.Nanoseconds()) / float64(count) / 1e6
+}
+
+// probeConfig sends count queries sealed to the config and stops at the first failure.
+func probeConfig(config odoh.ObliviousDoHConfig, dnsQuery []byte, count int, useProxy bool, targetName string, proxy string, client *http.Client) suiteProbeResult {
+	suite := suiteOfConfig(config)
+	result := suiteProbeResult{
+		Version: config.Version,
+		KemID:   uint16(suite.KemID),
+		KdfID:   uint16(suite.KdfID),
+		AeadID:  uint16(suite.AeadID),
+		KeyID:   fmt.Sprintf("%x", config.Contents.KeyID()),
+		Status:  PROBE_OK,
+	}
+	if err := checkConfigSupported(config); err != nil {
+		result.Status = PROBE_UNSUPPORTED
+		result.Error = err.Error()
+		return result
+	}
+
+	var sealTime, openTime, roundTrip time.Duration
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		odohQuery, queryContext, err := createOdohQuestion(dnsQuery, config)
+		sealed := time.Now()
+		if err != nil {
+			result.Status, result.Error = PROBE_SEAL_FAILED, err.Error()
+			break
+		}
+
+		odohMessage, err := resolveObliviousQuery(odohQuery, useProxy, targetName, proxy, client)
+		received := time.Now()
+		if err != nil {
+			result.Status, result.Error = PROBE_EXCHANGE_FAILED, err.Error()
+			break
+		}
+
+		dnsResponse, err := validateEncryptedResponse(odohMessage, queryContext)
+		opened := time.Now()
+		if err != nil {
+			result.Status, result.Error = PROBE_OPEN_FAILED, err.Error()
+			break
+		}
+		if dnsResponse.Rcode != dns.RcodeSuccess {
+			result.Status, result.Error = PROBE_DNS_FAILED, dns.RcodeToString[dnsResponse.Rcode]
+			break
+		}
+
+		result.Queries++
+		sealTime += sealed.Sub(start)
+		roundTrip += received.Sub(sealed)
+		openTime += opened.Sub(received)
+	}
+	result.SealMs = durationMs(sealTime, result.Queries)
+	result.OpenMs = durationMs(openTime, result.Queries)
+	result.RoundTripMs = durationMs(roundTrip, result.Queries)
+	return result
+}
+
+// probeTargetSuites lists every config a target advertises and verifies each one with real queries.
+func probeTargetSuites(c *cli.Context) error {
+	targetName := c.String("target")
+	proxy := c.String("proxy")
+	count := c.Int("count")
+	if count < 1 {
+		count = 1
+	}
+
+	client, err := newProxyHTTPClient(c, proxy)
+	if err != nil {
+		return err
+	}
+
+	fetched, err := fetchRawTargetConfigs(targetName, c.String("source"))
+	if err != nil {
+		return err
+	}
+	rawConfigs, err := splitObliviousDoHConfigs(fetched.Raw)
+	if err != nil {
+		return err
+	}
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(dns.Fqdn(c.String("domain")), dnsQueryStringToType(c.String("dnstype")))
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		return err
+	}
+
+	results := make([]suiteProbeResult, 0, len(rawConfigs))
+	failures := 0
+	for _, rawConfig := range rawConfigs {
+		description := describeConfig(rawConfig)
+		contents, err := odoh.UnmarshalObliviousDoHConfigContents(rawConfig.Contents)
+		if err != nil || !description.Supported {
+			results = append(results, suiteProbeResult{
+				Version: description.Version,
+				KemID:   description.KemID,
+				KdfID:   description.KdfID,
+				AeadID:  description.AeadID,
+				KeyID:   description.KeyID,
+				Status:  PROBE_UNSUPPORTED,
+				Error:   description.Problem,
+			})
+			continue
+		}
+		config := odoh.ObliviousDoHConfig{Version: rawConfig.Version, Contents: contents}
+		result := probeConfig(config, packedDnsQuery, count, len(proxy) > 0, targetName, proxy, client)
+		if result.Status != PROBE_OK {
+			failures++
+		}
+		results = append(results, result)
+	}
+
+	if c.String("output") == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("HPKE suites of %s (source: %s):\n", targetName, fetched.Source)
+		for _, result := range results {
+			fmt.Printf("  Version(0x%04x), KEM(0x%04x), KDF(0x%04x), AEAD(0x%04x): %s", result.Version, result.KemID, result.KdfID, result.AeadID, result.Status)
+			if result.Status == PROBE_OK {
+				fmt.Printf(" (%d queries, seal %.3fms, open %.3fms, round trip %.3fms)", result.Queries, result.SealMs, result.OpenMs, result.RoundTripMs)
+			} else if len(result.Error) > 0 {
+				fmt.Printf(": %s", result.Error)
+			}
+			fmt.Println()
+		}
+	}
+
+	if failures > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of the HPKE suites advertised by %s failed", failures, targetName), 1)
+	}
+	return nil
+}
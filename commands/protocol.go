@@ -0,0 +1,452 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"strings"
+)
+
+// The vendored odoh-go speaks draft-pauly-dprive-oblivious-doh (config version 0xff02) only.
+// The functions below implement both that draft and the final RFC 9230 encoding, which differ in
+// the config version, the HPKE version and the derivation and AAD of the encrypted response.
+
+// odohVersionName returns a human readable name for an ObliviousDoHConfig version.
+func odohVersionName(version uint16) string {
+	switch version {
+	case ODOH_VERSION_DRAFT:
+		return "draft"
+	case ODOH_VERSION_RFC9230:
+		return "rfc9230"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+// parseOdohVersions maps the `--odoh-version` flag to the config versions the client may use, in
+// order of preference. "auto" accepts both and prefers RFC 9230 when a target publishes both.
+func parseOdohVersions(name string) ([]uint16, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		return []uint16{ODOH_VERSION_RFC9230, ODOH_VERSION_DRAFT}, nil
+	case "draft":
+		return []uint16{ODOH_VERSION_DRAFT}, nil
+	case "rfc9230", "rfc", "v1":
+		return []uint16{ODOH_VERSION_RFC9230}, nil
+	default:
+		return nil, fmt.Errorf("unknown ODoH version %q, expected auto, draft or rfc9230", name)
+	}
+}
+
+// odohVersionSelection holds the versions to use for each target, e.g. as parsed from
+// "auto" or "draft,odoh.example.net=rfc9230".
+type odohVersionSelection struct {
+	defaultVersions []uint16
+	targetVersions  map[string][]uint16
+}
+
+func parseOdohVersionSelection(selection string) (odohVersionSelection, error) {
+	result := odohVersionSelection{
+		targetVersions: make(map[string][]uint16),
+	}
+	defaultVersions, _ := parseOdohVersions("auto")
+	result.defaultVersions = defaultVersions
+
+	for _, entry := range strings.Split(selection, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if index := strings.LastIndex(entry, "="); index >= 0 {
+			versions, err := parseOdohVersions(entry[index+1:])
+			if err != nil {
+				return odohVersionSelection{}, err
+			}
+			result.targetVersions[entry[:index]] = versions
+		} else {
+			versions, err := parseOdohVersions(entry)
+			if err != nil {
+				return odohVersionSelection{}, err
+			}
+			result.defaultVersions = versions
+		}
+	}
+	return result, nil
+}
+
+func (s odohVersionSelection) versionsFor(target string) []uint16 {
+	if versions, ok := s.targetVersions[target]; ok {
+		return versions
+	}
+	return s.defaultVersions
+}
+
+// rawObliviousDoHConfig is a single entry of an ObliviousDoHConfigs list before its contents are interpreted.
+type rawObliviousDoHConfig struct {
+	Version  uint16
+	Contents []byte
+}
+
+func splitObliviousDoHConfigs(buffer []byte) ([]rawObliviousDoHConfig, error) {
+	if len(buffer) < 2 {
+		return nil, errors.New("Invalid ObliviousDoHConfigs encoding")
+	}
+	length := int(binary.BigEndian.Uint16(buffer))
+	if len(buffer[2:]) < length {
+		return nil, fmt.Errorf("Invalid ObliviousDoHConfigs encoding, expected %v bytes, got %v", length, len(buffer[2:]))
+	}
+
+	configs := make([]rawObliviousDoHConfig, 0)
+	remaining := buffer[2 : 2+length]
+	for len(remaining) > 0 {
+		if len(remaining) < 4 {
+			return nil, errors.New("Invalid ObliviousDoHConfig encoding")
+		}
+		version := binary.BigEndian.Uint16(remaining[0:])
+		configLength := int(binary.BigEndian.Uint16(remaining[2:]))
+		if len(remaining[4:]) < configLength {
+			return nil, fmt.Errorf("Invalid serialized ObliviousDoHConfig, expected %v bytes, got %v", configLength, len(remaining[4:]))
+		}
+		configs = append(configs, rawObliviousDoHConfig{
+			Version:  version,
+			Contents: remaining[4 : 4+configLength],
+		})
+		remaining = remaining[4+configLength:]
+	}
+	return configs, nil
+}
+
+// parseObliviousDoHConfigs replaces odoh.UnmarshalObliviousDoHConfigs, which drops every config
+// that is not of the draft version. Configs of unknown versions or with unusable contents are skipped.
+func parseObliviousDoHConfigs(buffer []byte) (odoh.ObliviousDoHConfigs, error) {
+	rawConfigs, err := splitObliviousDoHConfigs(buffer)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+
+	configs := make([]odoh.ObliviousDoHConfig, 0, len(rawConfigs))
+	for _, rawConfig := range rawConfigs {
+		if !isSupportedConfigVersion(rawConfig.Version) {
+			continue
+		}
+		contents, err := odoh.UnmarshalObliviousDoHConfigContents(rawConfig.Contents)
+		if err != nil {
+			continue
+		}
+		configs = append(configs, odoh.ObliviousDoHConfig{
+			Version:  rawConfig.Version,
+			Contents: contents,
+		})
+	}
+	return odoh.CreateObliviousDoHConfigs(configs), nil
+}
+
+func encodeLengthPrefixed(data []byte) []byte {
+	result := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(result, uint16(len(data)))
+	return append(result, data...)
+}
+
+func queryAAD(keyID []byte) []byte {
+	return append([]byte{byte(odoh.QueryType)}, encodeLengthPrefixed(keyID)...)
+}
+
+func setupQuerySender(version uint16, suite hpke.CipherSuite, publicKeyBytes []byte) ([]byte, hpkeSenderContext, error) {
+	if version == ODOH_VERSION_RFC9230 {
+		enc, ctx, err := setupBaseSenderV1(suite, rand.Reader, publicKeyBytes, []byte(odoh.ODOH_LABEL_QUERY))
+		if err != nil {
+			return nil, nil, err
+		}
+		return enc, ctx, nil
+	}
+
+	pkR, err := suite.KEM.Deserialize(publicKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, ctx, err := hpke.SetupBaseS(suite, rand.Reader, pkR, []byte(odoh.ODOH_LABEL_QUERY))
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// odohQueryContext is what a client keeps after sealing a query in order to open the answer, and what
+// a target keeps after opening a query in order to seal the answer.
+type odohQueryContext struct {
+	Version uint16
+	Suite   hpkeSuite
+	// Query is the serialized ObliviousDoHMessagePlaintext that was sealed.
+	Query []byte
+	// Secret is exported from the HPKE context, "odoh secret" for the draft and "odoh response" for RFC 9230.
+	Secret []byte
+}
+
+// sealQuery encrypts an ObliviousDoHMessagePlaintext to the config, following the config's version.
+func sealQuery(query *odoh.ObliviousDNSQuery, config odoh.ObliviousDoHConfig) (odoh.ObliviousDNSMessage, odohQueryContext, error) {
+	if !isSupportedConfigVersion(config.Version) {
+		return odoh.ObliviousDNSMessage{}, odohQueryContext{}, fmt.Errorf("unsupported ObliviousDoHConfig version 0x%04x", config.Version)
+	}
+	suite, err := config.Contents.CipherSuite()
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, odohQueryContext{}, err
+	}
+
+	enc, ctx, err := setupQuerySender(config.Version, suite, config.Contents.PublicKeyBytes)
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, odohQueryContext{}, err
+	}
+
+	keyID := config.Contents.KeyID()
+	plaintext := query.Marshal()
+	ct := ctx.Seal(queryAAD(keyID), plaintext)
+
+	var secret []byte
+	if config.Version == ODOH_VERSION_RFC9230 {
+		secret = ctx.Export([]byte(ODOH_LABEL_RESPONSE), suite.AEAD.KeySize())
+	} else {
+		secret = ctx.Export([]byte(odoh.ODOH_LABEL_SECRET), odoh.ODOH_SECRET_LENGTH)
+	}
+
+	message := odoh.ObliviousDNSMessage{
+		MessageType:      odoh.QueryType,
+		KeyID:            keyID,
+		EncryptedMessage: append(enc, ct...),
+	}
+	return message, odohQueryContext{
+		Version: config.Version,
+		Suite:   suiteOfConfig(config),
+		Query:   plaintext,
+		Secret:  secret,
+	}, nil
+}
+
+// responseKeyAndNonce derives the AEAD key, nonce and AAD protecting a response. For RFC 9230 the
+// response nonce is carried in the key_id field of the response message; the draft uses none.
+func responseKeyAndNonce(version uint16, suite hpke.CipherSuite, query []byte, secret []byte, responseNonce []byte) ([]byte, []byte, []byte) {
+	aad := append([]byte{byte(odoh.ResponseType)}, encodeLengthPrefixed(responseNonce)...)
+	salt := query
+	if version == ODOH_VERSION_RFC9230 {
+		salt = append(append([]byte{}, query...), encodeLengthPrefixed(responseNonce)...)
+	}
+	prk := suite.KDF.Extract(salt, secret)
+	key := suite.KDF.Expand(prk, []byte(odoh.ODOH_LABEL_KEY), suite.AEAD.KeySize())
+	nonce := suite.KDF.Expand(prk, []byte(odoh.ODOH_LABEL_NONCE), suite.AEAD.NonceSize())
+	return key, nonce, aad
+}
+
+func isZeroPadding(padding []byte) bool {
+	validPadding := 1
+	for _, v := range padding {
+		validPadding &= subtle.ConstantTimeByteEq(v, odoh.ODOH_PADDING_BYTE)
+	}
+	return validPadding == 1
+}
+
+// decodeLengthPrefixed reads an opaque<0..2^16-1> field. Unlike the odoh-go codec it computes the
+// bounds with ints, so a length of 0xffff cannot wrap around.
+func decodeLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated length prefix")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data[2:]) < length {
+		return nil, nil, fmt.Errorf("truncated field, expected %d bytes, got %d", length, len(data[2:]))
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+func unmarshalMessageBody(data []byte) (odoh.ObliviousDNSMessageBody, error) {
+	dnsMessage, rest, err := decodeLengthPrefixed(data)
+	if err != nil {
+		return odoh.ObliviousDNSMessageBody{}, fmt.Errorf("Invalid DNS message length: %v", err)
+	}
+	padding, _, err := decodeLengthPrefixed(rest)
+	if err != nil {
+		return odoh.ObliviousDNSMessageBody{}, fmt.Errorf("Invalid DNS padding length: %v", err)
+	}
+	if !isZeroPadding(padding) {
+		return odoh.ObliviousDNSMessageBody{}, errors.New("invalid padding")
+	}
+	return odoh.ObliviousDNSMessageBody{DnsMessage: dnsMessage, Padding: padding}, nil
+}
+
+// unmarshalObliviousMessage parses an ObliviousDoHMessage received from an untrusted peer.
+func unmarshalObliviousMessage(data []byte) (odoh.ObliviousDNSMessage, error) {
+	if len(data) < 1 {
+		return odoh.ObliviousDNSMessage{}, errors.New("empty ObliviousDoHMessage")
+	}
+	keyID, rest, err := decodeLengthPrefixed(data[1:])
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, fmt.Errorf("invalid key_id: %v", err)
+	}
+	encryptedMessage, rest, err := decodeLengthPrefixed(rest)
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, fmt.Errorf("invalid encrypted_message: %v", err)
+	}
+	if len(rest) != 0 {
+		return odoh.ObliviousDNSMessage{}, fmt.Errorf("%d trailing bytes after the ObliviousDoHMessage", len(rest))
+	}
+	return odoh.ObliviousDNSMessage{
+		MessageType:      odoh.ObliviousMessageType(data[0]),
+		KeyID:            keyID,
+		EncryptedMessage: encryptedMessage,
+	}, nil
+}
+
+// OpenAnswer decrypts the target's response and returns the DNS message it carries.
+func (c odohQueryContext) OpenAnswer(message odoh.ObliviousDNSMessage) ([]byte, error) {
+	if message.MessageType != odoh.ResponseType {
+		return nil, errors.New("message is not a response")
+	}
+	suite, err := hpke.AssembleCipherSuite(c.Suite.KemID, c.Suite.KdfID, c.Suite.AeadID)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseNonce []byte
+	if c.Version == ODOH_VERSION_RFC9230 {
+		responseNonce = message.KeyID
+	} else if len(message.KeyID) != 0 {
+		return nil, errors.New("unexpected key_id in draft response")
+	}
+
+	key, nonce, aad := responseKeyAndNonce(c.Version, suite, c.Query, c.Secret, responseNonce)
+	aead, err := suite.AEAD.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, message.EncryptedMessage, aad)
+	if err != nil {
+		return nil, errors.New("unable to decrypt the obtained response using the symmetric key sent")
+	}
+
+	body, err := unmarshalMessageBody(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return body.DnsMessage, nil
+}
+
+func setupQueryReceiver(version uint16, suite hpke.CipherSuite, privateKeyBytes []byte, enc []byte) (hpkeReceiverContext, error) {
+	if version == ODOH_VERSION_RFC9230 {
+		ctx, err := setupBaseReceiverV1(suite, privateKeyBytes, enc, []byte(odoh.ODOH_LABEL_QUERY))
+		if err != nil {
+			return nil, err
+		}
+		return ctx, nil
+	}
+
+	skR, err := suite.KEM.DeserializePrivate(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := hpke.SetupBaseR(suite, skR, enc, []byte(odoh.ODOH_LABEL_QUERY))
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// errUnknownKeyID is returned by openQuery when no key matches the key_id of the query.
+var errUnknownKeyID = errors.New("unknown key_id")
+
+// openQuery decrypts a query with whichever of the keys it was sealed to, and returns the context the
+// target needs to seal the answer. The same key may be published in both versions, so every key with
+// a matching key_id is tried.
+func openQuery(message odoh.ObliviousDNSMessage, keys []mintedKey) (*odoh.ObliviousDNSQuery, odohQueryContext, error) {
+	if message.MessageType != odoh.QueryType {
+		return nil, odohQueryContext{}, errors.New("message is not a query")
+	}
+
+	err := errUnknownKeyID
+	for _, key := range keys {
+		if !bytes.Equal(key.Config.Contents.KeyID(), message.KeyID) {
+			continue
+		}
+		var query *odoh.ObliviousDNSQuery
+		var queryContext odohQueryContext
+		query, queryContext, err = openQueryWithKey(message, key)
+		if err == nil {
+			return query, queryContext, nil
+		}
+	}
+	return nil, odohQueryContext{}, err
+}
+
+func openQueryWithKey(message odoh.ObliviousDNSMessage, key mintedKey) (*odoh.ObliviousDNSQuery, odohQueryContext, error) {
+	suite, err := key.Config.Contents.CipherSuite()
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	encSize := suite.KEM.PublicKeySize()
+	if len(message.EncryptedMessage) < encSize {
+		return nil, odohQueryContext{}, errors.New("encrypted query too short")
+	}
+	enc := message.EncryptedMessage[:encSize]
+	ct := message.EncryptedMessage[encSize:]
+
+	ctx, err := setupQueryReceiver(key.Config.Version, suite, key.PrivateKey, enc)
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	plaintext, err := ctx.Open(queryAAD(message.KeyID), ct)
+	if err != nil {
+		return nil, odohQueryContext{}, errors.New("unable to decrypt the query")
+	}
+	body, err := unmarshalMessageBody(plaintext)
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+
+	var secret []byte
+	if key.Config.Version == ODOH_VERSION_RFC9230 {
+		secret = ctx.Export([]byte(ODOH_LABEL_RESPONSE), suite.AEAD.KeySize())
+	} else {
+		secret = ctx.Export([]byte(odoh.ODOH_LABEL_SECRET), odoh.ODOH_SECRET_LENGTH)
+	}
+
+	return &odoh.ObliviousDNSQuery{ObliviousDNSMessageBody: body}, odohQueryContext{
+		Version: key.Config.Version,
+		Suite:   suiteOfConfig(key.Config),
+		Query:   plaintext,
+		Secret:  secret,
+	}, nil
+}
+
+// SealAnswer encrypts a DNS response to the client that sent the query, as a target does.
+func (c odohQueryContext) SealAnswer(dnsMessage []byte, paddingBytes uint16) (odoh.ObliviousDNSMessage, error) {
+	suite, err := hpke.AssembleCipherSuite(c.Suite.KemID, c.Suite.KdfID, c.Suite.AeadID)
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, err
+	}
+
+	var responseNonce []byte
+	if c.Version == ODOH_VERSION_RFC9230 {
+		nonceSize := suite.AEAD.KeySize()
+		if suite.AEAD.NonceSize() > nonceSize {
+			nonceSize = suite.AEAD.NonceSize()
+		}
+		responseNonce = make([]byte, nonceSize)
+		if _, err := rand.Read(responseNonce); err != nil {
+			return odoh.ObliviousDNSMessage{}, err
+		}
+	}
+
+	key, nonce, aad := responseKeyAndNonce(c.Version, suite, c.Query, c.Secret, responseNonce)
+	aead, err := suite.AEAD.New(key)
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, err
+	}
+	response := odoh.CreateObliviousDNSResponse(dnsMessage, paddingBytes)
+	return odoh.ObliviousDNSMessage{
+		MessageType:      odoh.ResponseType,
+		KeyID:            responseNonce,
+		EncryptedMessage: aead.Seal(nil, nonce, response.Marshal(), aad),
+	}, nil
+}
@@ -0,0 +1,274 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// odohProxy relays ODoH messages between clients and targets, as prepareHttpRequest expects: a POST
+// to /proxy with the target in the targethost and targetpath query parameters. A GET of
+// /.well-known/odohconfigs is relayed too. Oblivious HTTP requests are relayed the same way on
+// /ohttp-relay.
+type odohProxy struct {
+	client *http.Client
+	// allowedTargets restricts the targets the proxy forwards to; any public target is allowed if empty.
+	allowedTargets map[string]bool
+}
+
+// nonPublicNetworks are the networks an open proxy must not let clients reach: loopback, private,
+// shared, link-local and unique local addresses such as the metadata service at 169.254.169.254,
+// the NAT64 prefixes, which embed IPv4 addresses, and the benchmarking, IETF protocol assignment,
+// documentation, multicast and reserved ranges.
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24",
+	"192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// refuseNonPublicAddress is a net.Dialer Control function refusing to connect to non-public
+// addresses. It sees the address after name resolution, so a name cannot lead to them either.
+func refuseNonPublicAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected address %q", address)
+	}
+	// Check IPv4-mapped IPv6 addresses, ::ffff:0:0/96, as the IPv4 address they carry.
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	for _, nonPublic := range nonPublicNetworks {
+		if nonPublic.Contains(ip) {
+			return fmt.Errorf("refusing to forward to the non-public address %v, allow the target with --allow-target", ip)
+		}
+	}
+	return nil
+}
+
+// newOdohProxy returns a proxy forwarding to the allowed targets over the transport. Without
+// allowed targets, it forwards to any target with a public address.
+func newOdohProxy(transport http.RoundTripper, timeout time.Duration, allowedTargets []string) (*odohProxy, error) {
+	proxy := &odohProxy{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			// The client chose the target, so never follow a redirect elsewhere.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		allowedTargets: make(map[string]bool),
+	}
+	for _, target := range allowedTargets {
+		proxy.allowedTargets[strings.ToLower(target)] = true
+	}
+	if len(proxy.allowedTargets) > 0 {
+		return proxy, nil
+	}
+
+	base, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("forwarding to public targets only needs an http.Transport")
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second, Control: refuseNonPublicAddress}
+	public := base.Clone()
+	// A proxy from the environment would connect to the target out of reach of the check.
+	public.Proxy = nil
+	public.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	proxy.client.Transport = public
+	return proxy, nil
+}
+
+func (p *odohProxy) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy", p.proxyHandler)
+	mux.HandleFunc("/ohttp-relay", p.relayHandler)
+	return mux
+}
+
+// targetURL validates the targethost and targetpath query parameters of a proxied request.
+func (p *odohProxy) targetURL(query url.Values) (*url.URL, error) {
+	targetHost := query.Get("targethost")
+	targetPath := query.Get("targetpath")
+	if len(targetHost) == 0 || len(targetPath) == 0 {
+		return nil, fmt.Errorf("missing targethost or targetpath")
+	}
+	if strings.ContainsAny(targetHost, "/@?#") {
+		return nil, fmt.Errorf("invalid targethost %q", targetHost)
+	}
+	if !strings.HasPrefix(targetPath, "/") || strings.ContainsAny(targetPath, "?#") {
+		return nil, fmt.Errorf("invalid targetpath %q", targetPath)
+	}
+	if len(p.allowedTargets) > 0 && !p.allowedTargets[strings.ToLower(targetHost)] {
+		return nil, fmt.Errorf("target %q is not allowed", targetHost)
+	}
+	return &url.URL{Scheme: TARGET_HTTP_MODE, Host: targetHost, Path: targetPath}, nil
+}
+
+func (p *odohProxy) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Query().Get("targetpath") == ODOH_CONFIG_WELLKNOWN_URL {
+		p.forwardConfigs(w, r)
+		return
+	}
+	p.forward(w, r, OBLIVIOUS_DOH, OBLIVIOUS_DOH)
+}
+
+// forwardConfigs relays a GET of the well-known configs of the target, which lets clients compare
+// the configs the target hands out to them with those it hands out to anonymous clients.
+func (p *odohProxy) forwardConfigs(w http.ResponseWriter, r *http.Request) {
+	targetURL, err := p.targetURL(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, targetURL.String(), nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("User-Agent", "")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("unable to reach target %v: %v", targetURL.Host, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer closeBody(resp.Body)
+	responseBody, err := readLimitedBody(resp.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	for _, name := range []string{"Content-Type", "Cache-Control"} {
+		if value := resp.Header.Get(name); len(value) > 0 {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(responseBody)
+}
+
+// relayHandler relays Oblivious HTTP requests to the gateway given as for /proxy, which is how
+// `odoh --protocol ohttp` addresses a gateway through a proxy.
+func (p *odohProxy) relayHandler(w http.ResponseWriter, r *http.Request) {
+	p.forward(w, r, OHTTP_REQUEST, OHTTP_RESPONSE)
+}
+
+// forward posts the request body to the target of the query parameters and relays the answer.
+func (p *odohProxy) forward(w http.ResponseWriter, r *http.Request, contentType string, accept string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasContentType(r.Header.Get("Content-Type"), contentType) {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	targetURL, err := p.targetURL(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := readLimitedBody(r.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Only the message and its media type reach the target, nothing that identifies the client.
+	req, err := http.NewRequest(http.MethodPost, targetURL.String(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("unable to reach target %v: %v", targetURL.Host, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer closeBody(resp.Body)
+	responseBody, err := readLimitedBody(resp.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); len(contentType) > 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(responseBody)
+}
+
+func runProxy(c *cli.Context) error {
+	proxy, err := newOdohProxy(httpTransport, c.Duration("target-timeout"), c.StringSlice("allow-target"))
+	if err != nil {
+		return err
+	}
+	if len(proxy.allowedTargets) == 0 {
+		log.Printf("Forwarding to any target with a public address, pass --allow-target to restrict the targets")
+	}
+
+	listen := c.String("listen")
+	server := &http.Server{
+		Addr:         listen,
+		Handler:      proxy.handler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: c.Duration("target-timeout") + 10*time.Second,
+	}
+
+	if len(c.String("cert")) > 0 || len(c.String("key")) > 0 {
+		certificate, err := tls.LoadX509KeyPair(c.String("cert"), c.String("key"))
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		fmt.Fprintf(os.Stderr, "ODoH proxy listening on https://%v/proxy\n", listen)
+		return server.ListenAndServeTLS("", "")
+	}
+
+	if host, _, err := net.SplitHostPort(listen); err == nil {
+		if ip := net.ParseIP(host); (ip == nil && host != "localhost") || (ip != nil && !ip.IsLoopback()) {
+			log.Printf("Serving the proxy over plain HTTP on a non-loopback address, pass --cert and --key for HTTPS")
+		}
+	}
+	fmt.Fprintf(os.Stderr, "ODoH proxy listening on http://%v/proxy\n", listen)
+	return server.ListenAndServe()
+}
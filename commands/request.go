@@ -2,25 +2,26 @@ package commands
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	odoh "github.com/cloudflare/odoh-go"
 	"github.com/miekg/dns"
 	"github.com/urfave/cli"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"time"
 )
 
 func createPlainQueryResponse(hostname string, serializedDnsQueryString []byte) (response *dns.Msg, err error) {
-	client := http.Client{}
+	client := newHTTPClient()
 	queryUrl := fmt.Sprintf(TARGET_HTTP_MODE+"://%s/dns-query", hostname)
 	req, err := http.NewRequest(http.MethodGet, queryUrl, nil)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
 	queries := req.URL.Query()
@@ -31,16 +32,15 @@ func createPlainQueryResponse(hostname string, serializedDnsQueryString []byte)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
+	defer closeBody(resp.Body)
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	bodyBytes, err := readResponse(resp, DOH_MESSAGE, MAX_OBLIVIOUS_MESSAGE_SIZE)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	dnsBytes, err := parseDnsResponse(bodyBytes)
-
-	return dnsBytes, nil
+	return parseDnsResponse(bodyBytes)
 }
 
 func prepareHttpRequest(serializedBody []byte, useProxy bool, targetIP string, proxy string) (req *http.Request, err error) {
@@ -52,7 +52,7 @@ func prepareHttpRequest(serializedBody []byte, useProxy bool, targetIP string, p
 		req, err = http.NewRequest(http.MethodPost, baseurl, bytes.NewBuffer(serializedBody))
 		queries = req.URL.Query()
 	} else {
-		baseurl = fmt.Sprintf("%s://%s/%s", PROXY_HTTP_MODE, proxy, "proxy")
+		baseurl = fmt.Sprintf("%s/%s", proxyBaseURL(proxy), "proxy")
 		req, err = http.NewRequest(http.MethodPost, baseurl, bytes.NewBuffer(serializedBody))
 		queries = req.URL.Query()
 		queries.Add("targethost", targetIP)
@@ -60,36 +60,39 @@ func prepareHttpRequest(serializedBody []byte, useProxy bool, targetIP string, p
 	}
 
 	req.Header.Set("Content-Type", "application/oblivious-dns-message")
+	req.Header.Set("Accept", OBLIVIOUS_DOH)
 	req.URL.RawQuery = queries.Encode()
 
 	return req, err
 }
 
 func resolveObliviousQuery(query odoh.ObliviousDNSMessage, useProxy bool, targetIP string, proxy string, client *http.Client) (response odoh.ObliviousDNSMessage, err error) {
+	return resolveObliviousQueryWithContext(context.Background(), query, useProxy, targetIP, proxy, client)
+}
+
+// resolveObliviousQueryWithContext is resolveObliviousQuery with a request context, e.g. carrying an httptrace.ClientTrace.
+func resolveObliviousQueryWithContext(ctx context.Context, query odoh.ObliviousDNSMessage, useProxy bool, targetIP string, proxy string, client *http.Client) (response odoh.ObliviousDNSMessage, err error) {
 	serializedQuery := query.Marshal()
 	req, err := prepareHttpRequest(serializedQuery, useProxy, targetIP, proxy)
 	if err != nil {
 		return odoh.ObliviousDNSMessage{}, err
 	}
+	req = req.WithContext(ctx)
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return odoh.ObliviousDNSMessage{}, err
 	}
+	defer closeBody(resp.Body)
 
-	responseHeader := resp.Header.Get("Content-Type")
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-
+	bodyBytes, err := readResponse(resp, OBLIVIOUS_DOH, MAX_OBLIVIOUS_MESSAGE_SIZE)
 	if err != nil {
 		return odoh.ObliviousDNSMessage{}, err
 	}
-	if responseHeader != OBLIVIOUS_DOH {
-		return odoh.ObliviousDNSMessage{}, errors.New(fmt.Sprintf("Did not obtain the correct headers from %v with response %v", targetIP, string(bodyBytes)))
-	}
 
-	odohQueryResponse, err := odoh.UnmarshalDNSMessage(bodyBytes)
+	odohQueryResponse, err := unmarshalObliviousMessage(bodyBytes)
 	if err != nil {
-		return odoh.ObliviousDNSMessage{}, err
+		return odoh.ObliviousDNSMessage{}, fmt.Errorf("invalid response from %v: %v", targetIP, err)
 	}
 
 	return odohQueryResponse, nil
@@ -98,19 +101,22 @@ func resolveObliviousQuery(query odoh.ObliviousDNSMessage, useProxy bool, target
 func fetchProxiesAndTargets(hostname string, client *http.Client) (response DiscoveryServiceResponse, err error) {
 	req, err := http.NewRequest(http.MethodGet, TARGET_HTTP_MODE+"://"+hostname, nil)
 	if err != nil {
-		log.Fatalf("Unable to discover the proxies and targets")
+		return DiscoveryServiceResponse{}, fmt.Errorf("Unable to discover the proxies and targets: %v", err)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Unable to obtain a response from the discovery service")
+		return DiscoveryServiceResponse{}, fmt.Errorf("Unable to obtain a response from the discovery service: %v", err)
 	}
-	defer resp.Body.Close()
+	defer closeBody(resp.Body)
 
+	bodyBytes, err := readResponse(resp, "", MAX_DISCOVERY_SIZE)
+	if err != nil {
+		return DiscoveryServiceResponse{}, fmt.Errorf("Unable to obtain a response from the discovery service: %v", err)
+	}
 	var data DiscoveryServiceResponse
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
+	err = json.Unmarshal(bodyBytes, &data)
 	if err != nil {
-		log.Fatalf("Unable to decode the obtained JSON response from the Discovery service %v\n", err)
+		return DiscoveryServiceResponse{}, fmt.Errorf("Unable to decode the obtained JSON response from the Discovery service: %v", err)
 	}
 	return data, nil
 }
@@ -138,56 +144,260 @@ func plainDnsRequest(c *cli.Context) error {
 }
 
 func obliviousDnsRequest(c *cli.Context) error {
+	restore, err := useOutboundProxies(c)
+	defer restore()
+	if err != nil {
+		return err
+	}
+
+	switch c.String("resolution") {
+	case "", RESOLUTION_SINGLE:
+	case RESOLUTION_RACE, RESOLUTION_MAJORITY:
+		return crossCheckRequest(c)
+	default:
+		return fmt.Errorf("unknown resolution %q, expected %s, %s or %s", c.String("resolution"), RESOLUTION_SINGLE, RESOLUTION_RACE, RESOLUTION_MAJORITY)
+	}
+
+	switch c.String("protocol") {
+	case PROTOCOL_ODOH:
+	case PROTOCOL_OHTTP:
+		return obliviousHTTPRequest(c)
+	default:
+		return fmt.Errorf("unknown protocol %q, expected %s or %s", c.String("protocol"), PROTOCOL_ODOH, PROTOCOL_OHTTP)
+	}
+
 	domainName := c.String("domain")
 	dnsTypeString := c.String("dnstype")
-	targetName := c.String("target")
 	proxy := c.String("proxy")
+	targetName, shard, err := queryTarget(c, domainName)
+	if err != nil {
+		return err
+	}
 
 	var useproxy bool
 	if len(proxy) > 0 {
 		useproxy = true
 	}
 
-	odohConfigs, err := fetchTargetConfigs(targetName)
+	suitePreference, err := parseSuitePreference(c.String("suites"))
+	if err != nil {
+		return err
+	}
+	versions, err := parseOdohVersions(c.String("odoh-version"))
+	if err != nil {
+		return err
+	}
+
+	client, err := newProxyHTTPClient(c, proxy)
+	if err != nil {
+		return err
+	}
+	timing, err := newTimingPolicy(c)
+	if err != nil {
+		return err
+	}
+	cover, err := newCoverTrafficFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	trace := &odohTrace{Timing: timing, Shard: shard}
+	ctx := context.Background()
+	if c.Bool("trace") {
+		ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	}
+
+	fetchStart := time.Now()
+	agreed, err := checkKeyConsistency(c, targetName, proxy)
+	if err != nil {
+		return err
+	}
+	var fetched fetchedTargetConfigs
+	if agreed != nil {
+		fetched = *agreed
+	} else if fetched, err = fetchRawTargetConfigs(targetName, c.String("config-source")); err != nil {
+		return err
+	}
+	trace.ConfigFetch = time.Since(fetchStart)
+	trace.ConfigSource = fetched.Source
+	trace.ConfigTTL = fetched.TTL
+	odohConfigs, err := fetched.parse()
 	if err != nil {
 		return err
 	}
-	odohConfig := odohConfigs.Configs[0]
 
 	dnsType := dnsQueryStringToType(dnsTypeString)
 
 	dnsQuery := new(dns.Msg)
 	dnsQuery.SetQuestion(domainName, dnsType)
+	if cover != nil {
+		if err := padDnsQuery(dnsQuery); err != nil {
+			return err
+		}
+	}
 	packedDnsQuery, err := dnsQuery.Pack()
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
 
-	odohQuery, queryContext, err := createOdohQuestion(packedDnsQuery, odohConfig.Contents)
+	usableConfigs := orderConfigs(odohConfigs, versions, suitePreference)
+	sealStart := time.Now()
+	odohQuery, queryContext, _, err := createOdohQuestionWithConfigs(packedDnsQuery, usableConfigs)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-
-	client := http.Client{}
-	odohMessage, err := resolveObliviousQuery(odohQuery, useproxy, targetName, proxy, &client)
+	trace.Seal = time.Since(sealStart)
+	trace.Version = queryContext.Version
+	trace.Suite = queryContext.Suite
+	trace.QuerySize = len(odohQuery.Marshal())
+
+	var decoys []func()
+	if cover != nil {
+		for _, decoy := range cover.decoyDomains() {
+			decoys = append(decoys, odohDecoy(decoy, dnsType, usableConfigs, useproxy, targetName, proxy, client))
+		}
+	}
+	trace.Decoys = len(decoys)
+
+	var odohMessage odoh.ObliviousDNSMessage
+	trace.TimingDelay = scheduleQuery(timing, func() {
+		exchangeStart := time.Now()
+		odohMessage, err = resolveObliviousQueryWithContext(ctx, odohQuery, useproxy, targetName, proxy, client)
+		trace.Exchange = time.Since(exchangeStart)
+	}, decoys)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
+	trace.ResponseSize = len(odohMessage.Marshal())
 
+	openStart := time.Now()
 	dnsResponse, err := validateEncryptedResponse(odohMessage, queryContext)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
+	trace.Open = time.Since(openStart)
+	if c.BoolT("strict") {
+		if trace.Scrubbed, err = validateDnsResponse(dnsQuery, dnsResponse); err != nil {
+			return err
+		}
+	}
 
 	fmt.Println(dnsResponse)
+	if c.Bool("trace") {
+		trace.print(os.Stdout)
+	}
+	return nil
+}
+
+// obliviousHTTPRequest resolves the query with DoH over Oblivious HTTP for `odoh --protocol ohttp`,
+// sending it through the relay or the proxy when one is given.
+func obliviousHTTPRequest(c *cli.Context) error {
+	targetName, shard, err := queryTarget(c, c.String("domain"))
+	if err != nil {
+		return err
+	}
+	gatewayURL := c.String("gateway")
+	if len(gatewayURL) == 0 {
+		gatewayURL = ohttpGatewayURL(targetName)
+	}
+	relayURL, err := ohttpRelayURL(c.String("relay"), c.String("proxy"), gatewayURL)
+	if err != nil {
+		return err
+	}
+
+	timing, err := newTimingPolicy(c)
+	if err != nil {
+		return err
+	}
+	cover, err := newCoverTrafficFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	trace := &odohTrace{Protocol: PROTOCOL_OHTTP, Timing: timing, Shard: shard}
+	ctx := context.Background()
+	if c.Bool("trace") {
+		ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	}
+	client, err := newProxyHTTPClient(c, c.String("proxy"), c.String("relay"))
+	if err != nil {
+		return err
+	}
+
+	fetchStart := time.Now()
+	keyConfigs, err := fetchOHTTPKeyConfigs(gatewayURL, client)
+	if err != nil {
+		return err
+	}
+	trace.ConfigFetch = time.Since(fetchStart)
+	trace.ConfigSource = gatewayURL
+
+	dnsType := dnsQueryStringToType(c.String("dnstype"))
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(c.String("domain"), dnsType)
+	if cover != nil {
+		if err := padDnsQuery(dnsQuery); err != nil {
+			return err
+		}
+	}
+	packedDnsQuery, err := dnsQuery.Pack()
+	if err != nil {
+		return err
+	}
+
+	sealStart := time.Now()
+	encapsulated, requestContext, err := sealOHTTPQueryWithConfigs(packedDnsQuery, targetName, keyConfigs)
+	if err != nil {
+		return err
+	}
+	trace.Seal = time.Since(sealStart)
+	trace.KeyID = requestContext.KeyID
+	trace.Suite = requestContext.Suite
+	trace.QuerySize = len(encapsulated)
+
+	var decoys []func()
+	if cover != nil {
+		for _, decoy := range cover.decoyDomains() {
+			decoys = append(decoys, ohttpDecoy(decoy, dnsType, targetName, keyConfigs, relayURL, client))
+		}
+	}
+	trace.Decoys = len(decoys)
+
+	var encapsulatedResponse []byte
+	trace.TimingDelay = scheduleQuery(timing, func() {
+		exchangeStart := time.Now()
+		encapsulatedResponse, err = exchangeOHTTP(ctx, encapsulated, relayURL, client)
+		trace.Exchange = time.Since(exchangeStart)
+	}, decoys)
+	if err != nil {
+		return err
+	}
+	trace.ResponseSize = len(encapsulatedResponse)
+
+	openStart := time.Now()
+	dnsResponse, err := openOHTTPAnswer(encapsulatedResponse, requestContext)
+	if err != nil {
+		return err
+	}
+	trace.Open = time.Since(openStart)
+	if c.BoolT("strict") {
+		if trace.Scrubbed, err = validateDnsResponse(dnsQuery, dnsResponse); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(dnsResponse)
+	if c.Bool("trace") {
+		trace.print(os.Stdout)
+	}
 	return nil
 }
 
-func validateEncryptedResponse(message odoh.ObliviousDNSMessage, queryContext odoh.QueryContext) (response *dns.Msg, err error) {
+func validateEncryptedResponse(message odoh.ObliviousDNSMessage, queryContext odohQueryContext) (response *dns.Msg, err error) {
 	decryptedResponse, err := queryContext.OpenAnswer(message)
 	if err != nil {
 		return nil, err
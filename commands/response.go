@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Every HTTP response the client reads goes through readResponse: the status must be 200, the
+// media type the expected one whatever its parameters, and the body no larger than the limit. The
+// body is closed with closeBody, which drains what is left of it so that the connection can be
+// reused instead of leaking.
+
+// httpStatusError reports a response with a status other than 200, with the start of its body,
+// which usually explains the failure.
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	message := fmt.Sprintf("%s answered with status %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if len(e.Body) > 0 {
+		message += ": " + e.Body
+	}
+	return message
+}
+
+// closeBody drains at most HTTP_DRAIN_SIZE bytes of the body before closing it. A larger remainder
+// is not worth reading, and the connection is dropped instead.
+func closeBody(body io.ReadCloser) {
+	io.CopyN(ioutil.Discard, body, HTTP_DRAIN_SIZE)
+	body.Close()
+}
+
+// readResponse reads the body of a 200 response of the content type, or of any type if contentType
+// is empty, up to limit bytes. It does not close the body.
+func readResponse(resp *http.Response, contentType string, limit int64) ([]byte, error) {
+	url := "the server"
+	if resp.Request != nil && resp.Request.URL != nil {
+		url = resp.Request.URL.Scheme + "://" + resp.Request.URL.Host + resp.Request.URL.Path
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, HTTP_ERROR_BODY_SIZE))
+		return nil, &httpStatusError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(strings.ToValidUTF8(string(body), "?")),
+		}
+	}
+	if len(contentType) > 0 && !hasContentType(resp.Header.Get("Content-Type"), contentType) {
+		return nil, fmt.Errorf("unexpected Content-Type %q from %s, expected %s", resp.Header.Get("Content-Type"), url, contentType)
+	}
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("response of %d bytes from %s is larger than %d bytes", resp.ContentLength, url, limit)
+	}
+	body, err := readLimitedBody(resp.Body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the response from %s: %v", url, err)
+	}
+	return body, nil
+}
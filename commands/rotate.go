@@ -0,0 +1,351 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// A key moves through the keyring as follows:
+// 1. next     => minted and pre-published next to the active key, accepted by the target.
+// 2. active   => the key clients are expected to use; published first.
+// 3. retiring => no longer published, but still accepted until every cached config has expired.
+// 4. retired  => neither published nor accepted; the private key is erased.
+// The waits between the stages count from when publish first emitted the configs with the key, and
+// the first configs without it, as clients can only cache what was actually published.
+const (
+	KEY_STATE_NEXT     = "next"
+	KEY_STATE_ACTIVE   = "active"
+	KEY_STATE_RETIRING = "retiring"
+	KEY_STATE_RETIRED  = "retired"
+)
+
+type keyringEntry struct {
+	State       string    `json:"state"`
+	Version     uint16    `json:"version"`
+	KemID       uint16    `json:"kemId"`
+	KdfID       uint16    `json:"kdfId"`
+	AeadID      uint16    `json:"aeadId"`
+	KeyID       string    `json:"keyId"`
+	PublicKey   string    `json:"publicKey"`
+	PrivateKey  string    `json:"privateKey,omitempty"`
+	Created     time.Time `json:"created"`
+	Published   time.Time `json:"published"`
+	Activated   time.Time `json:"activated"`
+	Deactivated time.Time `json:"deactivated"`
+	Unpublished time.Time `json:"unpublished"`
+	Retired     time.Time `json:"retired"`
+}
+
+// keyring is the local state of a target operator's ODoH keys.
+type keyring struct {
+	// MaxTTL bounds how long clients may cache published configs, in seconds.
+	MaxTTL uint32         `json:"maxTtl"`
+	Keys   []keyringEntry `json:"keys"`
+}
+
+func newKeyringEntry(key mintedKey, state string, now time.Time) keyringEntry {
+	return keyringEntry{
+		State:      state,
+		Version:    key.Config.Version,
+		KemID:      uint16(key.Config.Contents.KemID),
+		KdfID:      uint16(key.Config.Contents.KdfID),
+		AeadID:     uint16(key.Config.Contents.AeadID),
+		KeyID:      hex.EncodeToString(key.Config.Contents.KeyID()),
+		PublicKey:  hex.EncodeToString(key.Config.Contents.PublicKeyBytes),
+		PrivateKey: hex.EncodeToString(key.PrivateKey),
+		Created:    now,
+	}
+}
+
+func (e keyringEntry) mintedKey() (mintedKey, error) {
+	publicKey, err := hex.DecodeString(e.PublicKey)
+	if err != nil {
+		return mintedKey{}, err
+	}
+	privateKey, err := hex.DecodeString(e.PrivateKey)
+	if err != nil {
+		return mintedKey{}, err
+	}
+	contents, err := odoh.CreateObliviousDoHConfigContents(hpke.KEMID(e.KemID), hpke.KDFID(e.KdfID), hpke.AEADID(e.AeadID), publicKey)
+	if err != nil {
+		return mintedKey{}, err
+	}
+	return mintedKey{
+		Config:     odoh.ObliviousDoHConfig{Version: e.Version, Contents: contents},
+		PrivateKey: privateKey,
+	}, nil
+}
+
+func loadKeyring(path string) (*keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ring keyring
+	if err := json.Unmarshal(data, &ring); err != nil {
+		return nil, fmt.Errorf("unable to parse the keyring %v: %v", path, err)
+	}
+	return &ring, nil
+}
+
+func (k *keyring) save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The keyring holds private keys.
+	return writeOutput(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+func (k *keyring) keysInState(state string) []int {
+	indices := make([]int, 0)
+	for i, entry := range k.Keys {
+		if entry.State == state {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// published returns the keys whose configs should be published, the active key first.
+func (k *keyring) published() []keyringEntry {
+	entries := make([]keyringEntry, 0)
+	for _, state := range []string{KEY_STATE_ACTIVE, KEY_STATE_NEXT} {
+		for _, i := range k.keysInState(state) {
+			entries = append(entries, k.Keys[i])
+		}
+	}
+	return entries
+}
+
+// accepted returns the keys a target must still be able to decrypt queries for.
+func (k *keyring) accepted() []keyringEntry {
+	entries := k.published()
+	for _, i := range k.keysInState(KEY_STATE_RETIRING) {
+		entries = append(entries, k.Keys[i])
+	}
+	return entries
+}
+
+func (k *keyring) maxTTL() time.Duration {
+	return time.Duration(k.MaxTTL) * time.Second
+}
+
+func mintKeyringKey(c *cli.Context) (mintedKey, error) {
+	suites, err := mintSuites(c)
+	if err != nil {
+		return mintedKey{}, err
+	}
+	if len(suites) != 1 {
+		return mintedKey{}, errors.New("a keyring key is minted for exactly one HPKE suite")
+	}
+	version, err := parseMintVersion(c.String("odoh-version"))
+	if err != nil {
+		return mintedKey{}, err
+	}
+	return mintKey(suites[0], version, nil)
+}
+
+func rotateInit(c *cli.Context) error {
+	path := c.String("keyring")
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("keyring %v already exists", path)
+	}
+	key, err := mintKeyringKey(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	entry := newKeyringEntry(key, KEY_STATE_ACTIVE, now)
+	entry.Activated = now
+	ring := keyring{
+		MaxTTL: uint32(c.Duration("max-ttl").Seconds()),
+		Keys:   []keyringEntry{entry},
+	}
+	fmt.Printf("Created keyring %v with active KeyID(%s)\n", path, entry.KeyID)
+	return ring.save(path)
+}
+
+// rotatePrepare mints the next key and pre-publishes it next to the active one.
+func rotatePrepare(c *cli.Context) error {
+	path := c.String("keyring")
+	ring, err := loadKeyring(path)
+	if err != nil {
+		return err
+	}
+	if len(ring.keysInState(KEY_STATE_NEXT)) > 0 {
+		return errors.New("a next key is already pre-published, switch to it first")
+	}
+	key, err := mintKeyringKey(c)
+	if err != nil {
+		return err
+	}
+
+	entry := newKeyringEntry(key, KEY_STATE_NEXT, time.Now().UTC())
+	ring.Keys = append(ring.Keys, entry)
+	fmt.Printf("Prepared next KeyID(%s), publish it and switch to it after %v\n", entry.KeyID, ring.maxTTL())
+	return ring.save(path)
+}
+
+// rotateSwitch makes the next key active and stops publishing the previously active one.
+func rotateSwitch(c *cli.Context) error {
+	path := c.String("keyring")
+	ring, err := loadKeyring(path)
+	if err != nil {
+		return err
+	}
+	next := ring.keysInState(KEY_STATE_NEXT)
+	if len(next) == 0 {
+		return errors.New("no next key to switch to, prepare one first")
+	}
+
+	now := time.Now().UTC()
+	if ring.Keys[next[0]].Published.IsZero() && !c.Bool("force") {
+		return errors.New("the next key has not been published yet, run publish first or use --force")
+	}
+	prePublished := now.Sub(ring.Keys[next[0]].Published)
+	if prePublished < ring.maxTTL() && !c.Bool("force") {
+		return fmt.Errorf("the next key was only published %v ago, wait until %v have passed or use --force", prePublished.Round(time.Second), ring.maxTTL())
+	}
+
+	for _, i := range ring.keysInState(KEY_STATE_ACTIVE) {
+		ring.Keys[i].State = KEY_STATE_RETIRING
+		ring.Keys[i].Deactivated = now
+	}
+	ring.Keys[next[0]].State = KEY_STATE_ACTIVE
+	ring.Keys[next[0]].Activated = now
+	fmt.Printf("Switched to KeyID(%s), retire the previous key after %v\n", ring.Keys[next[0]].KeyID, ring.maxTTL())
+	return ring.save(path)
+}
+
+// rotateRetire forgets the keys that clients can no longer have cached configs for.
+func rotateRetire(c *cli.Context) error {
+	path := c.String("keyring")
+	ring, err := loadKeyring(path)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	retired := 0
+	for _, i := range ring.keysInState(KEY_STATE_RETIRING) {
+		if ring.Keys[i].Unpublished.IsZero() && !c.Bool("force") {
+			fmt.Printf("Keeping KeyID(%s), still published until the next publish\n", ring.Keys[i].KeyID)
+			continue
+		}
+		unpublished := now.Sub(ring.Keys[i].Unpublished)
+		if unpublished < ring.maxTTL() && !c.Bool("force") {
+			fmt.Printf("Keeping KeyID(%s), unpublished only %v ago\n", ring.Keys[i].KeyID, unpublished.Round(time.Second))
+			continue
+		}
+		ring.Keys[i].State = KEY_STATE_RETIRED
+		ring.Keys[i].Retired = now
+		ring.Keys[i].PrivateKey = ""
+		fmt.Printf("Retired KeyID(%s)\n", ring.Keys[i].KeyID)
+		retired++
+	}
+	if retired == 0 {
+		return nil
+	}
+	return ring.save(path)
+}
+
+func rotateStatus(c *cli.Context) error {
+	ring, err := loadKeyring(c.String("keyring"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Keyring %v (max TTL %v):\n", c.String("keyring"), ring.maxTTL())
+	for _, entry := range ring.Keys {
+		fmt.Printf("  %-8s Version(0x%04x), KEM(0x%04x), KDF(0x%04x), AEAD(0x%04x) KeyID(%s) created %v\n",
+			entry.State, entry.Version, entry.KemID, entry.KdfID, entry.AeadID, entry.KeyID, entry.Created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// rotatePublish emits the ObliviousDoHConfigs to publish for the current stage, and optionally the
+// private keys the target must accept. It records when each key was first published, and when the
+// configs first left out each retiring key.
+func rotatePublish(c *cli.Context) error {
+	path := c.String("keyring")
+	ring, err := loadKeyring(path)
+	if err != nil {
+		return err
+	}
+
+	configs := make([]odoh.ObliviousDoHConfig, 0)
+	for _, entry := range ring.published() {
+		key, err := entry.mintedKey()
+		if err != nil {
+			return fmt.Errorf("invalid keyring entry KeyID(%s): %v", entry.KeyID, err)
+		}
+		configs = append(configs, key.Config)
+	}
+	serializedConfigs := odoh.CreateObliviousDoHConfigs(configs).Marshal()
+
+	err = writeOutput(c.String("config-out"), 0644, func(w io.Writer) error {
+		switch c.String("format") {
+		case "pem":
+			return writeConfigsPEM(w, serializedConfigs)
+		case "hex":
+			_, err := fmt.Fprintf(w, "%x\n", serializedConfigs)
+			return err
+		case "base64":
+			_, err := fmt.Fprintln(w, base64.StdEncoding.EncodeToString(serializedConfigs))
+			return err
+		default:
+			return fmt.Errorf("unknown format %q, expected pem, hex or base64", c.String("format"))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(c.String("private-key-out")) > 0 {
+		keys := make([]mintedKey, 0)
+		for _, entry := range ring.accepted() {
+			key, err := entry.mintedKey()
+			if err != nil {
+				return fmt.Errorf("invalid keyring entry KeyID(%s): %v", entry.KeyID, err)
+			}
+			keys = append(keys, key)
+		}
+		err = writeOutput(c.String("private-key-out"), 0600, func(w io.Writer) error {
+			return writePrivateKeysPEM(w, keys)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	changed := false
+	for i, entry := range ring.Keys {
+		switch {
+		case (entry.State == KEY_STATE_ACTIVE || entry.State == KEY_STATE_NEXT) && entry.Published.IsZero():
+			ring.Keys[i].Published = now
+			changed = true
+		case entry.State == KEY_STATE_RETIRING && entry.Unpublished.IsZero():
+			ring.Keys[i].Unpublished = now
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return ring.save(path)
+}
@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hpkeSuite is a single (KEM, KDF, AEAD) HPKE ciphersuite as advertised in an ObliviousDoHConfigContents.
+type hpkeSuite struct {
+	KemID  hpke.KEMID
+	KdfID  hpke.KDFID
+	AeadID hpke.AEADID
+}
+
+func (s hpkeSuite) String() string {
+	return fmt.Sprintf("KEM(0x%04x), KDF(0x%04x), AEAD(0x%04x)", uint16(s.KemID), uint16(s.KdfID), uint16(s.AeadID))
+}
+
+func suiteOfConfig(config odoh.ObliviousDoHConfig) hpkeSuite {
+	return hpkeSuite{
+		KemID:  config.Contents.KemID,
+		KdfID:  config.Contents.KdfID,
+		AeadID: config.Contents.AeadID,
+	}
+}
+
+// The default client preference favours X25519 over the NIST curves and AES-128-GCM over the other AEADs.
+// Supported suites which are not listed are still used, after all of the listed ones.
+var defaultSuitePreference = []hpkeSuite{
+	{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128},
+	{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_CHACHA20POLY1305},
+	{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM256},
+	{hpke.DHKEM_P256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128},
+	{hpke.DHKEM_P256, hpke.KDF_HKDF_SHA256, hpke.AEAD_CHACHA20POLY1305},
+	{hpke.DHKEM_P256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM256},
+}
+
+// parseSuitePreference reads a comma separated list of KEM:KDF:AEAD identifiers, given in decimal
+// as for `odohconfig-mint`, e.g. "32:1:1,16:1:1". An empty string yields the default preference.
+func parseSuitePreference(preference string) ([]hpkeSuite, error) {
+	if len(strings.TrimSpace(preference)) == 0 {
+		return defaultSuitePreference, nil
+	}
+
+	suites := make([]hpkeSuite, 0)
+	for _, entry := range strings.Split(preference, ",") {
+		identifiers := strings.Split(strings.TrimSpace(entry), ":")
+		if len(identifiers) != 3 {
+			return nil, fmt.Errorf("invalid HPKE suite %q, expected KEM:KDF:AEAD", entry)
+		}
+		values := make([]uint16, 3)
+		for i, identifier := range identifiers {
+			value, err := strconv.ParseUint(identifier, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid HPKE suite %q: %v", entry, err)
+			}
+			values[i] = uint16(value)
+		}
+		suites = append(suites, hpkeSuite{hpke.KEMID(values[0]), hpke.KDFID(values[1]), hpke.AEADID(values[2])})
+	}
+	return suites, nil
+}
+
+func isSupportedConfigVersion(version uint16) bool {
+	return version == ODOH_VERSION_DRAFT || version == ODOH_VERSION_RFC9230
+}
+
+// checkConfigSupported reports why a config cannot be used by this client, or nil if it can.
+func checkConfigSupported(config odoh.ObliviousDoHConfig) error {
+	if !isSupportedConfigVersion(config.Version) {
+		return fmt.Errorf("unsupported version 0x%04x", config.Version)
+	}
+	suite, err := config.Contents.CipherSuite()
+	if err != nil {
+		return fmt.Errorf("unsupported HPKE suite %v: %v", suiteOfConfig(config), err)
+	}
+	if _, err := suite.KEM.Deserialize(config.Contents.PublicKeyBytes); err != nil {
+		return fmt.Errorf("invalid public key for HPKE suite %v: %v", suiteOfConfig(config), err)
+	}
+	if config.Version == ODOH_VERSION_RFC9230 {
+		if _, err := newDHKEM(config.Contents.KemID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderConfigs drops the configs this client cannot or may not use and sorts the remainder first by
+// the given version preference and then by the given suite preference. Configs which are equally
+// preferred keep the order in which the target published them.
+func orderConfigs(configs odoh.ObliviousDoHConfigs, versions []uint16, preference []hpkeSuite) []odoh.ObliviousDoHConfig {
+	versionRank := func(config odoh.ObliviousDoHConfig) int {
+		for i, version := range versions {
+			if config.Version == version {
+				return i
+			}
+		}
+		return -1
+	}
+	suiteRank := func(config odoh.ObliviousDoHConfig) int {
+		suite := suiteOfConfig(config)
+		for i, preferred := range preference {
+			if suite == preferred {
+				return i
+			}
+		}
+		return len(preference)
+	}
+
+	usable := make([]odoh.ObliviousDoHConfig, 0, len(configs.Configs))
+	for _, config := range configs.Configs {
+		if versionRank(config) >= 0 && checkConfigSupported(config) == nil {
+			usable = append(usable, config)
+		}
+	}
+	sort.SliceStable(usable, func(i, j int) bool {
+		if versionRank(usable[i]) != versionRank(usable[j]) {
+			return versionRank(usable[i]) < versionRank(usable[j])
+		}
+		return suiteRank(usable[i]) < suiteRank(usable[j])
+	})
+	return usable
+}
+
+// createOdohQuestionWithConfigs encrypts the query to the most preferred usable config, falling
+// back to the next one whenever encryption fails. It returns the config that was eventually used.
+func createOdohQuestionWithConfigs(dnsMessage []byte, configs []odoh.ObliviousDoHConfig) (odoh.ObliviousDNSMessage, odohQueryContext, odoh.ObliviousDoHConfig, error) {
+	if len(configs) == 0 {
+		return odoh.ObliviousDNSMessage{}, odohQueryContext{}, odoh.ObliviousDoHConfig{}, errors.New("no usable ObliviousDoHConfig available")
+	}
+
+	failures := make([]string, 0)
+	for _, config := range configs {
+		odohQuery, queryContext, err := createOdohQuestion(dnsMessage, config)
+		if err == nil {
+			return odohQuery, queryContext, config, nil
+		}
+		failures = append(failures, fmt.Sprintf("KeyID(%x): %v", config.Contents.KeyID(), err))
+	}
+	return odoh.ObliviousDNSMessage{}, odohQueryContext{}, odoh.ObliviousDoHConfig{}, fmt.Errorf("unable to encrypt to any ObliviousDoHConfig [%s]", strings.Join(failures, "; "))
+}
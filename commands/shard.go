@@ -0,0 +1,126 @@
+package commands
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"golang.org/x/net/publicsuffix"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Sharding spreads the queries of a client over several targets by registrable domain, so that
+// each target only sees the part of the browsing that falls on its shard. A keyed hash places the
+// targets and the domains on a consistent hashing ring: the same key gives the same assignment
+// across restarts, and a target joining or leaving only moves the domains of its own shard. The key
+// stays with the client, so that no target can work out which domains went to the others.
+
+type shardPoint struct {
+	hash   uint64
+	target string
+}
+
+type shardRing struct {
+	key     []byte
+	targets []string
+	points  []shardPoint
+}
+
+func newShardRing(key []byte, targets []string) (*shardRing, error) {
+	if len(key) == 0 {
+		return nil, errors.New("the shard key is empty")
+	}
+	ring := &shardRing{key: key}
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		ring.targets = append(ring.targets, target)
+		// Virtual nodes even out the share of each target.
+		for i := 0; i < SHARD_VIRTUAL_NODES; i++ {
+			ring.points = append(ring.points, shardPoint{ring.hash(fmt.Sprintf("target %s %d", target, i)), target})
+		}
+	}
+	if len(ring.targets) == 0 {
+		return nil, errors.New("no targets to shard queries across")
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	return ring, nil
+}
+
+func (r *shardRing) hash(value string) uint64 {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// targetFor returns the target of the shard of the registrable domain of the name.
+func (r *shardRing) targetFor(name string) string {
+	hash := r.hash("domain " + registrableDomain(name))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].target
+}
+
+// registrableDomain returns the name's effective TLD plus one label from the public suffix list, so
+// that all the names of a site share a shard. Names that are a public suffix themselves or are not
+// valid are returned as they are.
+func registrableDomain(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return domain
+	}
+	return name
+}
+
+// loadShardKey reads the hex encoded shard key, creating a random one the first time.
+func loadShardKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, SHARD_KEY_SIZE)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the shard key %v: %v", path, err)
+	}
+	return key, nil
+}
+
+// queryTarget returns the target to send the query for the domain to: --target, or the target of
+// its shard under --shard-targets. shard describes the assignment for the trace.
+func queryTarget(c *cli.Context, domain string) (target string, shard string, err error) {
+	targets := splitList(c.StringSlice("shard-targets"))
+	if len(targets) == 0 {
+		return c.String("target"), "", nil
+	}
+	key, err := loadShardKey(c.String("shard-key"))
+	if err != nil {
+		return "", "", err
+	}
+	ring, err := newShardRing(key, targets)
+	if err != nil {
+		return "", "", err
+	}
+	target = ring.targetFor(domain)
+	return target, fmt.Sprintf("%s on %s, one of %d targets", registrableDomain(domain), target, len(ring.targets)), nil
+}
@@ -10,44 +10,67 @@ import (
 
 type state struct {
 	sync.RWMutex
-	configContents map[string]odoh.ObliviousDoHConfigContents
-	client         []*http.Client
+	configs map[string][]odoh.ObliviousDoHConfig
+	// ohttpConfigs holds the OHTTP key configs of the gateways of the targets for `--protocol ohttp`.
+	ohttpConfigs map[string][]ohttpKeyConfig
+	client       []*http.Client
 }
 
 var instance state
 
-func GetInstance(N uint64) *state {
+// GetInstance resets the state with N clients, each with its own copy of httpTransport.
+func GetInstance(N uint64) (*state, error) {
+	base, ok := httpTransport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("the benchmark clients need an http.Transport")
+	}
 	instance.client = make([]*http.Client, N)
 	for index := 0; index < int(N); index++ {
-		tr := &http.Transport{
-			MaxIdleConnsPerHost: 1024,
-			TLSHandshakeTimeout: 0 * time.Second,
-			// Uncomment the line below to explicitly disable http/2 in the clients.
-			//TLSNextProto: make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
-		}
-		instance.client[index] = &http.Client{Transport: tr}
+		tr := base.Clone()
+		tr.MaxIdleConnsPerHost = 1024
+		tr.TLSHandshakeTimeout = 0 * time.Second
+		// Uncomment the line below to explicitly disable http/2 in the clients.
+		//tr.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+		instance.client[index] = &http.Client{Transport: tr, Timeout: HTTP_CLIENT_TIMEOUT}
+	}
+	instance.configs = make(map[string][]odoh.ObliviousDoHConfig)
+	instance.ohttpConfigs = make(map[string][]ohttpKeyConfig)
+	return &instance, nil
+}
+
+// InsertConfigs stores the usable configs of a target, ordered by client preference.
+func (s *state) InsertConfigs(targethost string, configs []odoh.ObliviousDoHConfig) {
+	s.Lock()
+	defer s.Unlock()
+	s.configs[targethost] = configs
+}
+
+func (s *state) GetTargetConfigs(targethost string) ([]odoh.ObliviousDoHConfig, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if configs, ok := s.configs[targethost]; ok && len(configs) > 0 {
+		return configs, nil
 	}
-	instance.configContents = make(map[string]odoh.ObliviousDoHConfigContents)
-	return &instance
+	return nil, errors.New("public key for target not available")
 }
 
-func (s *state) InsertKey(targethost string, key odoh.ObliviousDoHConfigContents) {
+func (s *state) InsertOHTTPConfigs(targethost string, configs []ohttpKeyConfig) {
 	s.Lock()
 	defer s.Unlock()
-	s.configContents[targethost] = key
+	s.ohttpConfigs[targethost] = configs
 }
 
-func (s *state) GetTargetConfigContents(targethost string) (odoh.ObliviousDoHConfigContents, error) {
+func (s *state) GetOHTTPConfigs(targethost string) ([]ohttpKeyConfig, error) {
 	s.RLock()
 	defer s.RUnlock()
-	if key, ok := s.configContents[targethost]; ok {
-		return key, nil
+	if configs, ok := s.ohttpConfigs[targethost]; ok && len(configs) > 0 {
+		return configs, nil
 	}
-	return odoh.ObliviousDoHConfigContents{}, errors.New("public key for target not available")
+	return nil, errors.New("OHTTP key for target not available")
 }
 
 func (s *state) TotalNumberOfTargets() int {
 	s.RLock()
 	defer s.RUnlock()
-	return len(s.configContents)
+	return len(s.configs) + len(s.ohttpConfigs)
 }
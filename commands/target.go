@@ -0,0 +1,324 @@
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	hpke "github.com/cisco/go-hpke"
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// odohTarget decrypts ODoH queries, resolves them and encrypts the answers.
+type odohTarget struct {
+	keys []mintedKey
+	// configs is the serialized ObliviousDoHConfigs list served on the well-known endpoint.
+	configs   []byte
+	configTTL uint32
+	resolver  dnsResolver
+	// ohttpKeys enables the Oblivious HTTP gateway for DoH queries when not empty.
+	ohttpKeys []ohttpGatewayKey
+}
+
+func (t *odohTarget) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ODOH_CONFIG_WELLKNOWN_URL, t.configsHandler)
+	mux.HandleFunc("/dns-query", t.queryHandler)
+	if len(t.ohttpKeys) > 0 {
+		mux.HandleFunc(OHTTP_GATEWAY_WELLKNOWN_URL, t.ohttpGatewayHandler)
+	}
+	return mux
+}
+
+func (t *odohTarget) configsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", t.configTTL))
+	w.Write(t.configs)
+}
+
+// hasContentType compares the media type of a Content-Type header, ignoring any parameters.
+func hasContentType(header string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	return err == nil && mediaType == contentType
+}
+
+// readLimitedBody reads at most limit bytes of a request or response body.
+func readLimitedBody(body io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("body larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// resolve answers a serialized DNS query, with SERVFAIL if the upstream fails. The status is not
+// http.StatusOK if the query cannot be answered.
+func (t *odohTarget) resolve(dnsMessage []byte) ([]byte, int) {
+	dnsQuery := new(dns.Msg)
+	if err := dnsQuery.Unpack(dnsMessage); err != nil {
+		return nil, http.StatusBadRequest
+	}
+	dnsResponse, err := t.resolver.Resolve(dnsQuery)
+	if err != nil {
+		log.Printf("upstream resolution failed: %v", err)
+		dnsResponse = new(dns.Msg)
+		dnsResponse.SetRcode(dnsQuery, dns.RcodeServerFailure)
+	}
+	dnsResponse.Id = dnsQuery.Id
+	packedResponse, err := dnsResponse.Pack()
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	return packedResponse, http.StatusOK
+}
+
+func (t *odohTarget) queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasContentType(r.Header.Get("Content-Type"), OBLIVIOUS_DOH) {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := readLimitedBody(r.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	message, err := unmarshalObliviousMessage(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, queryContext, err := openQuery(message, t.keys)
+	if err == errUnknownKeyID {
+		// RFC 9230 asks clients to refetch the configs when the target rejects their key.
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	packedResponse, status := t.resolve(query.DnsMessage)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	answer, err := queryContext.SealAnswer(packedResponse, 0)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", OBLIVIOUS_DOH)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Write(answer.Marshal())
+}
+
+// ohttpGatewayHandler publishes the OHTTP keys and answers encapsulated DoH queries. Errors in the
+// encapsulated request are reported in the encapsulated response, so that only the client sees them.
+func (t *odohTarget) ohttpGatewayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		keys := make([]ohttpKeyConfig, 0, len(t.ohttpKeys))
+		for _, key := range t.ohttpKeys {
+			keys = append(keys, key.Config)
+		}
+		w.Header().Set("Content-Type", OHTTP_KEYS)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", t.configTTL))
+		w.Write(marshalOHTTPKeyConfigs(keys))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasContentType(r.Header.Get("Content-Type"), OHTTP_REQUEST) {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := readLimitedBody(r.Body, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	serialized, requestContext, err := decapsulateRequest(body, t.ohttpKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := bhttpResponse{Status: http.StatusOK, Header: make(http.Header)}
+	request, err := unmarshalBinaryRequest(serialized)
+	switch {
+	case err != nil:
+		response.Status = http.StatusBadRequest
+	case request.Path != "/dns-query":
+		response.Status = http.StatusNotFound
+	case request.Method != http.MethodPost:
+		response.Status = http.StatusMethodNotAllowed
+	case !hasContentType(request.Header.Get("Content-Type"), DOH_MESSAGE):
+		response.Status = http.StatusUnsupportedMediaType
+	default:
+		response.Content, response.Status = t.resolve(request.Content)
+	}
+	if response.Status == http.StatusOK {
+		response.Header.Set("Content-Type", DOH_MESSAGE)
+	}
+
+	encapsulated, err := requestContext.SealResponse(response.Marshal())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", OHTTP_RESPONSE)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Write(encapsulated)
+}
+
+// selfSignedCertificate creates a throwaway ECDSA certificate for the given host names and addresses.
+func selfSignedCertificate(hosts []string) (tls.Certificate, []byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "odoh-client local target"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if len(host) > 0 {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: privateKey}, certificatePEM, nil
+}
+
+// serverCertificate loads `--cert` and `--key`, or creates a self-signed certificate for the listen
+// address and localhost, written to `--cert-out` so that clients can trust it via SSL_CERT_FILE.
+func serverCertificate(c *cli.Context, listen string) (tls.Certificate, error) {
+	if len(c.String("cert")) > 0 || len(c.String("key")) > 0 {
+		return tls.LoadX509KeyPair(c.String("cert"), c.String("key"))
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certificate, certificatePEM, err := selfSignedCertificate([]string{host, "localhost", "127.0.0.1", "::1"})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if len(c.String("cert-out")) > 0 {
+		if err := ioutil.WriteFile(c.String("cert-out"), certificatePEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	} else {
+		log.Printf("Using a self-signed certificate, pass --cert-out to save it for SSL_CERT_FILE")
+	}
+	return certificate, nil
+}
+
+func runTarget(c *cli.Context) error {
+	configs, serializedConfigs, err := readConfigsPEM(c.String("config"))
+	if err != nil {
+		return err
+	}
+	if len(configs.Configs) == 0 {
+		return errors.New("no supported ObliviousDoHConfig to serve")
+	}
+	keys, err := readPrivateKeysPEM(c.String("private-key"), configs)
+	if err != nil {
+		return err
+	}
+
+	var resolver dnsResolver
+	if len(c.String("zone")) > 0 {
+		resolver, err = loadZoneResolver(c.String("zone"))
+	} else {
+		resolver, err = newDNSResolver(c.String("upstream"), c.Duration("upstream-timeout"))
+	}
+	if err != nil {
+		return err
+	}
+
+	target := &odohTarget{
+		keys:      keys,
+		configs:   serializedConfigs,
+		configTTL: uint32(c.Duration("config-ttl").Seconds()),
+		resolver:  resolver,
+	}
+	if c.Bool("ohttp") {
+		// The gateway key lives as long as the process; clients fetch it from the gateway.
+		key, err := newOHTTPGatewayKey(0, hpkeSuite{hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128})
+		if err != nil {
+			return err
+		}
+		target.ohttpKeys = []ohttpGatewayKey{key}
+	}
+
+	listen := c.String("listen")
+	certificate, err := serverCertificate(c, listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:         listen,
+		Handler:      target.handler(),
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{certificate}},
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	for _, key := range keys {
+		fmt.Fprintf(os.Stderr, "Serving Version(0x%04x), %v KeyID(%x)\n", key.Config.Version, suiteOfConfig(key.Config), key.Config.Contents.KeyID())
+	}
+	fmt.Fprintf(os.Stderr, "ODoH target listening on https://%v\n", listen)
+	if len(target.ohttpKeys) > 0 {
+		fmt.Fprintf(os.Stderr, "OHTTP gateway listening on %v\n", ohttpGatewayURL(listen))
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,185 @@
+package commands
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/urfave/cli"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// The proxy and the target can correlate a client's queries by when they arrive, even though neither
+// sees both the client and the question. A timing policy decouples the moment a query is asked from
+// the moment it is sent:
+//   - jitter delays each query by a random time up to the jitter.
+//   - batch holds the queries and releases them together at every multiple of the interval, so
+//     that every client using the same interval sends at the same instants.
+//   - constant-rate sends exactly one query per interval, a dummy one if none is waiting.
+
+type timingPolicy struct {
+	Mode     string
+	Jitter   time.Duration
+	Interval time.Duration
+}
+
+func parseTimingPolicy(mode string, jitter time.Duration, interval time.Duration) (timingPolicy, error) {
+	policy := timingPolicy{Mode: mode, Jitter: jitter, Interval: interval}
+	switch mode {
+	case "", TIMING_NONE:
+		policy.Mode = TIMING_NONE
+	case TIMING_JITTER:
+		if jitter <= 0 {
+			return policy, fmt.Errorf("%s needs a positive jitter", mode)
+		}
+	case TIMING_BATCH, TIMING_CONSTANT_RATE:
+		if interval <= 0 {
+			return policy, fmt.Errorf("%s needs a positive interval", mode)
+		}
+	default:
+		return policy, fmt.Errorf("unknown timing policy %q, expected %s, %s, %s or %s", mode, TIMING_NONE, TIMING_JITTER, TIMING_BATCH, TIMING_CONSTANT_RATE)
+	}
+	return policy, nil
+}
+
+// newTimingPolicy reads the --timing, --jitter and --interval flags of odoh and bench.
+func newTimingPolicy(c *cli.Context) (timingPolicy, error) {
+	return parseTimingPolicy(c.String("timing"), c.Duration("jitter"), c.Duration("interval"))
+}
+
+func (p timingPolicy) String() string {
+	switch p.Mode {
+	case TIMING_JITTER:
+		return fmt.Sprintf("%s(%v)", p.Mode, p.Jitter)
+	case TIMING_BATCH, TIMING_CONSTANT_RATE:
+		return fmt.Sprintf("%s(%v)", p.Mode, p.Interval)
+	default:
+		return p.Mode
+	}
+}
+
+// randomDuration returns a uniformly random duration in [0, max], from a source the proxy cannot
+// predict.
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)+1))
+	if err != nil {
+		return max
+	}
+	return time.Duration(n.Int64())
+}
+
+// nextSlot returns the next multiple of the interval after now, in wall clock time.
+func nextSlot(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
+
+// queryScheduler releases the queries submitted to it according to the timing policy. Queries
+// are sent on their own goroutine once released.
+type queryScheduler struct {
+	policy timingPolicy
+	// dummy sends a dummy query, for the empty slots of constant-rate.
+	dummy func()
+
+	lock    sync.Mutex
+	pending []func()
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newQueryScheduler(policy timingPolicy, dummy func()) *queryScheduler {
+	s := &queryScheduler{
+		policy: policy,
+		dummy:  dummy,
+		done:   make(chan struct{}),
+	}
+	if policy.Mode == TIMING_BATCH || policy.Mode == TIMING_CONSTANT_RATE {
+		go s.releaseSlots()
+	} else {
+		close(s.done)
+	}
+	return s
+}
+
+// Submit hands a query over to the scheduler, which calls send when the policy releases it.
+func (s *queryScheduler) Submit(send func()) {
+	s.wg.Add(1)
+	release := func() {
+		defer s.wg.Done()
+		send()
+	}
+	switch s.policy.Mode {
+	case TIMING_JITTER:
+		delay := randomDuration(s.policy.Jitter)
+		go func() {
+			time.Sleep(delay)
+			release()
+		}()
+	case TIMING_BATCH, TIMING_CONSTANT_RATE:
+		s.lock.Lock()
+		s.pending = append(s.pending, release)
+		s.lock.Unlock()
+	default:
+		go release()
+	}
+}
+
+func (s *queryScheduler) releaseSlots() {
+	defer close(s.done)
+	for {
+		time.Sleep(time.Until(nextSlot(time.Now(), s.policy.Interval)))
+
+		s.lock.Lock()
+		var released []func()
+		if s.policy.Mode == TIMING_BATCH {
+			released, s.pending = s.pending, nil
+		} else if len(s.pending) > 0 {
+			released, s.pending = s.pending[:1], s.pending[1:]
+		}
+		finished := s.closed && len(s.pending) == 0
+		s.lock.Unlock()
+
+		for _, release := range released {
+			go release()
+		}
+		if finished {
+			return
+		}
+		if len(released) == 0 && s.policy.Mode == TIMING_CONSTANT_RATE && s.dummy != nil {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.dummy()
+			}()
+		}
+	}
+}
+
+// Close waits until every submitted query has been sent and stops the dummy queries.
+func (s *queryScheduler) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	<-s.done
+	s.wg.Wait()
+}
+
+// scheduleQuery sends the query, among the decoys of cover traffic in random order, under the
+// policy and returns how long the policy held the query back.
+func scheduleQuery(policy timingPolicy, send func(), decoys []func()) time.Duration {
+	scheduler := newQueryScheduler(policy, nil)
+	queued := time.Now()
+	var released time.Time
+	query := func() {
+		released = time.Now()
+		send()
+	}
+	for _, query := range shuffleQueries(query, decoys) {
+		scheduler.Submit(query)
+	}
+	scheduler.Close()
+	return released.Sub(queued)
+}
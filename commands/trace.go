@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// odohTrace records the phases of a single ODoH exchange for `odoh --trace`.
+type odohTrace struct {
+	sync.Mutex
+	// Protocol is PROTOCOL_OHTTP for `--protocol ohttp`, where KeyID identifies the OHTTP key and
+	// ConfigSource the gateway; it is empty for ODoH.
+	Protocol     string
+	KeyID        uint8
+	ConfigSource string
+	ConfigTTL    uint32
+	ConfigFetch  time.Duration
+	Version      uint16
+	Suite        hpkeSuite
+	Seal         time.Duration
+	Open         time.Duration
+	Exchange     time.Duration
+	// TimingDelay is how long the Timing policy held the query back before the exchange.
+	Timing      timingPolicy
+	TimingDelay time.Duration
+	// Decoys counts the cover queries sent along with the query.
+	Decoys int
+	// Shard describes the shard of the query under --shard-targets.
+	Shard string
+	// Scrubbed counts the out-of-bailiwick additional records removed by --strict.
+	Scrubbed     int
+	QuerySize    int
+	ResponseSize int
+	// Network phases, as reported by httptrace for the connection to the proxy or target.
+	DNSLookup       time.Duration
+	Connect         time.Duration
+	TLSHandshake    time.Duration
+	TimeToFirstByte time.Duration
+	RemoteAddr      string
+	ReusedConn      bool
+	TLSVersion      uint16
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+}
+
+func (t *odohTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.Lock()
+			defer t.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.Lock()
+			defer t.Unlock()
+			t.DNSLookup = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			t.Lock()
+			defer t.Unlock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.Lock()
+			defer t.Unlock()
+			if err == nil {
+				t.Connect = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.Lock()
+			defer t.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.Lock()
+			defer t.Unlock()
+			t.TLSHandshake = time.Since(t.tlsStart)
+			t.TLSVersion = state.Version
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.Lock()
+			defer t.Unlock()
+			t.RemoteAddr = info.Conn.RemoteAddr().String()
+			t.ReusedConn = info.Reused
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.Lock()
+			defer t.Unlock()
+			t.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.Lock()
+			defer t.Unlock()
+			t.TimeToFirstByte = time.Since(t.wroteRequest)
+		},
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d.Nanoseconds())/1e6)
+}
+
+// print writes the trace as dig style comments, so that it can follow the DNS answer.
+func (t *odohTrace) print(w io.Writer) {
+	t.Lock()
+	defer t.Unlock()
+	fmt.Fprintf(w, ";; ODoH TRACE:\n")
+	if len(t.Shard) > 0 {
+		fmt.Fprintf(w, ";; shard:              %s\n", t.Shard)
+	}
+	if t.Protocol == PROTOCOL_OHTTP {
+		fmt.Fprintf(w, ";; key fetch:          %s (gateway %s)\n", formatDuration(t.ConfigFetch), t.ConfigSource)
+		fmt.Fprintf(w, ";; hpke seal:          %s (OHTTP KeyID(%d), %v)\n", formatDuration(t.Seal), t.KeyID, t.Suite)
+	} else {
+		fmt.Fprintf(w, ";; config fetch:       %s (source %s, TTL %ds)\n", formatDuration(t.ConfigFetch), t.ConfigSource, t.ConfigTTL)
+		fmt.Fprintf(w, ";; hpke seal:          %s (Version(0x%04x), %v)\n", formatDuration(t.Seal), t.Version, t.Suite)
+	}
+	if t.ReusedConn {
+		fmt.Fprintf(w, ";; connection:         reused %s\n", t.RemoteAddr)
+	} else {
+		fmt.Fprintf(w, ";; dns lookup:         %s\n", formatDuration(t.DNSLookup))
+		fmt.Fprintf(w, ";; tcp connect:        %s (%s)\n", formatDuration(t.Connect), t.RemoteAddr)
+		if t.TLSVersion == 0 {
+			fmt.Fprintf(w, ";; tls handshake:      none\n")
+		} else {
+			fmt.Fprintf(w, ";; tls handshake:      %s (%s)\n", formatDuration(t.TLSHandshake), tlsVersionName(t.TLSVersion))
+		}
+	}
+	if t.Timing.Mode != TIMING_NONE && len(t.Timing.Mode) > 0 {
+		fmt.Fprintf(w, ";; timing delay:       %s (%v)\n", formatDuration(t.TimingDelay), t.Timing)
+	}
+	if t.Scrubbed > 0 {
+		fmt.Fprintf(w, ";; scrubbed:           %d out-of-bailiwick additional records\n", t.Scrubbed)
+	}
+	if t.Decoys > 0 {
+		fmt.Fprintf(w, ";; cover queries:      %d decoys\n", t.Decoys)
+	}
+	fmt.Fprintf(w, ";; time to first byte: %s\n", formatDuration(t.TimeToFirstByte))
+	fmt.Fprintf(w, ";; http exchange:      %s\n", formatDuration(t.Exchange))
+	fmt.Fprintf(w, ";; hpke open:          %s\n", formatDuration(t.Open))
+	fmt.Fprintf(w, ";; query size:         %d bytes\n", t.QuerySize)
+	fmt.Fprintf(w, ";; response size:      %d bytes\n", t.ResponseSize)
+}
@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnsResolver answers the plaintext DNS queries a target decrypted.
+type dnsResolver interface {
+	Resolve(query *dns.Msg) (*dns.Msg, error)
+}
+
+// do53Resolver forwards queries to a classic DNS server over UDP or TCP.
+type do53Resolver struct {
+	client  *dns.Client
+	address string
+}
+
+func (r do53Resolver) Resolve(query *dns.Msg) (*dns.Msg, error) {
+	response, _, err := r.client.Exchange(query, r.address)
+	return response, err
+}
+
+// dohResolver forwards queries to a DoH server with POST requests.
+type dohResolver struct {
+	client *http.Client
+	url    string
+}
+
+func (r dohResolver) Resolve(query *dns.Msg) (*dns.Msg, error) {
+	packedQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewBuffer(packedQuery))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body)
+	bodyBytes, err := readResponse(resp, DOH_MESSAGE, MAX_OBLIVIOUS_MESSAGE_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %v failed: %v", r.url, err)
+	}
+	return parseDnsResponse(bodyBytes)
+}
+
+// zoneResolver answers authoritatively from a static zone file, which keeps tests independent of the network.
+type zoneResolver struct {
+	records map[string][]dns.RR
+}
+
+func loadZoneResolver(path string) (zoneResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return zoneResolver{}, err
+	}
+	defer f.Close()
+
+	resolver := zoneResolver{records: make(map[string][]dns.RR)}
+	parser := dns.NewZoneParser(f, ".", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		resolver.records[name] = append(resolver.records[name], rr)
+	}
+	if err := parser.Err(); err != nil {
+		return zoneResolver{}, err
+	}
+	return resolver, nil
+}
+
+func (r zoneResolver) Resolve(query *dns.Msg) (*dns.Msg, error) {
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Authoritative = true
+	if len(query.Question) != 1 {
+		response.Rcode = dns.RcodeFormatError
+		return response, nil
+	}
+
+	question := query.Question[0]
+	records, ok := r.records[strings.ToLower(question.Name)]
+	if !ok {
+		response.Rcode = dns.RcodeNameError
+		return response, nil
+	}
+	for _, rr := range records {
+		if rr.Header().Rrtype == question.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			response.Answer = append(response.Answer, rr)
+		}
+	}
+	return response, nil
+}
+
+// newDNSResolver reads the `--upstream` flag of the target: "udp://host:port", "tcp://host:port"
+// or an https:// DoH endpoint. A bare host:port is queried over UDP.
+func newDNSResolver(upstream string, timeout time.Duration) (dnsResolver, error) {
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		return dohResolver{client: &http.Client{Timeout: timeout}, url: upstream}, nil
+	case strings.HasPrefix(upstream, "udp://"):
+		return do53Resolver{client: &dns.Client{Net: "udp", Timeout: timeout}, address: strings.TrimPrefix(upstream, "udp://")}, nil
+	case strings.HasPrefix(upstream, "tcp://"):
+		return do53Resolver{client: &dns.Client{Net: "tcp", Timeout: timeout}, address: strings.TrimPrefix(upstream, "tcp://")}, nil
+	case strings.Contains(upstream, "://"):
+		return nil, fmt.Errorf("unsupported upstream %q, expected udp://, tcp:// or https://", upstream)
+	case len(upstream) == 0:
+		return nil, errors.New("no upstream resolver given")
+	default:
+		return do53Resolver{client: &dns.Client{Net: "udp", Timeout: timeout}, address: upstream}, nil
+	}
+}
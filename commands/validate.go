@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Decrypting the answer only proves that it came from the target. Strict validation also checks
+// that it answers the question that was sent: the same ID and question, the QR bit set, and answer
+// records that belong to the question name or to the CNAME and DNAME chain starting from it.
+// Additional records outside the bailiwick of the answer are scrubbed, so that a target cannot
+// plant records for unrelated names.
+
+// answerNames returns the names the answer section may hold records for: the question name and
+// the names the CNAME and DNAME records of the answer lead to.
+func answerNames(question dns.Question, answer []dns.RR) map[string]bool {
+	names := map[string]bool{strings.ToLower(question.Name): true}
+	for changed := true; changed; {
+		changed = false
+		var reached []string
+		for _, rr := range answer {
+			owner := strings.ToLower(rr.Header().Name)
+			switch record := rr.(type) {
+			case *dns.CNAME:
+				if names[owner] {
+					reached = append(reached, strings.ToLower(record.Target))
+				}
+			case *dns.DNAME:
+				// A DNAME at an ancestor of a name rewrites the name under the DNAME target.
+				for name := range names {
+					if name != owner && dns.IsSubDomain(owner, name) {
+						reached = append(reached, owner, strings.TrimSuffix(name, owner)+strings.ToLower(dns.Fqdn(record.Target)))
+					}
+				}
+			}
+		}
+		for _, name := range reached {
+			if !names[name] {
+				names[name] = true
+				changed = true
+			}
+		}
+	}
+	return names
+}
+
+// checkDnsResponse reports why the response does not answer the query, or nil if it does.
+func checkDnsResponse(query *dns.Msg, response *dns.Msg) error {
+	if response.Id != query.Id {
+		return fmt.Errorf("response ID %d does not match query ID %d", response.Id, query.Id)
+	}
+	if !response.Response {
+		return errors.New("QR bit not set, the message is a query")
+	}
+	if len(response.Question) != 1 {
+		return fmt.Errorf("response carries %d questions, expected 1", len(response.Question))
+	}
+	question, asked := response.Question[0], query.Question[0]
+	if !strings.EqualFold(question.Name, asked.Name) {
+		return fmt.Errorf("response is for %s, the query asked for %s", question.Name, asked.Name)
+	}
+	if question.Qtype != asked.Qtype {
+		return fmt.Errorf("response is for type %s, the query asked for %s", dns.TypeToString[question.Qtype], dns.TypeToString[asked.Qtype])
+	}
+	if question.Qclass != asked.Qclass {
+		return fmt.Errorf("response is for class %s, the query asked for %s", dns.ClassToString[question.Qclass], dns.ClassToString[asked.Qclass])
+	}
+	names := answerNames(asked, response.Answer)
+	for _, rr := range response.Answer {
+		if !names[strings.ToLower(rr.Header().Name)] {
+			return fmt.Errorf("answer record for %s is out of bailiwick for %s", rr.Header().Name, asked.Name)
+		}
+	}
+	return nil
+}
+
+// answerBailiwick is the zone the response speaks for: the owner of the SOA or NS records of the
+// authority section when they are an ancestor of the question, else the registrable domain of it.
+func answerBailiwick(question dns.Question, response *dns.Msg) string {
+	for _, rr := range response.Ns {
+		rrtype := rr.Header().Rrtype
+		if (rrtype == dns.TypeSOA || rrtype == dns.TypeNS) && dns.IsSubDomain(rr.Header().Name, question.Name) {
+			return strings.ToLower(rr.Header().Name)
+		}
+	}
+	return dns.Fqdn(registrableDomain(question.Name))
+}
+
+// scrubAdditional removes the additional records outside the bailiwick of the response and returns
+// how many it removed. The OPT pseudo-record is kept.
+func scrubAdditional(query *dns.Msg, response *dns.Msg) int {
+	if len(query.Question) == 0 {
+		return 0
+	}
+	bailiwick := answerBailiwick(query.Question[0], response)
+	kept := response.Extra[:0]
+	removed := 0
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT || dns.IsSubDomain(bailiwick, rr.Header().Name) {
+			kept = append(kept, rr)
+		} else {
+			removed++
+		}
+	}
+	response.Extra = kept
+	return removed
+}
+
+// validateDnsResponse checks the response strictly against the query and scrubs its additional
+// section for `odoh --strict`, returning the number of scrubbed records.
+func validateDnsResponse(query *dns.Msg, response *dns.Msg) (int, error) {
+	if err := checkDnsResponse(query, response); err != nil {
+		return 0, fmt.Errorf("invalid response: %v", err)
+	}
+	return scrubAdditional(query, response), nil
+}
@@ -11,6 +11,8 @@ require (
 	github.com/google/go-cmp v0.5.1 // indirect
 	github.com/miekg/dns v1.1.32
 	github.com/urfave/cli v1.22.4
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
 	golang.org/x/sys v0.0.0-20200728102440-3e129f6d46b1 // indirect
 	google.golang.org/genproto v0.0.0-20200730144737-007c33dbd381 // indirect
 	google.golang.org/grpc v1.31.0 // indirect